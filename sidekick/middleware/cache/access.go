@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/puzpuzpuz/xsync"
+)
+
+var (
+	ErrPurgeNotAllowed = errors.New("client is not allowed")
+	ErrPurgeRateLimit  = errors.New("too many purge requests")
+)
+
+// parseCIDRs parses addresses and CIDR ranges, a bare address is a range of one
+func parseCIDRs(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, v := range list {
+		if strings.Contains(v, "/") {
+			prefix, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// clientIP returns the address of the client. Caddy resolves it through
+// the trusted_proxies of the server, so forwarded headers only count from those.
+func clientIP(r *http.Request) (netip.Addr, error) {
+	address, _ := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+	if address == "" {
+		address = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return addr, err
+	}
+	return addr.WithZone("").Unmap(), nil
+}
+
+// allowed reports whether the client is in one of the ranges, no ranges allow everyone
+func allowed(prefixes []netip.Prefix, addr netip.Addr) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter is a token bucket per client, refilling the whole limit every minute
+type rateLimiter struct {
+	limit   float64
+	buckets *xsync.MapOf[string, *bucket]
+}
+
+type bucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		limit:   float64(perMinute),
+		buckets: xsync.NewMapOf[*bucket](),
+	}
+}
+
+// allow takes a token for the client, reporting false when its bucket is empty
+func (rl *rateLimiter) allow(client string, now time.Time) bool {
+	b, ok := rl.buckets.Load(client)
+	if !ok {
+		rl.prune(now)
+		b, _ = rl.buckets.LoadOrStore(client, &bucket{tokens: rl.limit, last: now})
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(rl.limit, b.tokens+now.Sub(b.last).Minutes()*rl.limit)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops the buckets that refilled completely, they are the same as a new one
+func (rl *rateLimiter) prune(now time.Time) {
+	rl.buckets.Range(func(client string, b *bucket) bool {
+		b.mu.Lock()
+		idle := now.Sub(b.last) > time.Minute
+		b.mu.Unlock()
+		if idle {
+			rl.buckets.Delete(client)
+		}
+		return true
+	})
+}
+
+// checkClient applies the allowlist of the operation
+func (c *Cache) checkClient(r *http.Request) error {
+	addr, err := clientIP(r)
+	if err != nil {
+		return ErrPurgeNotAllowed
+	}
+
+	list := c.purgeAllow
+	if r.Method == "GET" {
+		list = c.listAllow
+	}
+	if !allowed(list, addr) {
+		return ErrPurgeNotAllowed
+	}
+	return nil
+}
+
+// checkRateLimit takes a purge token of the client. It runs once the request
+// is verified, so unsigned requests can't drain the bucket of signed purges.
+func (c *Cache) checkRateLimit(r *http.Request) error {
+	if r.Method != "POST" || c.purgeLimit == nil {
+		return nil
+	}
+	addr, err := clientIP(r)
+	if err != nil {
+		return ErrPurgeNotAllowed
+	}
+	if !c.purgeLimit.allow(addr.String(), time.Now()) {
+		return ErrPurgeRateLimit
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// fromClient sets the client address Caddy resolved for the request
+func fromClient(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{})
+	caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, ip)
+	return r.WithContext(ctx)
+}
+
+// sendPurge sends a request signed with the key "secret" from the client ip
+func sendPurge(c *Cache, method, ip string) *httptest.ResponseRecorder {
+	uri := c.PurgePath + "/a/"
+	r := httptest.NewRequest(method, uri, nil)
+	r.Header.Set(c.PurgeKeyHeader, SignPurge("secret", method, uri, nil, time.Now()))
+	w := httptest.NewRecorder()
+	c.servePurge(w, fromClient(r, ip))
+	return w
+}
+
+func TestPurgeAllowlists(t *testing.T) {
+	c := newTestCache(t, &Cache{
+		TTL:        60,
+		PurgeKey:   "secret",
+		PurgeAllow: []string{"10.0.0.0/8", "2001:db8::/32"},
+		ListAllow:  []string{"192.0.2.7"},
+	})
+
+	tests := []struct {
+		method string
+		ip     string
+		want   int
+	}{
+		{"POST", "10.1.2.3", http.StatusOK},
+		{"POST", "2001:db8::1", http.StatusOK},
+		{"POST", "::ffff:10.1.2.3", http.StatusOK},
+		{"POST", "192.0.2.7", http.StatusForbidden},
+		{"POST", "11.0.0.1", http.StatusForbidden},
+		{"GET", "192.0.2.7", http.StatusOK},
+		{"GET", "10.1.2.3", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if w := sendPurge(c, tt.method, tt.ip); w.Code != tt.want {
+			t.Errorf("%s from %s answered %d, want %d", tt.method, tt.ip, w.Code, tt.want)
+		}
+	}
+}
+
+func TestPurgeAllowUsesResolvedClient(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, PurgeKey: "secret", PurgeAllow: []string{"10.0.0.0/8"}})
+
+	// the connection comes from inside the range, Caddy resolved the client outside it
+	uri := c.PurgePath + "/a/"
+	r := httptest.NewRequest("POST", uri, nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set("X-Forwarded-For", "10.0.0.2")
+	r.Header.Set(c.PurgeKeyHeader, SignPurge("secret", "POST", uri, nil, time.Now()))
+	w := httptest.NewRecorder()
+	c.servePurge(w, fromClient(r, "203.0.113.9"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("client outside the range answered %d, want 403", w.Code)
+	}
+
+	// without a resolved client the connection address counts
+	r = httptest.NewRequest("POST", uri, nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set(c.PurgeKeyHeader, SignPurge("secret", "POST", uri, nil, time.Now()))
+	w = httptest.NewRecorder()
+	c.servePurge(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("connection inside the range answered %d, want 200", w.Code)
+	}
+}
+
+func TestPurgeRateLimit(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, PurgeKey: "secret", PurgeRateLimit: 2})
+
+	// unsigned requests don't use up the limit
+	r := httptest.NewRequest("POST", c.PurgePath+"/a/", nil)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		c.servePurge(w, fromClient(r, "10.0.0.1"))
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("unsigned purge answered %d, want 403", w.Code)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := sendPurge(c, "POST", "10.0.0.1"); w.Code != http.StatusOK {
+			t.Fatalf("purge %d within the limit answered %d", i, w.Code)
+		}
+	}
+	w := sendPurge(c, "POST", "10.0.0.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "31" {
+		t.Errorf("purge over the limit answered %d, Retry-After %q, want 429 and 31", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := sendPurge(c, "POST", "10.0.0.2"); w.Code != http.StatusOK {
+		t.Errorf("another client was limited too: %d", w.Code)
+	}
+	if w := sendPurge(c, "GET", "10.0.0.1"); w.Code != http.StatusOK {
+		t.Errorf("listing was rate limited: %d", w.Code)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	rl := newRateLimiter(2)
+	now := time.Now()
+	if !rl.allow("a", now) || !rl.allow("a", now) || rl.allow("a", now) {
+		t.Fatal("limit of 2 not applied")
+	}
+	if !rl.allow("a", now.Add(30*time.Second)) {
+		t.Error("no token back after half a minute")
+	}
+	if rl.allow("a", now.Add(30*time.Second)) {
+		t.Error("more than one token back after half a minute")
+	}
+}
@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// zones holds the provisioned caches by zone name for the admin API. A zone keeps
+// every cache registered under it, newest last, as a config reload provisions
+// the new handlers before cleaning up the old ones.
+var zones = struct {
+	sync.Mutex
+	m map[string][]*Cache
+}{m: make(map[string][]*Cache)}
+
+func registerZone(c *Cache) {
+	zones.Lock()
+	defer zones.Unlock()
+	zones.m[c.Zone] = append(zones.m[c.Zone], c)
+}
+
+func unregisterZone(c *Cache) {
+	zones.Lock()
+	defer zones.Unlock()
+	list := slices.DeleteFunc(zones.m[c.Zone], func(z *Cache) bool {
+		return z == c
+	})
+	if len(list) == 0 {
+		delete(zones.m, c.Zone)
+		return
+	}
+	zones.m[c.Zone] = list
+}
+
+// lookupZone returns the newest cache of the zone
+func lookupZone(name string) (*Cache, bool) {
+	zones.Lock()
+	defer zones.Unlock()
+	list := zones.m[name]
+	if len(list) == 0 {
+		return nil, false
+	}
+	return list[len(list)-1], true
+}
+
+// AdminAPI manages the caches over the Caddy admin endpoint, so nothing
+// has to be exposed on the public listener:
+//
+//	GET    /wp_cache/                     zone names
+//	POST   /wp_cache/{zone}/purge/{path}  purge like the purge path, always sync
+//	GET    /wp_cache/{zone}/list          cached keys
+//	GET    /wp_cache/{zone}/stats         store sizes
+//	GET    /wp_cache/{zone}/entry/{path}  entries of the page
+//	DELETE /wp_cache/{zone}/entry/{path}  purge the page
+type AdminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "admin.api.wp_cache",
+		New: func() caddy.Module {
+			return new(AdminAPI)
+		},
+	}
+}
+
+// Routes returns the admin routes of the wp_cache zones
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/wp_cache/",
+			Handler: caddy.AdminHandlerFunc(a.handle),
+		},
+	}
+}
+
+func (a *AdminAPI) handle(w http.ResponseWriter, r *http.Request) error {
+	rest := strings.TrimPrefix(r.URL.Path, "/wp_cache/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			return methodNotAllowed(r)
+		}
+		zones.Lock()
+		names := make([]string, 0, len(zones.m))
+		for name := range zones.m {
+			names = append(names, name)
+		}
+		zones.Unlock()
+		slices.Sort(names)
+		return writeJSON(w, names)
+	}
+
+	name, rest, _ := strings.Cut(rest, "/")
+	op, reqPath, _ := strings.Cut(rest, "/")
+	reqPath = "/" + reqPath
+
+	c, ok := lookupZone(name)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown wp_cache zone '%s'", name),
+		}
+	}
+	db := c.Store
+
+	switch op {
+	case "purge":
+		if r.Method != http.MethodPost {
+			return methodNotAllowed(r)
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, purgeBodyMaxSize+1))
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		if len(body) > purgeBodyMaxSize {
+			return caddy.APIError{HTTPStatus: http.StatusRequestEntityTooLarge, Err: ErrPurgeTooLarge}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// the admin host isn't the site, CDN URLs need site_url
+		purge, err := c.preparePurge(w, r, reqPath, c.siteURL(nil))
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		uri := strings.TrimSuffix(c.PurgePath, "/") + reqPath
+		if r.URL.RawQuery != "" {
+			uri += "?" + r.URL.RawQuery
+		}
+		writePurgeResult(w, c.withPeers(purge, r, uri, "", body)())
+		return nil
+
+	case "list":
+		if r.Method != http.MethodGet {
+			return methodNotAllowed(r)
+		}
+		return writeJSON(w, db.List())
+
+	case "stats":
+		if r.Method != http.MethodGet {
+			return methodNotAllowed(r)
+		}
+		return writeJSON(w, db.Stats())
+
+	case "entry":
+		switch r.Method {
+		case http.MethodGet:
+			return writeJSON(w, db.Entries(reqPath))
+		case http.MethodDelete:
+			if !db.cacheKey.Path {
+				return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: ErrPurgePaths}
+			}
+			purge := c.withCDN(func() *PurgeResult {
+				return db.Purge(reqPath, PurgeExact, false)
+			}, r, cdnPurgePath(c.siteURL(nil), reqPath, PurgeExact))
+			uri := strings.TrimSuffix(c.PurgePath, "/") + reqPath + "?mode=exact"
+			writePurgeResult(w, c.withPeers(purge, r, uri, "", nil)())
+			return nil
+		}
+		return methodNotAllowed(r)
+	}
+
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("unknown wp_cache operation '%s'", op),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+func methodNotAllowed(r *http.Request) error {
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method %s not allowed", r.Method),
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// adminDo sends a request to the admin routes of the wp_cache zones
+func adminDo(method, target, body string) (*httptest.ResponseRecorder, error) {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	return w, (&AdminAPI{}).handle(w, r)
+}
+
+// adminStatus returns the status of the API error, 0 for none
+func adminStatus(err error) int {
+	var apiErr caddy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatus
+	}
+	return 0
+}
+
+// newAdminCache provisions a cache of the zone holding the entries
+func newAdminCache(t *testing.T, zone string, keys ...string) *Cache {
+	t.Helper()
+	c := newTestCache(t, &Cache{Zone: zone, TTL: 60})
+	for _, key := range keys {
+		if err := c.Store.Set(key, c.Store.Generation(), http.Header{}, testMeta(), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+func TestAdminZones(t *testing.T) {
+	newAdminCache(t, "admin-b")
+	newAdminCache(t, "admin-a")
+
+	w, err := adminDo(http.MethodGet, "/wp_cache/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	if err := json.Unmarshal(w.Body.Bytes(), &names); err != nil {
+		t.Fatalf("zones %q: %v", w.Body, err)
+	}
+	a, b := slices.Index(names, "admin-a"), slices.Index(names, "admin-b")
+	if a < 0 || b < a {
+		t.Errorf("zones %v, want admin-a and admin-b sorted", names)
+	}
+
+	if _, err := adminDo(http.MethodPost, "/wp_cache/", ""); adminStatus(err) != http.StatusMethodNotAllowed {
+		t.Errorf("POST to the zone index returned %v, want 405", err)
+	}
+}
+
+func TestAdminUnknownZoneAndOperation(t *testing.T) {
+	newAdminCache(t, "admin-known")
+
+	if _, err := adminDo(http.MethodGet, "/wp_cache/admin-unknown/list", ""); adminStatus(err) != http.StatusNotFound {
+		t.Errorf("unknown zone returned %v, want 404", err)
+	}
+	if _, err := adminDo(http.MethodGet, "/wp_cache/admin-known/keys", ""); adminStatus(err) != http.StatusNotFound {
+		t.Errorf("unknown operation returned %v, want 404", err)
+	}
+}
+
+func TestAdminListAndStats(t *testing.T) {
+	newAdminCache(t, "admin-list", "/a/::", "/b/::")
+
+	w, err := adminDo(http.MethodGet, "/wp_cache/admin-list/list", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list map[string][]string
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("list %q: %v", w.Body, err)
+	}
+	slices.Sort(list["disk"])
+	if !slices.Equal(list["disk"], []string{"+a+::::none", "+b+::::none"}) || len(list["mem"]) != 2 {
+		t.Errorf("list %v, want both entries in mem and on disk", list)
+	}
+
+	w, err = adminDo(http.MethodGet, "/wp_cache/admin-list/stats", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats StoreStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("stats %q: %v", w.Body, err)
+	}
+	if stats.MemCount != 2 || stats.DiskCount != 2 || stats.MemMaxCount == 0 {
+		t.Errorf("stats %+v, want 2 entries in mem and on disk", stats)
+	}
+
+	if _, err := adminDo(http.MethodPost, "/wp_cache/admin-list/stats", ""); adminStatus(err) != http.StatusMethodNotAllowed {
+		t.Errorf("POST to stats returned %v, want 405", err)
+	}
+}
+
+func TestAdminEntry(t *testing.T) {
+	c := newAdminCache(t, "admin-entry", "/a/::", "/a/b/::")
+
+	w, err := adminDo(http.MethodGet, "/wp_cache/admin-entry/entry/a/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []EntryInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("entries %q: %v", w.Body, err)
+	}
+	if len(entries) != 1 || entries[0].Key != "+a+::" || entries[0].Status != http.StatusOK {
+		t.Errorf("entries %+v, want only the entry of /a/", entries)
+	}
+
+	// delete purges the page only, not the pages below it
+	w, err = adminDo(http.MethodDelete, "/wp_cache/admin-entry/entry/a/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report PurgeResult
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || report.Mem != 1 || report.Disk != 1 {
+		t.Errorf("delete report %q, %v", w.Body, err)
+	}
+	if _, _, err := c.Store.Get("/a/::", http.Header{}, "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("deleted entry still cached: %v", err)
+	}
+	if _, _, err := c.Store.Get("/a/b/::", http.Header{}, "none"); err != nil {
+		t.Errorf("delete of /a/ removed /a/b/: %v", err)
+	}
+
+	if _, err := adminDo(http.MethodPut, "/wp_cache/admin-entry/entry/a/", ""); adminStatus(err) != http.StatusMethodNotAllowed {
+		t.Errorf("PUT to an entry returned %v, want 405", err)
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	c := newAdminCache(t, "admin-purge", "/a/::", "/a/b/::", "/c/::")
+
+	w, err := adminDo(http.MethodPost, "/wp_cache/admin-purge/purge/a/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report PurgeResult
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || report.Mem != 2 {
+		t.Errorf("purge report %q, %v, want the subtree of /a/ purged", w.Body, err)
+	}
+	if _, _, err := c.Store.Get("/c/::", http.Header{}, "none"); err != nil {
+		t.Errorf("purge of /a/ removed /c/: %v", err)
+	}
+
+	// a batch is taken as a JSON body
+	if _, err := adminDo(http.MethodPost, "/wp_cache/admin-purge/purge/", `{"urls":["/c/"]}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Store.Get("/c/::", http.Header{}, "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("batch purge left /c/: %v", err)
+	}
+
+	if _, err := adminDo(http.MethodGet, "/wp_cache/admin-purge/purge/a/", ""); adminStatus(err) != http.StatusMethodNotAllowed {
+		t.Errorf("GET to purge returned %v, want 405", err)
+	}
+}
+
+func TestAdminPurgeBodyTooLarge(t *testing.T) {
+	c := &Cache{Zone: "admin-test", Store: newTestStore(t, StoreOptions{}), logger: zap.NewNop()}
+	registerZone(c)
+	defer unregisterZone(c)
+
+	body := `{"urls":["/` + strings.Repeat("a", purgeBodyMaxSize) + `"]}`
+	if _, err := adminDo(http.MethodPost, "/wp_cache/admin-test/purge/", body); adminStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized purge body returned %v, want 413", err)
+	}
+}
+
+func TestAdminZoneReload(t *testing.T) {
+	// a reload provisions the new cache before the old one is cleaned up
+	old := &Cache{Zone: "admin-reload", Store: newTestStore(t, StoreOptions{}), logger: zap.NewNop()}
+	cur := &Cache{Zone: "admin-reload", Store: newTestStore(t, StoreOptions{}), logger: zap.NewNop()}
+	cur.Store.Set("/new/::", cur.Store.Generation(), http.Header{}, testMeta(), []byte("new"))
+	registerZone(old)
+	registerZone(cur)
+	defer unregisterZone(cur)
+
+	stats := func() StoreStats {
+		t.Helper()
+		w, err := adminDo(http.MethodGet, "/wp_cache/admin-reload/stats", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stats StoreStats
+		json.Unmarshal(w.Body.Bytes(), &stats)
+		return stats
+	}
+	if s := stats(); s.MemCount != 1 {
+		t.Errorf("stats %+v, want those of the newest cache", s)
+	}
+	unregisterZone(old)
+	if s := stats(); s.MemCount != 1 {
+		t.Errorf("stats after the old cache left %+v, want those of the newest cache", s)
+	}
+
+	unregisterZone(cur)
+	if _, err := adminDo(http.MethodGet, "/wp_cache/admin-reload/stats", ""); adminStatus(err) != http.StatusNotFound {
+		t.Errorf("zone without caches returned %v, want 404", err)
+	}
+}
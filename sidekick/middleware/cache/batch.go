@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// ErrBatchHosts is returned for a batch with hosts when the cache key doesn't record the host
+var ErrBatchHosts = errors.New("cache_key has no host, a batch can't purge by host")
+
+// ErrPurgePaths is returned for a purge by path when the cache key doesn't record the path
+var ErrPurgePaths = errors.New("cache_key has no path, purge by tag or flush instead")
+
+// PurgeBatch selects entries to purge in a single pass, an entry matching
+// any of the lists is purged
+type PurgeBatch struct {
+	// Paths purge by Mode, like a purge of the path on the purge endpoint
+	Paths []string `json:"paths"`
+	// Mode is exact, subtree or prefix, see PurgeMode. Defaults to subtree.
+	Mode string `json:"mode"`
+	// URLs purge every variant of a page, e.g. "https://example.com/blog/" or "/blog/"
+	URLs []string `json:"urls"`
+	// Prefixes purge every entry whose path starts with the prefix
+	Prefixes []string `json:"prefixes"`
+	// Regexes purge every entry whose path matches
+	Regexes []string `json:"regexes"`
+	// Hosts purge every entry of the host
+	Hosts []string `json:"hosts"`
+	// Tags purge every entry carrying the tag
+	Tags []string `json:"tags"`
+
+	m *batchMatcher
+}
+
+// batchURL is a parsed entry of PurgeBatch.URLs
+type batchURL struct {
+	path string
+	host string
+}
+
+// batchMatcher matches flattened keys against a compiled batch
+type batchMatcher struct {
+	paths    []func(key string) bool
+	urls     []batchURL
+	prefixes []string
+	rxs      []*regexp.Regexp
+	hosts    []string
+	tags     []string
+	// flattened keys carrying one of the tags
+	tagged map[string]bool
+}
+
+// Provision parses the URLs and compiles the regexes
+func (b *PurgeBatch) Provision() error {
+	m := &batchMatcher{tags: b.Tags}
+	mode, err := ParsePurgeMode(b.Mode)
+	if err != nil {
+		return err
+	}
+	for _, p := range b.Paths {
+		m.paths = append(m.paths, mode.matcher(p))
+	}
+	for _, raw := range b.URLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return err
+		}
+		m.urls = append(m.urls, batchURL{
+			path: strings.ReplaceAll(u.Path, "/", "+"),
+			host: strings.ToLower(u.Host),
+		})
+	}
+	for _, prefix := range b.Prefixes {
+		m.prefixes = append(m.prefixes, strings.ReplaceAll(prefix, "/", "+"))
+	}
+	for _, expr := range b.Regexes {
+		rx, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		m.rxs = append(m.rxs, rx)
+	}
+	for _, host := range b.Hosts {
+		m.hosts = append(m.hosts, strings.ToLower(host))
+	}
+	b.m = m
+	return nil
+}
+
+// keyParts splits a flattened key into its path and the host it records.
+// known is false when the cache key doesn't record the host, URLs then match any host
+// and the store refuses batches with hosts. Hashed extras keep the host readable.
+func keyParts(key string) (keyPath, host string, known bool) {
+	keyPath, extras, _ := strings.Cut(key, "::")
+	// drop the vary variant
+	extras, _, _ = strings.Cut(extras, "|")
+	if !strings.Contains(extras, "host=") {
+		return keyPath, "", false
+	}
+	values, err := url.ParseQuery(extras)
+	if err != nil || !values.Has("host") {
+		return keyPath, "", false
+	}
+	return keyPath, values.Get("host"), true
+}
+
+// match reports whether the flattened key is selected by the batch
+func (m *batchMatcher) match(key string) bool {
+	return m.tagged[key] || m.matchKey(key)
+}
+
+// matchKey matches the key against everything but the tags
+func (m *batchMatcher) matchKey(key string) bool {
+	for _, match := range m.paths {
+		if match(key) {
+			return true
+		}
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	keyPath, host, known := keyParts(key)
+	for _, u := range m.urls {
+		if keyPath == u.path && (u.host == "" || !known || host == u.host) {
+			return true
+		}
+	}
+	for _, h := range m.hosts {
+		if known && host == h {
+			return true
+		}
+	}
+	if len(m.rxs) > 0 {
+		reqPath := strings.ReplaceAll(keyPath, "+", "/")
+		for _, rx := range m.rxs {
+			if rx.MatchString(reqPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchMeta is match for the purge log, which reads the tags off the entry
+// as the tagged keys are only known after the purge is recorded
+func (m *batchMatcher) matchMeta(key string, meta *CacheMeta) bool {
+	if m.matchKey(key) {
+		return true
+	}
+	for _, tag := range meta.Tags {
+		if slices.Contains(m.tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBatch provisions the batch and makes sure the keys record what it selects on
+func (d *Store) checkBatch(b *PurgeBatch) error {
+	if b.m == nil {
+		if err := b.Provision(); err != nil {
+			return err
+		}
+	}
+	if len(b.Hosts) > 0 && !d.cacheKey.Host {
+		return ErrBatchHosts
+	}
+	if !d.cacheKey.Path && len(b.Paths)+len(b.URLs)+len(b.Prefixes)+len(b.Regexes) > 0 {
+		return ErrPurgePaths
+	}
+	return nil
+}
+
+// pagePaths returns the request paths the batch names, the paths and the paths of the URLs
+func (b *PurgeBatch) pagePaths() []string {
+	paths := slices.Clip(b.Paths)
+	for _, u := range b.m.urls {
+		paths = append(paths, strings.ReplaceAll(u.path, "+", "/"))
+	}
+	return paths
+}
+
+// batchPaths returns the request paths of the pages the batch names or tags,
+// for the purge rules to match
+func (d *Store) batchPaths(b *PurgeBatch) []string {
+	if len(d.purgeRules) == 0 {
+		return nil
+	}
+	return append(b.pagePaths(), d.taggedPaths(b.Tags)...)
+}
+
+// PurgeBatch removes every entry selected by the batch in one pass over memory and disk,
+// with related the pages the purge rules tie to its paths, URLs and tagged entries too
+func (d *Store) PurgeBatch(b *PurgeBatch, related bool) (*PurgeResult, error) {
+	if err := d.checkBatch(b); err != nil {
+		return nil, err
+	}
+	m := b.m
+	d.logger.Debug("Removing batch from cache", zap.Any("batch", b), zap.Bool("related", related))
+	var paths []string
+	if related {
+		paths = d.batchPaths(b)
+	}
+	d.recordPurge(d.withRelatedMeta(paths, m.matchMeta))
+	m.tagged = d.taggedSet(b.Tags)
+	return d.removeKeys("", d.withRelated(paths, m.match)), nil
+}
+
+// SoftPurgeBatch marks every entry selected by the batch as expired
+func (d *Store) SoftPurgeBatch(b *PurgeBatch, related bool) (*PurgeResult, error) {
+	if err := d.checkBatch(b); err != nil {
+		return nil, err
+	}
+	m := b.m
+	d.logger.Debug("Soft purging batch from cache", zap.Any("batch", b), zap.Bool("related", related))
+	var paths []string
+	if related {
+		paths = d.batchPaths(b)
+	}
+	d.recordPurge(d.withRelatedMeta(paths, m.matchMeta))
+	m.tagged = d.taggedSet(b.Tags)
+	return d.expireKeys("", d.withRelated(paths, m.match)), nil
+}
@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPurgeBatchHostsNeedHostKeys(t *testing.T) {
+	d := newTestStore(t, StoreOptions{})
+	if err := d.Set("/a/::", d.Generation(), http.Header{}, testMeta(), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := d.PurgeBatch(&PurgeBatch{Hosts: []string{"example.com"}}, false)
+	if !errors.Is(err, ErrBatchHosts) {
+		t.Fatalf("hosts batch without host keys returned %v, want ErrBatchHosts", err)
+	}
+	if _, _, err := d.Get("/a/::", http.Header{}, "none"); err != nil {
+		t.Fatalf("refused hosts batch purged the entry: %v", err)
+	}
+}
+
+func TestPurgeBatchHosts(t *testing.T) {
+	d := newTestStore(t, StoreOptions{CacheKey: &CacheKey{Path: true, Host: true}})
+	for _, key := range []string{"/a/::host=example.com", "/a/::host=example.org"} {
+		if err := d.Set(key, d.Generation(), http.Header{}, testMeta(), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := d.PurgeBatch(&PurgeBatch{Hosts: []string{"Example.com"}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.Get("/a/::host=example.com", http.Header{}, "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("entry of the purged host: Get returned %v", err)
+	}
+	if _, _, err := d.Get("/a/::host=example.org", http.Header{}, "none"); err != nil {
+		t.Errorf("entry of another host: Get returned %v", err)
+	}
+}
+
+func TestPurgeBatchHostsOfHashedKeys(t *testing.T) {
+	k := &CacheKey{Path: true, Host: true, Headers: []string{"X-Long"}}
+	d := newTestStore(t, StoreOptions{CacheKey: k})
+	keys := map[string]string{}
+	for _, host := range []string{"a.example", "b.example"} {
+		r := httptest.NewRequest("GET", "http://"+host+"/a/", nil)
+		r.Header.Set("X-Long", strings.Repeat("x", 200))
+		keys[host] = k.Build(r)
+		if err := d.Set(keys[host], d.Generation(), http.Header{}, testMeta(), []byte(host)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := d.PurgeBatch(&PurgeBatch{Hosts: []string{"a.example"}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.Get(keys["a.example"], http.Header{}, "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("hashed entry of the purged host: Get returned %v", err)
+	}
+	if _, _, err := d.Get(keys["b.example"], http.Header{}, "none"); err != nil {
+		t.Errorf("hashed entry of another host: Get returned %v", err)
+	}
+}
+
+// newRelatedStore returns a store whose purges of posts take the home page and feed along,
+// holding a post tagged post-1, the home page, the feed and an unrelated page
+func newRelatedStore(t *testing.T) *Store {
+	t.Helper()
+	rule := PurgeRule{PathPrefix: "/blog/", Also: []string{"/", "/feed/*"}}
+	if err := rule.Provision(); err != nil {
+		t.Fatal(err)
+	}
+	d := newTestStore(t, StoreOptions{PurgeRules: []PurgeRule{rule}})
+	entries := map[string][]string{
+		"/blog/post/::": {"post-1"},
+		"/::":           nil,
+		"/feed/atom/::": nil,
+		"/about/::":     nil,
+	}
+	for key, tags := range entries {
+		if err := d.Set(key, d.Generation(), http.Header{}, testMeta(tags...), []byte(key)); err != nil {
+			t.Fatalf("Set %s: %v", key, err)
+		}
+	}
+	return d
+}
+
+func TestPurgeBatchRelated(t *testing.T) {
+	for _, batch := range []PurgeBatch{
+		{URLs: []string{"https://example.com/blog/post/"}},
+		{Paths: []string{"/blog/post/"}, Mode: "exact"},
+		{Tags: []string{"post-1"}},
+	} {
+		d := newRelatedStore(t)
+		if _, err := d.PurgeBatch(&batch, true); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"/blog/post/::", "/::", "/feed/atom/::"} {
+			assertNotStored(t, d, key)
+		}
+		if _, _, err := d.Get("/about/::", http.Header{}, "none"); err != nil {
+			t.Errorf("batch %+v purged an unrelated page: %v", batch, err)
+		}
+	}
+}
+
+func TestPurgeBatchWithoutRelated(t *testing.T) {
+	d := newRelatedStore(t)
+	if _, err := d.PurgeBatch(&PurgeBatch{URLs: []string{"/blog/post/"}}, false); err != nil {
+		t.Fatal(err)
+	}
+	assertNotStored(t, d, "/blog/post/::")
+	if _, _, err := d.Get("/::", http.Header{}, "none"); err != nil {
+		t.Errorf("batch with related=0 purged the home page: %v", err)
+	}
+}
@@ -0,0 +1,368 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	bolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	caddy.RegisterModule(BoltStorage{})
+}
+
+var (
+	boltBucket = []byte("entries")
+	// open databases, shared by the configs of a reload as bolt locks the file
+	boltPool = caddy.NewUsagePool()
+)
+
+// BoltStorage keeps entries in a single bbolt file. Records are keyed by the
+// flattened key, a NUL and the field: "meta", "vary" or a content encoding,
+// so the records of a key sit together and purges scan a key range.
+type BoltStorage struct {
+	// Path is the database file, sidekick-data/sidekick-cache.db in CACHE_LOC by default,
+	// or in /var/www/html/wp-content/cache when CACHE_LOC is unset
+	Path string
+	// Timeout is how long opening waits for another process holding the file
+	Timeout caddy.Duration
+	// NoSync skips fsync on commit, faster but a crash may lose recent writes
+	NoSync bool
+
+	db *bolt.DB
+}
+
+// boltDB closes the database once the last config using it is cleaned up
+type boltDB struct {
+	*bolt.DB
+}
+
+func (db boltDB) Destruct() error {
+	return db.Close()
+}
+
+// CaddyModule returns the Caddy module information.
+func (BoltStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.wp_cache.storage.bolt",
+		New: func() caddy.Module {
+			return new(BoltStorage)
+		},
+	}
+}
+
+// UnmarshalCaddyfile parses a bolt block:
+//
+//	storage bolt {
+//		path /var/www/html/wp-content/cache/sidekick-data/sidekick-cache.db
+//		timeout 5s
+//		no_sync
+//	}
+func (s *BoltStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // backend name
+	return parseBlock(d, func(key string, args []string) error {
+		switch key {
+		case "path":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			s.Path = args[0]
+
+		case "timeout":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return d.Errf("invalid timeout '%s'", args[0])
+			}
+			s.Timeout = caddy.Duration(dur)
+
+		case "no_sync":
+			if len(args) > 1 {
+				return d.ArgErr()
+			}
+			s.NoSync = len(args) == 0 || parseBool(args[0])
+
+		default:
+			return d.Errf("unknown bolt storage option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Provision opens the database, or takes the one a previous config opened
+func (s *BoltStorage) Provision(ctx caddy.Context) error {
+	if s.Path == "" {
+		loc := os.Getenv("CACHE_LOC")
+		if loc == "" {
+			loc = defaultCacheLoc
+		}
+		s.Path = filepath.Join(loc, DATA_DIR, "sidekick-cache.db")
+	}
+	if s.Timeout == 0 {
+		s.Timeout = caddy.Duration(5 * time.Second)
+	}
+
+	db, _, err := boltPool.LoadOrNew(s.Path, func() (caddy.Destructor, error) {
+		if err := os.MkdirAll(filepath.Dir(s.Path), 0o755); err != nil {
+			return nil, err
+		}
+		db, err := bolt.Open(s.Path, 0o644, &bolt.Options{Timeout: time.Duration(s.Timeout)})
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltBucket)
+			return err
+		}); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return boltDB{db}, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.db = db.(boltDB).DB
+	s.db.NoSync = s.NoSync
+	return nil
+}
+
+// Cleanup releases the database, it is closed when no config uses it anymore
+func (s *BoltStorage) Cleanup() error {
+	_, err := boltPool.Delete(s.Path)
+	return err
+}
+
+// boltKey returns the record key of a field of the entry
+func boltKey(key, field string) []byte {
+	return []byte(key + "\x00" + field)
+}
+
+// splitBoltKey splits a record key into the flattened key and the field
+func splitBoltKey(k []byte) (string, string) {
+	i := bytes.IndexByte(k, 0)
+	if i < 0 {
+		return string(k), ""
+	}
+	return string(k[:i]), string(k[i+1:])
+}
+
+// boltScan calls fn with every record whose flattened key starts with prefix
+func boltScan(b *bolt.Bucket, prefix string, fn func(key, field string, v []byte)) {
+	c := b.Cursor()
+	p := []byte(prefix)
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		key, field := splitBoltKey(k)
+		fn(key, field, v)
+	}
+}
+
+func (s *BoltStorage) Get(key, ce string) (*CacheMeta, []byte, error) {
+	meta := &CacheMeta{}
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		buf := b.Get(boltKey(key, "meta"))
+		v := b.Get(boltKey(key, ce))
+		if buf == nil || v == nil {
+			return ErrCacheNotFound
+		}
+		// values are only valid inside the transaction
+		value = bytes.Clone(v)
+		return json.Unmarshal(buf, meta)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, value, nil
+}
+
+// Set writes the body and the meta in one transaction. The key keeps one meta:
+// when the new body is of a later render, the bodies of the other encodings
+// belong to the response it replaces and are dropped.
+func (s *BoltStorage) Set(key, ce string, meta *CacheMeta, value []byte) error {
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		if old := b.Get(boltKey(key, "meta")); old != nil && replacesMeta(old, meta) {
+			var rm [][]byte
+			boltScan(b, key+"\x00", func(_, field string, _ []byte) {
+				if field != "meta" && field != "vary" && field != ce {
+					rm = append(rm, boltKey(key, field))
+				}
+			})
+			for _, k := range rm {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		if err := b.Put(boltKey(key, ce), value); err != nil {
+			return err
+		}
+		return b.Put(boltKey(key, "meta"), buf)
+	})
+}
+
+// replacesMeta reports whether meta is of a later render than the stored meta
+func replacesMeta(stored []byte, meta *CacheMeta) bool {
+	old := &CacheMeta{}
+	if err := json.Unmarshal(stored, old); err != nil {
+		return true
+	}
+	return meta.replaces(old)
+}
+
+func (s *BoltStorage) Meta(key string) (*CacheMeta, error) {
+	meta := &CacheMeta{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(boltBucket).Get(boltKey(key, "meta"))
+		if buf == nil {
+			return ErrCacheNotFound
+		}
+		return json.Unmarshal(buf, meta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *BoltStorage) Expire(key string, expires int64) (int, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		buf := b.Get(boltKey(key, "meta"))
+		if buf == nil {
+			return ErrCacheNotFound
+		}
+		meta := &CacheMeta{}
+		if err := json.Unmarshal(buf, meta); err != nil {
+			return err
+		}
+		meta.softExpire(expires)
+		buf, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		return b.Put(boltKey(key, "meta"), buf)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// remove deletes the records of the keys starting with prefix that match, counting one per key
+func (s *BoltStorage) remove(prefix string, match func(key string) bool) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		var rm [][]byte
+		last := ""
+		boltScan(b, prefix, func(key, field string, _ []byte) {
+			if !match(key) {
+				return
+			}
+			if n == 0 || key != last {
+				n++
+				last = key
+			}
+			rm = append(rm, boltKey(key, field))
+		})
+		for _, k := range rm {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Delete counts one per key
+func (s *BoltStorage) Delete(key string) (int, error) {
+	return s.remove(key+"\x00", func(string) bool {
+		return true
+	})
+}
+
+func (s *BoltStorage) Purge(prefix string, match func(key string) bool) (int, []PurgeError) {
+	n, err := s.remove(prefix, match)
+	if err != nil {
+		return 0, []PurgeError{{Path: s.Path, Error: err.Error()}}
+	}
+	return n, nil
+}
+
+func (s *BoltStorage) Flush() (int, error) {
+	return s.remove("", func(string) bool {
+		return true
+	})
+}
+
+// List leaves out keys holding only vary fields, they hold no encodings
+func (s *BoltStorage) List() (map[string][]string, error) {
+	list := make(map[string][]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		boltScan(tx.Bucket(boltBucket), "", func(key, field string, _ []byte) {
+			if field != "meta" && field != "vary" {
+				list[key] = append(list[key], field)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Vary returns the vary fields of the key, a key cached without them varies on nothing
+func (s *BoltStorage) Vary(key string) ([]string, error) {
+	var fields []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		buf := b.Get(boltKey(key, "vary"))
+		if buf == nil {
+			if k, _ := b.Cursor().Seek([]byte(key + "\x00")); !bytes.HasPrefix(k, []byte(key+"\x00")) {
+				return ErrCacheNotFound
+			}
+			fields = []string{}
+			return nil
+		}
+		return json.Unmarshal(buf, &fields)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func (s *BoltStorage) SetVary(key string, fields []string) error {
+	buf, _ := json.Marshal(fields)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(boltKey(key, "vary"), buf)
+	})
+}
+
+// Interface guards
+var (
+	_ Storage               = (*BoltStorage)(nil)
+	_ caddy.Provisioner     = (*BoltStorage)(nil)
+	_ caddy.CleanerUpper    = (*BoltStorage)(nil)
+	_ caddyfile.Unmarshaler = (*BoltStorage)(nil)
+	_ caddy.Destructor      = boltDB{}
+)
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func newTestBolt(t *testing.T) *BoltStorage {
+	t.Helper()
+	s := &BoltStorage{Path: filepath.Join(t.TempDir(), "cache.db")}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Cleanup() })
+	return s
+}
+
+func TestBoltSetKeepsOtherEncodings(t *testing.T) {
+	s := newTestBolt(t)
+	meta := testMeta("post-1")
+	meta.Expires = meta.Timestamp + 60
+	if err := s.Set("+a::", "gzip", meta, []byte("zipped")); err != nil {
+		t.Fatal(err)
+	}
+	s.SetVary("+a::", []string{})
+	// the same render, filled in for another encoding
+	fill := testMeta("post-1")
+	fill.Timestamp, fill.Rendered, fill.Expires = meta.Timestamp, meta.Rendered, meta.Expires
+	if err := s.Set("+a::", "none", fill, []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, value, err := s.Get("+a::", "gzip"); err != nil || string(value) != "zipped" {
+		t.Errorf("gzip Get after an identity fill = %q, %v", value, err)
+	}
+	list, _ := s.List()
+	slices.Sort(list["+a::"])
+	if !slices.Equal(list["+a::"], []string{"gzip", "none"}) {
+		t.Errorf("List = %v", list)
+	}
+}
+
+func TestBoltSetDropsReplacedEncodings(t *testing.T) {
+	s := newTestBolt(t)
+	old := testMeta("post-1")
+	old.Timestamp -= 70
+	old.Expires = old.Timestamp + 60
+	if err := s.Set("+a::", "gzip", old, []byte("old zipped")); err != nil {
+		t.Fatal(err)
+	}
+	s.SetVary("+a::", []string{})
+
+	// rendered after the stored entry expired, the gzip body is of the old response
+	fresh := testMeta("post-2")
+	if err := s.Set("+a::", "none", fresh, []byte("new plain")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.Get("+a::", "gzip"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("body of the old meta still served, err %v", err)
+	}
+	meta, value, err := s.Get("+a::", "none")
+	if err != nil || string(value) != "new plain" || !slices.Equal(meta.Tags, []string{"post-2"}) {
+		t.Fatalf("Get = %+v, %q, %v", meta, value, err)
+	}
+	if fields, err := s.Vary("+a::"); err != nil || len(fields) != 0 {
+		t.Errorf("Set dropped the vary fields: %v, %v", fields, err)
+	}
+}
+
+func TestBoltSetDropsEncodingsOfEarlierRender(t *testing.T) {
+	s := newTestBolt(t)
+	old := testMeta("post-1")
+	old.Timestamp -= 30
+	old.Expires = old.Timestamp + 60
+	if err := s.Set("+a::", "gzip", old, []byte("old zipped")); err != nil {
+		t.Fatal(err)
+	}
+
+	// refresh-ahead, revalidation and soft purges render again before the entry expires
+	if err := s.Set("+a::", "none", testMeta("post-2"), []byte("new plain")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.Get("+a::", "gzip"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("gzip body of the earlier render still served, err %v", err)
+	}
+	if _, value, err := s.Get("+a::", "none"); err != nil || string(value) != "new plain" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+}
+
+func TestBoltDefaultPath(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CACHE_LOC", dir)
+	s := &BoltStorage{}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Cleanup()
+	if s.Path != filepath.Join(dir, DATA_DIR, "sidekick-cache.db") {
+		t.Errorf("Path = %s", s.Path)
+	}
+
+	// without CACHE_LOC the file doesn't follow the working directory
+	if !filepath.IsAbs(defaultCacheLoc) {
+		t.Errorf("default location %s is relative", defaultCacheLoc)
+	}
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(Bunny{})
+}
+
+// Bunny purges a bunny.net pull zone. Prefixes become wildcard URLs, tags
+// match the CDN-Tag header the cache adds to responses.
+type Bunny struct {
+	CDNBase
+	PullZoneID string
+	AccessKey  string
+}
+
+// CaddyModule returns the Caddy module information.
+func (Bunny) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.wp_cache.cdn.bunny",
+		New: func() caddy.Module {
+			return new(Bunny)
+		},
+	}
+}
+
+// UnmarshalCaddyfile parses a bunny block:
+//
+//	cdn bunny {
+//		pull_zone_id <id>
+//		access_key <key>
+//		base_url https://api.bunny.net
+//	}
+func (b *Bunny) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // driver name
+	return parseBlock(d, func(key string, args []string) error {
+		if ok, err := b.parseOption(d, key, args); ok {
+			return err
+		}
+		switch key {
+		case "pull_zone_id":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			b.PullZoneID = args[0]
+
+		case "access_key":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			b.AccessKey = args[0]
+
+		default:
+			return d.Errf("unknown bunny option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Provision fills the credentials from BUNNY_PULL_ZONE_ID and BUNNY_ACCESS_KEY
+func (b *Bunny) Provision(ctx caddy.Context) error {
+	if b.PullZoneID == "" {
+		b.PullZoneID = os.Getenv("BUNNY_PULL_ZONE_ID")
+	}
+	if b.AccessKey == "" {
+		b.AccessKey = os.Getenv("BUNNY_ACCESS_KEY")
+	}
+	if b.AccessKey == "" {
+		return errors.New("bunny needs an access_key")
+	}
+	if b.PullZoneID == "" {
+		return errors.New("bunny needs a pull_zone_id")
+	}
+	// every URL is its own call, keep batches small
+	b.provision("bunny", 20, "https://api.bunny.net")
+	b.tags = cdnTagHeader{name: "CDN-Tag", sep: ","}
+	return nil
+}
+
+// Purge purges URLs and wildcard prefixes one by one, tags and everything through the pull zone
+func (b *Bunny) Purge(ctx context.Context, p *CDNPurge) error {
+	zonePath := "/pullzone/" + url.PathEscape(b.PullZoneID) + "/purgeCache"
+	if p.All {
+		return b.post(ctx, zonePath, nil)
+	}
+	for _, tag := range p.Tags {
+		buf, _ := json.Marshal(map[string]string{"CacheTag": tag})
+		if err := b.post(ctx, zonePath, buf); err != nil {
+			return err
+		}
+	}
+	for _, u := range p.URLs {
+		if err := b.post(ctx, "/purge?url="+url.QueryEscape(u), nil); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range p.Prefixes {
+		if err := b.post(ctx, "/purge?url="+url.QueryEscape(strings.TrimSuffix(prefix, "*")+"*"), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bunny) post(ctx context.Context, apiPath string, body []byte) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", b.BaseURL+apiPath, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("AccessKey", b.AccessKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	_, err = b.do(req)
+	return err
+}
+
+// Interface guards
+var (
+	_ CDNDriver             = (*Bunny)(nil)
+	_ caddy.Provisioner     = (*Bunny)(nil)
+	_ caddyfile.Unmarshaler = (*Bunny)(nil)
+)
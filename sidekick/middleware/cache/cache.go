@@ -3,41 +3,123 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
+	"net/netip"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"net/http"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/puzpuzpuz/xsync"
 	"go.uber.org/zap"
 )
 
+// defaultCacheLoc is the CACHE_LOC of the image, the bolt file and the CDN dead letter never land in
+// whatever directory Caddy happens to run from
+const defaultCacheLoc = "/var/www/html/wp-content/cache"
+
+// DATA_DIR holds the files of the cache other than the file tier's entries, under
+// the cache location. CACHE_LOC is in the web root, the Caddyfile refuses to serve it.
+const DATA_DIR = "sidekick-data"
+
 type Cache struct {
-	logger             *zap.Logger
-	Loc                string
-	PurgePath          string
-	PurgeKeyHeader     string
-	PurgeKey           string
+	logger *zap.Logger
+	Loc    string
+	// Zone names the cache on the admin API, /wp_cache/{zone}/...
+	Zone           string
+	PurgePath      string
+	PurgeKeyHeader string
+	// PurgeKey holds the secrets purge requests are signed with, comma separated.
+	// Every one is accepted so the old key keeps working while rotating.
+	PurgeKey string
+	// PurgeSkew is how far the timestamp of a signed purge may be from the clock
+	PurgeSkew caddy.Duration
+	// ListKey holds read-only secrets, comma separated, that can list the cache but not purge it
+	ListKey string
+	// PurgeAllow and ListAllow are the addresses or CIDR ranges allowed to purge
+	// and to list, empty allows everyone
+	PurgeAllow []string
+	ListAllow  []string
+	// PurgeRateLimit is how many purges a client may send per minute, 0 is unlimited
+	PurgeRateLimit int
+	// PurgeSync makes purge requests wait for the purge and answer with a JSON report
+	PurgeSync bool
+	// PurgeMode is the mode of path purges that don't give one, subtree when unset
+	PurgeMode          string
 	CacheHeaderName    string
+	TagsHeader         string
 	BypassPathPrefixes []string
 	BypassPathRegex    string
 	BypassHome         bool
 	BypassDebugQuery   string
 	CacheResponseCodes []string
 	TTL                int
+	TTLRules           []TTLRule
+	PurgeRules         []PurgeRule
+	CacheKey           *CacheKey
+	QueryNormalize     *QueryNormalize
+	DeviceDetect       *DeviceDetect
 	Store              *Store
 
+	// StaleWhileRevalidate is how many seconds past TTL an entry is still served
+	// while a single background request refreshes it
+	StaleWhileRevalidate int
+	// StaleIfError is how many seconds past TTL an entry replaces a failed origin response
+	StaleIfError int
+	// TrustOrigin lets Cache-Control, Expires and Surrogate-Control on the origin
+	// response decide whether and how long it is cached, instead of TTL alone
+	TrustOrigin bool
+	// CoalesceTimeout is how long concurrent misses of a key wait for the
+	// one request rendering it before going to the origin themselves, < 0 disables
+	CoalesceTimeout caddy.Duration
+	// RefreshAhead refreshes hot entries before they expire, nil disables
+	RefreshAhead *RefreshAhead
+	// Peers are the replicas purges are forwarded to, nil disables
+	Peers *Peers
+	// CDNRaw are the CDN drivers purges are passed on to
+	CDNRaw []json.RawMessage `caddy:"namespace=http.handlers.wp_cache.cdn inline_key=driver"`
+	// SiteURL is the scheme and host CDN purges are built with, defaults to https:// and the request host
+	SiteURL string
+	// CDNDeadLetter is the file CDN purges that failed for good are appended to
+	CDNDeadLetter string
+
+	// StorageRaw are the storage tiers of the store, fastest first. Without any
+	// a memory LRU of MemoryCacheMaxSize and MemoryCacheMaxCount sits in front of Loc.
+	StorageRaw []json.RawMessage `caddy:"namespace=http.handlers.wp_cache.storage inline_key=backend"`
+
 	MemoryItemMaxSize   int
 	MemoryCacheMaxSize  int
 	MemoryCacheMaxCount int
 
 	pathRx *regexp.Regexp
+
+	purgeKeys  [][]byte
+	listKeys   [][]byte
+	purgeAllow []netip.Prefix
+	listAllow  []netip.Prefix
+	purgeLimit *rateLimiter
+	// signatures of accepted purges, refused when replayed within the skew window
+	purgeSeen *xsync.MapOf[string, int64]
+	// instance is sent along forwarded purges, to find the peers that are this handler
+	instance string
+	cdns     []CDNDriver
+	// headers the CDNs read purge tags from
+	edgeTags []cdnTagHeader
+
+	// cache keys with a background refresh in flight
+	refreshing *xsync.MapOf[string, struct{}]
+	// cache keys with a miss being rendered, nil when coalescing is off
+	flights *xsync.MapOf[string, *flight]
 }
 
 func init() {
@@ -61,6 +143,96 @@ func (c *Cache) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 		key := d.Val()
 
+		// block and list options
+		switch key {
+		case "purge_allow", "list_allow":
+			list := splitList(d.RemainingArgs())
+			if _, err := parseCIDRs(list); err != nil {
+				return d.Errf("invalid %s: %v", key, err)
+			}
+			if key == "purge_allow" {
+				c.PurgeAllow = append(c.PurgeAllow, list...)
+			} else {
+				c.ListAllow = append(c.ListAllow, list...)
+			}
+			continue
+
+		case "cache_key":
+			c.CacheKey = DefaultCacheKey()
+			if err := c.CacheKey.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			continue
+
+		case "query_normalize":
+			c.QueryNormalize = DefaultQueryNormalize()
+			if err := c.QueryNormalize.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			continue
+
+		case "ttl_rule":
+			rule := TTLRule{}
+			if err := rule.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			c.TTLRules = append(c.TTLRules, rule)
+			continue
+
+		case "purge_rule":
+			rule := PurgeRule{}
+			if err := rule.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			c.PurgeRules = append(c.PurgeRules, rule)
+			continue
+
+		case "refresh_ahead":
+			c.RefreshAhead = &RefreshAhead{}
+			if err := c.RefreshAhead.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			continue
+
+		case "peers":
+			c.Peers = &Peers{}
+			if err := c.Peers.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			continue
+
+		case "cdn":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "http.handlers.wp_cache.cdn."+name)
+			if err != nil {
+				return err
+			}
+			c.CDNRaw = append(c.CDNRaw, caddyconfig.JSONModuleObject(unm, "driver", name, nil))
+			continue
+
+		case "storage":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "http.handlers.wp_cache.storage."+name)
+			if err != nil {
+				return err
+			}
+			c.StorageRaw = append(c.StorageRaw, caddyconfig.JSONModuleObject(unm, "backend", name, nil))
+			continue
+
+		case "device_detect":
+			c.DeviceDetect = &DeviceDetect{}
+			if err := c.DeviceDetect.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			continue
+		}
+
 		if !d.Args(&value) {
 			continue
 		}
@@ -113,15 +285,82 @@ func (c *Cache) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			c.TTL = ttl
 
+		case "stale_while_revalidate":
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return d.Errf("invalid stale_while_revalidate value '%s'", value)
+			}
+			c.StaleWhileRevalidate = n
+
+		case "trust_origin":
+			c.TrustOrigin = parseBool(value)
+
+		case "coalesce_timeout":
+			value = strings.TrimSpace(value)
+			if value == "off" {
+				c.CoalesceTimeout = -1
+				continue
+			}
+			dur, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid coalesce_timeout value '%s'", value)
+			}
+			c.CoalesceTimeout = caddy.Duration(dur)
+
+		case "stale_if_error":
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return d.Errf("invalid stale_if_error value '%s'", value)
+			}
+			c.StaleIfError = n
+
+		case "zone":
+			c.Zone = strings.TrimSpace(value)
+
 		case "purge_path":
 			c.PurgePath = value
 
 		case "purge_key":
 			c.PurgeKey = strings.TrimSpace(value)
 
+		case "purge_sync":
+			c.PurgeSync = parseBool(value)
+
+		case "purge_mode":
+			if _, err := ParsePurgeMode(value); err != nil {
+				return d.Errf("invalid purge_mode value '%s'", value)
+			}
+			c.PurgeMode = value
+
+		case "list_key":
+			c.ListKey = strings.TrimSpace(value)
+
+		case "purge_rate_limit":
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return d.Errf("invalid purge_rate_limit value '%s'", value)
+			}
+			c.PurgeRateLimit = n
+
+		case "purge_skew":
+			dur, err := caddy.ParseDuration(strings.TrimSpace(value))
+			if err != nil {
+				return d.Errf("invalid purge_skew value '%s'", value)
+			}
+			c.PurgeSkew = caddy.Duration(dur)
+
 		case "purge_key_header":
 			c.PurgeKeyHeader = value
 
+		case "site_url":
+			c.SiteURL = strings.TrimSpace(value)
+
+		case "cdn_dead_letter":
+			c.CDNDeadLetter = strings.TrimSpace(value)
+
+		case "tags_header":
+			c.TagsHeader = value
+
 		case "cache_header_name":
 			c.CacheHeaderName = value
 
@@ -201,6 +440,63 @@ func (c *Cache) Provision(ctx caddy.Context) error {
 		c.TTL = ttl
 	}
 
+	for i := range c.TTLRules {
+		if err := c.TTLRules[i].Provision(); err != nil {
+			return err
+		}
+	}
+
+	for i := range c.PurgeRules {
+		if err := c.PurgeRules[i].Provision(); err != nil {
+			return err
+		}
+	}
+
+	if c.StaleWhileRevalidate == 0 {
+		if v := os.Getenv("STALE_WHILE_REVALIDATE"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				c.logger.Error("Invalid STALE_WHILE_REVALIDATE value", zap.Error(err))
+			}
+			c.StaleWhileRevalidate = n
+		}
+	}
+
+	if !c.TrustOrigin {
+		c.TrustOrigin = parseBool(os.Getenv("TRUST_ORIGIN"))
+	}
+
+	if c.StaleIfError == 0 {
+		if v := os.Getenv("STALE_IF_ERROR"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				c.logger.Error("Invalid STALE_IF_ERROR value", zap.Error(err))
+			}
+			c.StaleIfError = n
+		}
+	}
+
+	if c.CoalesceTimeout == 0 {
+		c.CoalesceTimeout = caddy.Duration(10 * time.Second)
+		if v := os.Getenv("COALESCE_TIMEOUT"); v == "off" {
+			c.CoalesceTimeout = -1
+		} else if v != "" {
+			dur, err := caddy.ParseDuration(v)
+			if err != nil {
+				c.logger.Error("Invalid COALESCE_TIMEOUT value", zap.Error(err))
+			} else {
+				c.CoalesceTimeout = caddy.Duration(dur)
+			}
+		}
+	}
+
+	if c.Zone == "" {
+		c.Zone = os.Getenv("CACHE_ZONE")
+		if c.Zone == "" {
+			c.Zone = "default"
+		}
+	}
+
 	if c.PurgePath == "" {
 		c.PurgePath = os.Getenv("PURGE_PATH")
 
@@ -212,6 +508,79 @@ func (c *Cache) Provision(ctx caddy.Context) error {
 	if c.PurgeKey == "" {
 		c.PurgeKey = os.Getenv("PURGE_KEY")
 	}
+	c.purgeKeys = nil
+	for _, key := range splitList([]string{c.PurgeKey}) {
+		c.purgeKeys = append(c.purgeKeys, []byte(key))
+	}
+	if len(c.purgeKeys) == 0 {
+		c.logger.Warn("No purge key configured, purge requests are refused")
+	}
+
+	if c.ListKey == "" {
+		c.ListKey = os.Getenv("LIST_KEY")
+	}
+	c.listKeys = nil
+	for _, key := range splitList([]string{c.ListKey}) {
+		c.listKeys = append(c.listKeys, []byte(key))
+	}
+
+	if len(c.PurgeAllow) == 0 {
+		c.PurgeAllow = splitList([]string{os.Getenv("PURGE_ALLOW")})
+	}
+	purgeAllow, err := parseCIDRs(c.PurgeAllow)
+	if err != nil {
+		return err
+	}
+	c.purgeAllow = purgeAllow
+
+	if len(c.ListAllow) == 0 {
+		c.ListAllow = splitList([]string{os.Getenv("LIST_ALLOW")})
+	}
+	listAllow, err := parseCIDRs(c.ListAllow)
+	if err != nil {
+		return err
+	}
+	c.listAllow = listAllow
+
+	if c.PurgeRateLimit == 0 {
+		if v := os.Getenv("PURGE_RATE_LIMIT"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				c.logger.Error("Invalid PURGE_RATE_LIMIT value", zap.Error(err))
+			} else {
+				c.PurgeRateLimit = n
+			}
+		}
+	}
+	c.purgeLimit = nil
+	if c.PurgeRateLimit > 0 {
+		c.purgeLimit = newRateLimiter(c.PurgeRateLimit)
+	}
+
+	if c.PurgeSkew == 0 {
+		c.PurgeSkew = caddy.Duration(5 * time.Minute)
+		if v := os.Getenv("PURGE_SKEW"); v != "" {
+			dur, err := caddy.ParseDuration(v)
+			if err != nil {
+				c.logger.Error("Invalid PURGE_SKEW value", zap.Error(err))
+			} else {
+				c.PurgeSkew = caddy.Duration(dur)
+			}
+		}
+	}
+
+	if !c.PurgeSync {
+		c.PurgeSync = parseBool(os.Getenv("PURGE_SYNC"))
+	}
+
+	if c.PurgeMode == "" {
+		c.PurgeMode = os.Getenv("PURGE_MODE")
+	}
+	mode, err := ParsePurgeMode(c.PurgeMode)
+	if err != nil {
+		return fmt.Errorf("invalid purge mode: %v", err)
+	}
+	c.PurgeMode = string(mode)
 
 	if c.PurgeKeyHeader == "" {
 		c.PurgeKeyHeader = os.Getenv("PURGE_KEY_HEADER")
@@ -227,6 +596,13 @@ func (c *Cache) Provision(ctx caddy.Context) error {
 		}
 	}
 
+	if c.TagsHeader == "" {
+		c.TagsHeader = os.Getenv("CACHE_TAGS_HEADER")
+		if c.TagsHeader == "" {
+			c.TagsHeader = "X-Cache-Tags"
+		}
+	}
+
 	// TODO: let 0 == disable memory but cache to disk?
 	if c.MemoryItemMaxSize == 0 {
 		c.MemoryItemMaxSize = 4 * 1024 * 1024 // 4MB
@@ -245,8 +621,89 @@ func (c *Cache) Provision(ctx caddy.Context) error {
 		c.MemoryCacheMaxCount = 32 * 1024 // 32K item as default should be enough?
 	}
 
-	c.Store = NewStore(c.Loc, c.TTL, c.MemoryCacheMaxSize, c.MemoryCacheMaxCount, c.logger)
+	if c.CacheKey == nil {
+		c.CacheKey = DefaultCacheKey()
+	}
+	if c.QueryNormalize == nil {
+		c.QueryNormalize = DefaultQueryNormalize()
+	}
+	// normalize the query ahead of building the key
+	c.CacheKey.normalize = c.QueryNormalize
+	// names are looked up after fold_case lower-cased them
+	if c.QueryNormalize.FoldCase {
+		for i, name := range c.CacheKey.Query {
+			c.CacheKey.Query[i] = strings.ToLower(name)
+		}
+	}
 
+	// rules match the path the entries are keyed on
+	if !c.CacheKey.Path {
+		if len(c.PurgeRules) > 0 {
+			return errors.New("purge_rule needs the path in cache_key")
+		}
+		for _, rule := range c.TTLRules {
+			if rule.PathPrefix != "" || rule.PathRegex != "" {
+				return errors.New("ttl_rule with a path needs the path in cache_key")
+			}
+		}
+		c.logger.Warn("cache_key has no path, purges by path are refused, purge by tag or flush instead")
+	}
+
+	if c.DeviceDetect != nil {
+		if err := c.DeviceDetect.Provision(); err != nil {
+			return err
+		}
+		c.CacheKey.deviceHeader = c.DeviceDetect.Header
+	}
+
+	storeOpts := StoreOptions{
+		TTL:                  c.TTL,
+		TTLRules:             c.TTLRules,
+		PurgeRules:           c.PurgeRules,
+		StaleWhileRevalidate: c.StaleWhileRevalidate,
+		StaleIfError:         c.StaleIfError,
+		CacheKey:             c.CacheKey,
+		MemMaxSize:           c.MemoryCacheMaxSize,
+		MemMaxCount:          c.MemoryCacheMaxCount,
+	}
+	if c.RefreshAhead != nil {
+		c.RefreshAhead.Provision()
+		storeOpts.RefreshAheadFraction = c.RefreshAhead.Fraction
+		storeOpts.RefreshAheadHits = c.RefreshAhead.MinHits
+	}
+	if c.StorageRaw != nil {
+		mods, err := ctx.LoadModule(c, "StorageRaw")
+		if err != nil {
+			return fmt.Errorf("loading storage backends: %v", err)
+		}
+		for _, mod := range mods.([]any) {
+			storeOpts.Tiers = append(storeOpts.Tiers, mod.(Storage))
+		}
+	}
+	c.Store = NewStore(c.Loc, storeOpts, c.logger)
+	c.refreshing = xsync.NewMapOf[struct{}]()
+	c.purgeSeen = xsync.NewMapOf[int64]()
+	c.instance = newInstanceID()
+	if c.CoalesceTimeout > 0 {
+		c.flights = xsync.NewMapOf[*flight]()
+	}
+
+	if c.Peers == nil {
+		static := splitList([]string{os.Getenv("CACHE_PEERS")})
+		srv := os.Getenv("CACHE_PEERS_SRV")
+		if len(static) > 0 || srv != "" {
+			c.Peers = &Peers{Static: static, SRV: srv}
+		}
+	}
+	if c.Peers != nil {
+		c.Peers.Provision()
+	}
+
+	if err := c.provisionCDNs(ctx); err != nil {
+		return err
+	}
+
+	registerZone(c)
 	return nil
 }
 
@@ -327,33 +784,17 @@ func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp
 	bypass := false
 	c.logger.Debug("HTTP Version", zap.String("Version", r.Proto))
 
+	// classify first so PHP sees the same device class the cache keys on
+	if c.DeviceDetect != nil {
+		c.DeviceDetect.Apply(r)
+	} else {
+		stripDeviceHeaders(r)
+	}
+
 	reqHdr := r.Header
 	db := c.Store
-	if strings.HasPrefix(r.URL.Path, c.PurgePath) {
-		key := reqHdr.Get(c.PurgeKeyHeader)
-		if key != c.PurgeKey {
-			c.logger.Warn("wp cache - purge - invalid key", zap.String("path", r.URL.Path))
-		} else {
-			switch r.Method {
-			case "GET":
-				cacheList := db.List()
-				json.NewEncoder(w).Encode(cacheList)
-				return nil
-
-			case "POST":
-				pathToPurge := strings.Replace(r.URL.Path, c.PurgePath, "", 1)
-				c.logger.Debug("wp cache - purge", zap.String("path", pathToPurge))
-
-				// TODO: fix concurrent issue when flush/pruge running and new cache setting
-				if len(pathToPurge) < 2 {
-					go db.Flush()
-				} else {
-					go db.Purge(pathToPurge)
-				}
-				w.Write([]byte("OK"))
-				return nil
-			}
-		}
+	if strings.HasPrefix(r.URL.Path, c.PurgePath) && c.servePurge(w, r) {
+		return nil
 	}
 
 	// only GET Method can cache
@@ -405,9 +846,7 @@ func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp
 		return next.ServeHTTP(w, r)
 	}
 
-	// TODO: custom cacheKey by query, header ...
-	cacheKey := ""
-	cacheKey = c.Store.buildCacheKey(r.URL.Path, cacheKey)
+	cacheKey := db.buildCacheKey(r)
 
 	requestEncoding := strings.Split(strings.Join(reqHdr["Accept-Encoding"], ""), ",")
 	if len(requestEncoding) == 1 && len(requestEncoding[0]) == 0 {
@@ -422,62 +861,144 @@ func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp
 	ce := ""
 	for _, re := range requestEncoding {
 		ce = strings.TrimSpace(re)
-		cacheData, cacheMeta, err = db.Get(cacheKey, ce)
-		if err == nil {
+		cacheData, cacheMeta, err = db.Get(cacheKey, reqHdr, ce)
+		if err == nil || err == ErrCacheStale {
 			break
 		}
 	}
+
+	cacheState := "HIT"
+	if err == ErrCacheStale {
+		// serve the expired entry while one request refreshes it
+		cacheState = "STALE"
+		c.revalidate(cacheKey, r, next)
+		err = nil
+	}
 	if err == nil {
-		// TODO: some limit prevent self-DoS
 		if ce == "none" && requestEncoding[0] != "none" {
-			go c.doCache(r, next)
+			c.revalidate(cacheKey, r, next)
+		} else if c.RefreshAhead != nil && db.RefreshDue(cacheKey, reqHdr, cacheMeta) {
+			c.refreshAhead(cacheKey, r, next)
 		}
 
-		// Check for conditional requests (If-None-Match, If-Modified-Since)
-		if checkConditionalRequest(r, cacheMeta) {
-			// Content hasn't changed, return 304 Not Modified
-			hdr.Set(c.CacheHeaderName, "HIT-304")
-			hdr.Set("Vary", "Accept-Encoding")
+		c.serveCached(w, r, cacheMeta, cacheData, ce, cacheState)
+		return nil
+	}
+	c.logger.Debug("wp cache - error - "+cacheKey, zap.Error(err))
 
-			// Set validation headers (ETag, Last-Modified) from cache
-			for _, kv := range cacheMeta.Header {
-				if len(kv) != 2 {
-					continue
-				}
-				// Only include specific headers for 304 response
-				if kv[0] == "Etag" || kv[0] == "Last-Modified" || kv[0] == "Cache-Control" || kv[0] == "Expires" {
-					hdr.Set(kv[0], kv[1])
+	// one request renders the miss, the others wait and reuse what it stored
+	if c.flights != nil {
+		f, leader := c.joinFlight(cacheKey)
+		if leader {
+			// runs after the writer stored the response
+			defer c.leaveFlight(cacheKey, f)
+		} else if c.waitFlight(r.Context(), f) {
+			for _, re := range requestEncoding {
+				ce = strings.TrimSpace(re)
+				cacheData, cacheMeta, err = db.Get(cacheKey, reqHdr, ce)
+				if err == nil {
+					c.serveCached(w, r, cacheMeta, cacheData, ce, "COALESCED")
+					return nil
 				}
 			}
+		}
+		// leader failed, timed out or stored nothing usable, go to the origin
+	}
 
-			w.WriteHeader(http.StatusNotModified) // 304
-			// Don't send body for 304 responses
-			return nil
+	// find the copy to fall back to if the origin fails
+	var staleData []byte
+	var staleMeta *CacheMeta
+	staleCe := ""
+	if c.StaleIfError > 0 {
+		for _, re := range requestEncoding {
+			staleCe = strings.TrimSpace(re)
+			staleData, staleMeta, err = db.GetStale(cacheKey, reqHdr, staleCe)
+			if err == nil {
+				break
+			}
 		}
+	}
+
+	nw := NewCustomWriter(w, r, db, c.logger, c)
+	defer nw.Close()
+	if staleMeta == nil {
+		return next.ServeHTTP(nw, r)
+	}
 
-		// No conditional request or content has changed, send full response
-		hdr.Set(c.CacheHeaderName, "HIT")
-		hdr.Set("Vary", "Accept-Encoding")
-		if ce != "none" {
-			hdr.Set("Content-Encoding", ce)
+	// hold back 5xx responses, the stale entry replaces them
+	origHdr := hdr.Clone()
+	nw.holdErrors = true
+	err = next.ServeHTTP(nw, r)
+	if nw.Held() || (err != nil && !nw.Started()) {
+		c.logger.Warn("wp cache - origin failed, serving stale", zap.String("key", cacheKey), zap.Error(err))
+		// drop the headers of the failed response
+		for k := range hdr {
+			delete(hdr, k)
 		}
-		// set header back
+		for k, v := range origHdr {
+			hdr[k] = v
+		}
+		c.serveCached(w, r, staleMeta, staleData, staleCe, "STALE-ERROR")
+		return nil
+	}
+	return err
+}
+
+// serveCached writes a cached entry, or a 304 when the conditional request matches it
+func (c *Cache) serveCached(w http.ResponseWriter, r *http.Request, cacheMeta *CacheMeta, cacheData []byte, ce string, cacheState string) {
+	hdr := w.Header()
+
+	// Check for conditional requests (If-None-Match, If-Modified-Since)
+	if checkConditionalRequest(r, cacheMeta) {
+		// Content hasn't changed, return 304 Not Modified
+		hdr.Set(c.CacheHeaderName, cacheState+"-304")
+
+		// Set validation headers (ETag, Last-Modified) from cache
 		for _, kv := range cacheMeta.Header {
 			if len(kv) != 2 {
 				continue
 			}
-			hdr.Set(kv[0], kv[1])
+			// Only include specific headers for 304 response
+			if kv[0] == "Etag" || kv[0] == "Last-Modified" || kv[0] == "Cache-Control" || kv[0] == "Expires" {
+				hdr.Set(kv[0], kv[1])
+			}
 		}
-		w.WriteHeader(cacheMeta.StateCode)
-		w.Write(cacheData)
+		mergeVary(hdr, cacheMeta.GetHeader("Vary"))
 
-		return nil
+		w.WriteHeader(http.StatusNotModified) // 304
+		// Don't send body for 304 responses
+		return
 	}
-	c.logger.Debug("wp cache - error - "+cacheKey, zap.Error(err))
 
-	nw := NewCustomWriter(w, r, db, c.logger, c)
-	defer nw.Close()
-	return next.ServeHTTP(nw, r)
+	// No conditional request or content has changed, send full response
+	hdr.Set(c.CacheHeaderName, cacheState)
+	if ce != "none" {
+		hdr.Set("Content-Encoding", ce)
+	}
+	// set header back
+	for _, kv := range cacheMeta.Header {
+		if len(kv) != 2 {
+			continue
+		}
+		hdr.Set(kv[0], kv[1])
+	}
+	setEdgeTags(hdr, c.edgeTags, cacheMeta.Tags)
+	mergeVary(hdr, cacheMeta.GetHeader("Vary"))
+	w.WriteHeader(cacheMeta.StateCode)
+	w.Write(cacheData)
+}
+
+// revalidate refreshes the cache key in the background,
+// at most one refresh per key runs at a time
+func (c *Cache) revalidate(cacheKey string, r *http.Request, next caddyhttp.Handler) {
+	if _, running := c.refreshing.LoadOrStore(cacheKey, struct{}{}); running {
+		return
+	}
+	r = r.Clone(context.Background())
+	go func() {
+		defer c.refreshing.Delete(cacheKey)
+		c.doCache(r, next)
+	}()
 }
 
 func (c *Cache) doCache(r0 *http.Request, next caddyhttp.Handler) {
@@ -492,9 +1013,22 @@ func (c *Cache) doCache(r0 *http.Request, next caddyhttp.Handler) {
 	next.ServeHTTP(nw, r)
 }
 
+// Cleanup removes the cache from the admin API and flushes the CDN queues
+func (c *Cache) Cleanup() error {
+	unregisterZone(c)
+	// send what the CDNs still have queued, without holding up a reload for long
+	ctx, cancel := context.WithTimeout(context.Background(), cdnCleanupTimeout)
+	defer cancel()
+	for _, driver := range c.cdns {
+		driver.cdnBase().flush(ctx, driver)
+	}
+	return nil
+}
+
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Cache)(nil)
+	_ caddy.CleanerUpper          = (*Cache)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Cache)(nil)
 	_ caddyfile.Unmarshaler       = (*Cache)(nil)
 	// _ caddy.Validator             = (*Cache)(nil)
@@ -512,4 +1046,4 @@ func (nop *NopResponseWriter) Write(buf []byte) (int, error) {
 
 func (nop *NopResponseWriter) Header() http.Header {
 	return http.Header(*nop)
-}
\ No newline at end of file
+}
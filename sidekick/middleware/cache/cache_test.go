@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// serveGet sends a GET of target through c, with next as the origin
+func serveGet(c *Cache, next caddyhttp.Handler, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("GET", target, nil), next)
+	return w
+}
+
+// setExpired stores an entry for target that expired secs ago
+func setExpired(t *testing.T, d *Store, target, body string, secs int64) {
+	t.Helper()
+	meta := testMeta()
+	meta.Timestamp -= secs + 60
+	meta.Expires = time.Now().Unix() - secs
+	if err := d.Set(target+"::", d.Generation(), http.Header{}, meta, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond until it holds or a second passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, StaleWhileRevalidate: 60, CacheResponseCodes: []string{"2"}})
+	setExpired(t, c.Store, "/a/", "old", 1)
+
+	var renders atomic.Int32
+	release := make(chan struct{})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		renders.Add(1)
+		<-release
+		w.Write([]byte("new"))
+		return nil
+	})
+
+	// every hit in the window gets the old entry, one refresh runs for all of them
+	for i := 0; i < 3; i++ {
+		w := serveGet(c, next, "/a/")
+		if got := w.Header().Get(c.CacheHeaderName); got != "STALE" || w.Body.String() != "old" {
+			t.Fatalf("hit %d: %s %q, want the stale entry", i, got, w.Body.String())
+		}
+	}
+	waitFor(t, "the refresh to start", func() bool { return renders.Load() == 1 })
+	close(release)
+
+	waitFor(t, "the refreshed entry", func() bool {
+		value, _, err := c.Store.Get("/a/::", http.Header{}, "none")
+		return err == nil && string(value) == "new"
+	})
+	if n := renders.Load(); n != 1 {
+		t.Errorf("the stale entry was rendered %d times, want once", n)
+	}
+	if w := serveGet(c, next, "/a/"); w.Header().Get(c.CacheHeaderName) != "HIT" || w.Body.String() != "new" {
+		t.Errorf("after the refresh: %s %q", w.Header().Get(c.CacheHeaderName), w.Body.String())
+	}
+}
+
+func TestStaleWindowEnds(t *testing.T) {
+	d := newTestStore(t, StoreOptions{TTL: 60, StaleWhileRevalidate: 30})
+	setExpired(t, d, "/a/", "in", 10)
+	setExpired(t, d, "/b/", "past", 40)
+
+	if value, _, err := d.Get("/a/::", http.Header{}, "none"); !errors.Is(err, ErrCacheStale) || string(value) != "in" {
+		t.Errorf("inside the window: Get returned %q, %v", value, err)
+	}
+	if _, _, err := d.Get("/b/::", http.Header{}, "none"); !errors.Is(err, ErrCacheExpired) {
+		t.Errorf("past the window: Get returned %v", err)
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	failures := map[string]caddyhttp.HandlerFunc{
+		"5xx": func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("bad gateway"))
+			return nil
+		},
+		"handler error": func(w http.ResponseWriter, r *http.Request) error {
+			return errors.New("php down")
+		},
+	}
+	for name, next := range failures {
+		c := newTestCache(t, &Cache{TTL: 60, StaleIfError: 600, CacheResponseCodes: []string{"2"}})
+		setExpired(t, c.Store, "/a/", "old", 60)
+		setExpired(t, c.Store, "/gone/", "old", 700)
+
+		w := httptest.NewRecorder()
+		err := c.ServeHTTP(w, httptest.NewRequest("GET", "/a/", nil), next)
+		if err != nil || w.Code != http.StatusOK || w.Header().Get(c.CacheHeaderName) != "STALE-ERROR" || w.Body.String() != "old" {
+			t.Errorf("%s: answered %d %s %q, %v, want the stale entry", name, w.Code, w.Header().Get(c.CacheHeaderName), w.Body.String(), err)
+		}
+
+		// past stale_if_error the failure goes through
+		w = httptest.NewRecorder()
+		err = c.ServeHTTP(w, httptest.NewRequest("GET", "/gone/", nil), next)
+		if w.Body.String() == "old" || (err == nil && w.Code != http.StatusBadGateway) {
+			t.Errorf("%s past the window: answered %d %q, %v", name, w.Code, w.Body.String(), err)
+		}
+	}
+}
+
+func TestStaleIfErrorOriginRecovers(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, StaleIfError: 600, CacheResponseCodes: []string{"2"}})
+	setExpired(t, c.Store, "/a/", "old", 60)
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Write([]byte("new"))
+		return nil
+	})
+	if w := serveGet(c, next, "/a/"); w.Body.String() != "new" || w.Header().Get(c.CacheHeaderName) != "MISS" {
+		t.Errorf("working origin: %s %q, want the new response", w.Header().Get(c.CacheHeaderName), w.Body.String())
+	}
+}
@@ -0,0 +1,459 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// cdnBackoff is the wait before the first retry of a batch, doubled for every further one
+var cdnBackoff = time.Second
+
+// cdnCleanupTimeout bounds sending the queued purges when the config unloads,
+// what doesn't make it goes to the dead-letter file
+const cdnCleanupTimeout = 5 * time.Second
+
+// CDNDriver purges a CDN in front of the site. Drivers are Caddy modules in the
+// http.handlers.wp_cache.cdn namespace and embed CDNBase for the queue options.
+type CDNDriver interface {
+	// Purge sends one batch, at most BatchSize URLs, prefixes or tags
+	Purge(ctx context.Context, p *CDNPurge) error
+	cdnBase() *CDNBase
+}
+
+// CDNPurge is what a local purge removes, translated for CDNs
+type CDNPurge struct {
+	// URLs are full URLs of pages
+	URLs []string `json:"urls,omitempty"`
+	// Prefixes are full URLs everything below is purged
+	Prefixes []string `json:"prefixes,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// All purges everything, for flushes and purges a CDN can't express
+	All bool `json:"all,omitempty"`
+}
+
+func (p *CDNPurge) empty() bool {
+	return !p.All && len(p.URLs) == 0 && len(p.Prefixes) == 0 && len(p.Tags) == 0
+}
+
+// merge adds other to the purge, everything swallows the rest
+func (p *CDNPurge) merge(other *CDNPurge) {
+	if p.All || other.All {
+		*p = CDNPurge{All: true}
+		return
+	}
+	p.URLs = appendNew(p.URLs, other.URLs)
+	p.Prefixes = appendNew(p.Prefixes, other.Prefixes)
+	p.Tags = appendNew(p.Tags, other.Tags)
+}
+
+func appendNew(list []string, values []string) []string {
+	for _, v := range values {
+		if !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// chunks splits the purge into batches of at most size entries of one kind
+func (p *CDNPurge) chunks(size int) []*CDNPurge {
+	if p.All {
+		return []*CDNPurge{{All: true}}
+	}
+	chunks := make([]*CDNPurge, 0, 1)
+	split := func(list []string, set func(*CDNPurge, []string)) {
+		for len(list) > 0 {
+			n := min(size, len(list))
+			chunk := &CDNPurge{}
+			set(chunk, list[:n])
+			chunks = append(chunks, chunk)
+			list = list[n:]
+		}
+	}
+	split(p.URLs, func(c *CDNPurge, l []string) { c.URLs = l })
+	split(p.Prefixes, func(c *CDNPurge, l []string) { c.Prefixes = l })
+	split(p.Tags, func(c *CDNPurge, l []string) { c.Tags = l })
+	return chunks
+}
+
+// cdnTagHeader is the response header a CDN reads the purge tags of a page from
+type cdnTagHeader struct {
+	name string
+	sep  string
+}
+
+// setEdgeTags hands the tags of a page on to the CDNs, in the header each of them reads
+func setEdgeTags(hdr http.Header, headers []cdnTagHeader, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	for _, h := range headers {
+		hdr.Set(h.name, strings.Join(tags, h.sep))
+	}
+}
+
+// CDNBase holds the options every driver shares and queues its purges.
+// Purges arriving within Delay are merged and sent in batches of BatchSize,
+// a batch failing Retries more times goes to the dead-letter log.
+type CDNBase struct {
+	BaseURL   string
+	BatchSize int
+	Delay     caddy.Duration
+	// Retries is how many times a failed batch is sent again, 3 when unset
+	Retries *int
+	Timeout caddy.Duration
+
+	name    string
+	retries int
+	// the header tag purges match against, none when the CDN can't purge by tag
+	tags   cdnTagHeader
+	client *http.Client
+	logger *zap.Logger
+	dead   *deadLetter
+	queue  *cdnQueue
+}
+
+// cdnQueue is the purge waiting for the delay to pass
+type cdnQueue struct {
+	mu      sync.Mutex
+	pending *CDNPurge
+	timer   *time.Timer
+}
+
+func (b *CDNBase) cdnBase() *CDNBase {
+	return b
+}
+
+// parseOption parses the shared options, reporting whether key was one of them
+func (b *CDNBase) parseOption(d *caddyfile.Dispenser, key string, args []string) (bool, error) {
+	switch key {
+	case "base_url":
+		if len(args) != 1 {
+			return true, d.ArgErr()
+		}
+		b.BaseURL = strings.TrimSuffix(args[0], "/")
+
+	case "batch_size", "retries":
+		if len(args) != 1 {
+			return true, d.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return true, d.Errf("invalid %s '%s'", key, args[0])
+		}
+		if key == "batch_size" {
+			b.BatchSize = n
+		} else {
+			b.Retries = &n
+		}
+
+	case "delay", "timeout":
+		if len(args) != 1 {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(args[0])
+		if err != nil {
+			return true, d.Errf("invalid %s '%s'", key, args[0])
+		}
+		if key == "delay" {
+			b.Delay = caddy.Duration(dur)
+		} else {
+			b.Timeout = caddy.Duration(dur)
+		}
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// provision fills the defaults, batchSize and baseURL are the limits and API of the driver
+func (b *CDNBase) provision(name string, batchSize int, baseURL string) {
+	b.name = name
+	if b.BaseURL == "" {
+		b.BaseURL = baseURL
+	}
+	if b.BatchSize <= 0 {
+		b.BatchSize = batchSize
+	}
+	if b.Delay == 0 {
+		b.Delay = caddy.Duration(2 * time.Second)
+	}
+	b.retries = 3
+	if b.Retries != nil {
+		b.retries = *b.Retries
+	}
+	if b.Timeout == 0 {
+		b.Timeout = caddy.Duration(15 * time.Second)
+	}
+	b.client = &http.Client{Timeout: time.Duration(b.Timeout)}
+	b.logger = zap.NewNop()
+	b.queue = &cdnQueue{}
+}
+
+// enqueue merges the purge into the pending one, sent once Delay passes
+func (b *CDNBase) enqueue(driver CDNDriver, p *CDNPurge) {
+	q := b.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == nil {
+		q.pending = &CDNPurge{}
+	}
+	q.pending.merge(p)
+	if q.timer == nil {
+		q.timer = time.AfterFunc(time.Duration(b.Delay), func() {
+			b.flush(context.Background(), driver)
+		})
+	}
+}
+
+// flush sends the pending purge in batches. Once ctx is done the batches
+// left are written to the dead-letter file without being sent.
+func (b *CDNBase) flush(ctx context.Context, driver CDNDriver) {
+	q := b.queue
+	q.mu.Lock()
+	p := q.pending
+	q.pending = nil
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	q.mu.Unlock()
+	if p == nil || p.empty() {
+		return
+	}
+
+	for _, chunk := range p.chunks(b.BatchSize) {
+		err := ctx.Err()
+		if err == nil {
+			err = b.send(ctx, driver, chunk)
+		}
+		if err != nil {
+			b.logger.Error("wp cache - cdn - purge failed", zap.String("cdn", b.name), zap.Any("purge", chunk), zap.Error(err))
+			b.dead.write(b.name, chunk, err)
+		}
+	}
+}
+
+// send tries a batch until it succeeds, the retries run out or ctx is done, backing off in between
+func (b *CDNBase) send(ctx context.Context, driver CDNDriver, chunk *CDNPurge) error {
+	backoff := cdnBackoff
+	var err error
+	for attempt := 0; attempt <= b.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%v, gave up: %w", err, ctx.Err())
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, time.Duration(b.Timeout))
+		err = driver.Purge(attemptCtx, chunk)
+		cancel()
+		if err == nil {
+			b.logger.Debug("wp cache - cdn - purged", zap.String("cdn", b.name), zap.Any("purge", chunk))
+			return nil
+		}
+	}
+	return err
+}
+
+// do sends a request to the CDN API, any status but 2XX is an error
+func (b *CDNBase) do(req *http.Request) ([]byte, error) {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return body, fmt.Errorf("%s answered %d: %s", b.name, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// deadLetter appends purges that failed for good to a file, one JSON object per line
+type deadLetter struct {
+	mu     sync.Mutex
+	path   string
+	logger *zap.Logger
+}
+
+func (dl *deadLetter) write(name string, p *CDNPurge, cause error) {
+	if dl == nil || dl.path == "" {
+		return
+	}
+	line, _ := json.Marshal(struct {
+		Time  string    `json:"time"`
+		CDN   string    `json:"cdn"`
+		Purge *CDNPurge `json:"purge"`
+		Error string    `json:"error"`
+	}{time.Now().UTC().Format(time.RFC3339), name, p, cause.Error()})
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	f, err := os.OpenFile(dl.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		dl.logger.Error("wp cache - cdn - dead letter failed", zap.String("path", dl.path), zap.Error(err))
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+// provisionCDNs loads the CDN drivers. Without any configured, a Cloudflare
+// driver is set up when CLOUDFLARE_ZONE_ID and CLOUDFLARE_API_TOKEN are set.
+// With drivers, the directory of the dead-letter file must be writable.
+func (c *Cache) provisionCDNs(ctx caddy.Context) error {
+	if c.SiteURL == "" {
+		c.SiteURL = os.Getenv("CACHE_SITE_URL")
+	}
+	if c.CDNDeadLetter == "" {
+		c.CDNDeadLetter = os.Getenv("CDN_DEAD_LETTER")
+		if c.CDNDeadLetter == "" {
+			loc := c.Loc
+			if loc == "" {
+				loc = defaultCacheLoc
+			}
+			c.CDNDeadLetter = filepath.Join(loc, DATA_DIR, "sidekick-cdn-dead-letter.log")
+		}
+	}
+
+	if c.CDNRaw != nil {
+		mods, err := ctx.LoadModule(c, "CDNRaw")
+		if err != nil {
+			return fmt.Errorf("loading cdn drivers: %v", err)
+		}
+		for _, mod := range mods.([]any) {
+			c.cdns = append(c.cdns, mod.(CDNDriver))
+		}
+	} else if os.Getenv("CLOUDFLARE_ZONE_ID") != "" && os.Getenv("CLOUDFLARE_API_TOKEN") != "" {
+		cf := &Cloudflare{}
+		if err := cf.Provision(ctx); err != nil {
+			return err
+		}
+		c.cdns = append(c.cdns, cf)
+	}
+
+	if len(c.cdns) > 0 {
+		if err := checkWritableDir(filepath.Dir(c.CDNDeadLetter)); err != nil {
+			return fmt.Errorf("cdn dead letter: %v", err)
+		}
+	}
+
+	dead := &deadLetter{path: c.CDNDeadLetter, logger: c.logger}
+	for _, driver := range c.cdns {
+		base := driver.cdnBase()
+		base.logger = c.logger
+		base.dead = dead
+		if base.tags.name != "" && !slices.Contains(c.edgeTags, base.tags) {
+			c.edgeTags = append(c.edgeTags, base.tags)
+		}
+	}
+	return nil
+}
+
+// checkWritableDir creates dir and checks a file can be written in it
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// withCDN wraps a purge so the CDNs are purged once it is done here. Purges
+// forwarded by a peer are left out, the replica they came from sends them.
+func (c *Cache) withCDN(purge func() *PurgeResult, r *http.Request, p *CDNPurge) func() *PurgeResult {
+	if len(c.cdns) == 0 || p == nil || p.empty() || (r != nil && r.Header.Get(peerForwardedHeader) != "") {
+		return purge
+	}
+	return func() *PurgeResult {
+		res := purge()
+		for _, driver := range c.cdns {
+			driver.cdnBase().enqueue(driver, p)
+		}
+		return res
+	}
+}
+
+// siteURL is the scheme and host CDN purges build URLs with
+func (c *Cache) siteURL(r *http.Request) string {
+	if c.SiteURL != "" {
+		return strings.TrimSuffix(c.SiteURL, "/")
+	}
+	if r == nil || r.Host == "" {
+		return ""
+	}
+	return "https://" + r.Host
+}
+
+// cdnPurgePath translates a purge of the request path for the CDNs
+func cdnPurgePath(site, reqPath string, mode PurgeMode) *CDNPurge {
+	if site == "" {
+		return nil
+	}
+	if mode == PurgeExact {
+		return &CDNPurge{URLs: []string{site + reqPath}}
+	}
+	return &CDNPurge{Prefixes: []string{site + reqPath}}
+}
+
+// cdnPurgeRelated translates the also paths of purge rules, a path with *
+// purges everything below the part before it
+func cdnPurgeRelated(site string, paths []string) *CDNPurge {
+	p := &CDNPurge{}
+	for _, reqPath := range paths {
+		if prefix, _, ok := strings.Cut(reqPath, "*"); ok {
+			p.Prefixes = append(p.Prefixes, site+prefix)
+		} else {
+			p.URLs = append(p.URLs, site+reqPath)
+		}
+	}
+	return p
+}
+
+// cdnPurgeBatch translates a batch for the CDNs. Regexes and hosts
+// can't be expressed by a CDN, so they purge everything.
+func cdnPurgeBatch(site string, b *PurgeBatch) *CDNPurge {
+	if len(b.Regexes) > 0 || len(b.Hosts) > 0 {
+		return &CDNPurge{All: true}
+	}
+	p := &CDNPurge{Tags: b.Tags}
+	mode, _ := ParsePurgeMode(b.Mode)
+	for _, raw := range b.URLs {
+		if strings.Contains(raw, "://") {
+			p.URLs = append(p.URLs, raw)
+		} else if site != "" {
+			p.URLs = append(p.URLs, site+raw)
+		}
+	}
+	if site != "" {
+		for _, prefix := range b.Prefixes {
+			p.Prefixes = append(p.Prefixes, site+prefix)
+		}
+		for _, reqPath := range b.Paths {
+			p.merge(cdnPurgePath(site, reqPath, mode))
+		}
+	}
+	return p
+}
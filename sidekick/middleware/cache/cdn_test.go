@@ -0,0 +1,503 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// cdnRequest is a request a mock CDN API received
+type cdnRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   string
+}
+
+// mockCDN records the requests it receives and answers with body, failing
+// the first fails requests with a 500, or every request when fails is negative
+type mockCDN struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []cdnRequest
+	fails    int
+	body     string
+}
+
+func newMockCDN(t *testing.T, fails int, body string) *mockCDN {
+	t.Helper()
+	m := &mockCDN{fails: fails, body: body}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := io.ReadAll(r.Body)
+		m.mu.Lock()
+		m.requests = append(m.requests, cdnRequest{r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Clone(), string(buf)})
+		fail := m.fails != 0
+		if m.fails > 0 {
+			m.fails--
+		}
+		m.mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, m.body)
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockCDN) received() []cdnRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]cdnRequest(nil), m.requests...)
+}
+
+// provisionTestCDN provisions the driver against the mock, with a dead-letter file
+// in a temporary directory and retries backing off for a millisecond
+func provisionTestCDN(t *testing.T, driver CDNDriver, m *mockCDN) string {
+	t.Helper()
+	backoff := cdnBackoff
+	cdnBackoff = time.Millisecond
+	t.Cleanup(func() { cdnBackoff = backoff })
+
+	base := driver.cdnBase()
+	base.BaseURL = m.URL
+	if err := driver.(caddy.Provisioner).Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	dead := filepath.Join(t.TempDir(), "dead-letter.log")
+	base.logger = zap.NewNop()
+	base.dead = &deadLetter{path: dead, logger: base.logger}
+	return dead
+}
+
+// purgeNow queues the purges and sends them without waiting for the delay
+func purgeNow(driver CDNDriver, purges ...*CDNPurge) {
+	base := driver.cdnBase()
+	for _, p := range purges {
+		base.enqueue(driver, p)
+	}
+	base.flush(context.Background(), driver)
+}
+
+func readDeadLetter(t *testing.T, fp string) []map[string]any {
+	t.Helper()
+	buf, err := os.ReadFile(fp)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		entry := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("dead letter line %q: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func intPtr(n int) *int {
+	return &n
+}
+
+func testURLs(n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("https://example.com/post-%d/", i)
+	}
+	return urls
+}
+
+func TestCloudflareBatches(t *testing.T) {
+	m := newMockCDN(t, 0, `{"success":true}`)
+	cf := &Cloudflare{ZoneID: "zone", APIToken: "token"}
+	dead := provisionTestCDN(t, cf, m)
+
+	urls := testURLs(65)
+	purgeNow(cf, &CDNPurge{URLs: urls[:40]}, &CDNPurge{URLs: urls[30:]}, &CDNPurge{Tags: []string{"post-1"}})
+
+	reqs := m.received()
+	if len(reqs) != 4 {
+		t.Fatalf("got %d requests, want 3 batches of URLs and 1 of tags", len(reqs))
+	}
+	sizes := []int{}
+	for _, req := range reqs {
+		if req.Path != "/zones/zone/purge_cache" || req.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected request %s %s", req.Method, req.Path)
+		}
+		body := struct {
+			Files []string `json:"files"`
+			Tags  []string `json:"tags"`
+		}{}
+		json.Unmarshal([]byte(req.Body), &body)
+		sizes = append(sizes, len(body.Files)+len(body.Tags))
+	}
+	if sizes[0] != 30 || sizes[1] != 30 || sizes[2] != 5 || sizes[3] != 1 {
+		t.Errorf("batch sizes %v, want [30 30 5 1]", sizes)
+	}
+	if lines := readDeadLetter(t, dead); len(lines) != 0 {
+		t.Errorf("dead letter written for successful purges: %v", lines)
+	}
+}
+
+func TestCloudflareRetry(t *testing.T) {
+	m := newMockCDN(t, 2, `{"success":true}`)
+	cf := &Cloudflare{ZoneID: "zone", APIToken: "token"}
+	dead := provisionTestCDN(t, cf, m)
+
+	purgeNow(cf, &CDNPurge{Prefixes: []string{"https://example.com/blog/"}})
+
+	reqs := m.received()
+	if len(reqs) != 3 {
+		t.Fatalf("got %d attempts, want 2 failures and a success", len(reqs))
+	}
+	if !strings.Contains(reqs[2].Body, `"prefixes":["example.com/blog/"]`) {
+		t.Errorf("prefix sent as %s", reqs[2].Body)
+	}
+	if lines := readDeadLetter(t, dead); len(lines) != 0 {
+		t.Errorf("dead letter written for a retried purge: %v", lines)
+	}
+}
+
+func TestCloudflareDeadLetter(t *testing.T) {
+	m := newMockCDN(t, -1, "")
+	cf := &Cloudflare{CDNBase: CDNBase{Retries: intPtr(1)}, ZoneID: "zone", APIToken: "token"}
+	dead := provisionTestCDN(t, cf, m)
+
+	purgeNow(cf, &CDNPurge{URLs: []string{"https://example.com/"}})
+
+	if n := len(m.received()); n != 2 {
+		t.Fatalf("got %d attempts, want 2", n)
+	}
+	lines := readDeadLetter(t, dead)
+	if len(lines) != 1 || lines[0]["cdn"] != "cloudflare" {
+		t.Fatalf("dead letter %v, want one cloudflare purge", lines)
+	}
+	if purge, _ := json.Marshal(lines[0]["purge"]); string(purge) != `{"urls":["https://example.com/"]}` {
+		t.Errorf("dead letter purge %s", purge)
+	}
+}
+
+func TestCDNRetriesZero(t *testing.T) {
+	cf := &Cloudflare{}
+	d := caddyfile.NewTestDispenser(`cloudflare {
+		zone_id zone
+		api_token token
+		retries 0
+	}`)
+	if err := cf.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	m := newMockCDN(t, -1, "")
+	dead := provisionTestCDN(t, cf, m)
+
+	purgeNow(cf, &CDNPurge{URLs: []string{"https://example.com/"}})
+	if n := len(m.received()); n != 1 {
+		t.Fatalf("retries 0 made %d attempts, want 1", n)
+	}
+	if lines := readDeadLetter(t, dead); len(lines) != 1 {
+		t.Fatalf("dead letter %v, want the purge", lines)
+	}
+
+	unset := &Cloudflare{ZoneID: "zone", APIToken: "token"}
+	provisionTestCDN(t, unset, m)
+	if unset.retries != 3 {
+		t.Errorf("unset retries provisioned as %d, want 3", unset.retries)
+	}
+}
+
+func TestCDNDeadLetterLocation(t *testing.T) {
+	t.Setenv("CDN_DEAD_LETTER", "")
+	t.Setenv("CLOUDFLARE_ZONE_ID", "")
+	c := &Cache{logger: zap.NewNop()}
+	if err := c.provisionCDNs(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	// without a location the file doesn't follow the working directory
+	if want := filepath.Join(defaultCacheLoc, DATA_DIR, "sidekick-cdn-dead-letter.log"); c.CDNDeadLetter != want {
+		t.Errorf("dead letter at %s, want %s", c.CDNDeadLetter, want)
+	}
+
+	// with a driver to dead-letter for, the directory must be writable
+	t.Setenv("CLOUDFLARE_ZONE_ID", "zone")
+	t.Setenv("CLOUDFLARE_API_TOKEN", "token")
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0o644)
+	c = &Cache{CDNDeadLetter: filepath.Join(file, "dead-letter.log"), logger: zap.NewNop()}
+	if err := c.provisionCDNs(caddy.Context{}); err == nil {
+		t.Error("provisioned a dead letter in a directory that can't be created")
+	}
+}
+
+func TestFastlyPurge(t *testing.T) {
+	m := newMockCDN(t, 0, `{"status":"ok"}`)
+	f := &Fastly{ServiceID: "svc", APIToken: "token"}
+	dead := provisionTestCDN(t, f, m)
+
+	tags := make([]string, 300)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("post-%d", i)
+	}
+	purgeNow(f,
+		&CDNPurge{URLs: []string{"https://example.com/a/"}},
+		&CDNPurge{Prefixes: []string{"https://example.com/blog/", "https://example.com/wp-sitemap"}},
+		&CDNPurge{Tags: tags},
+	)
+
+	reqs := m.received()
+	if len(reqs) != 5 {
+		t.Fatalf("got %d requests, want 3 URLs and 2 surrogate key batches", len(reqs))
+	}
+	if reqs[0].Path != "/purge/example.com/a/" || reqs[0].Header.Get("Fastly-Key") != "token" {
+		t.Errorf("URL purged with %s %s", reqs[0].Method, reqs[0].Path)
+	}
+	// no prefix purge, the page at each prefix is purged
+	if reqs[1].Path != "/purge/example.com/blog/" || reqs[2].Path != "/purge/example.com/wp-sitemap" {
+		t.Errorf("prefixes purged at %s and %s", reqs[1].Path, reqs[2].Path)
+	}
+	for i, n := range []int{256, 44} {
+		req := reqs[i+3]
+		if req.Path != "/service/svc/purge" {
+			t.Errorf("tags purged at %s", req.Path)
+		}
+		if got := len(strings.Fields(req.Header.Get("Surrogate-Key"))); got != n {
+			t.Errorf("surrogate key batch %d has %d keys, want %d", i, got, n)
+		}
+	}
+	for _, req := range reqs {
+		if strings.HasSuffix(req.Path, "/purge_all") {
+			t.Errorf("prefixes purged the whole service")
+		}
+	}
+
+	purgeNow(f, &CDNPurge{All: true})
+	if reqs := m.received(); reqs[len(reqs)-1].Path != "/service/svc/purge_all" {
+		t.Errorf("flush sent to %s", reqs[len(reqs)-1].Path)
+	}
+	if lines := readDeadLetter(t, dead); len(lines) != 0 {
+		t.Errorf("dead letter written: %v", lines)
+	}
+}
+
+func TestFastlyDeadLetter(t *testing.T) {
+	m := newMockCDN(t, -1, "")
+	f := &Fastly{CDNBase: CDNBase{Retries: intPtr(2)}, ServiceID: "svc", APIToken: "token"}
+	dead := provisionTestCDN(t, f, m)
+
+	purgeNow(f, &CDNPurge{Tags: []string{"home"}})
+
+	if n := len(m.received()); n != 3 {
+		t.Fatalf("got %d attempts, want 3", n)
+	}
+	if lines := readDeadLetter(t, dead); len(lines) != 1 || lines[0]["cdn"] != "fastly" {
+		t.Fatalf("dead letter %v, want one fastly purge", lines)
+	}
+}
+
+func TestBunnyPurge(t *testing.T) {
+	m := newMockCDN(t, 1, "")
+	b := &Bunny{PullZoneID: "42", AccessKey: "key"}
+	dead := provisionTestCDN(t, b, m)
+
+	purgeNow(b, &CDNPurge{
+		URLs:     testURLs(25),
+		Prefixes: []string{"https://example.com/blog/"},
+		Tags:     []string{"post-1"},
+	})
+
+	reqs := m.received()
+	// the first URL batch fails once and is sent again whole
+	if len(reqs) != 1+20+5+1+1 {
+		t.Fatalf("got %d requests, want a failure, 25 URLs, a prefix and a tag", len(reqs))
+	}
+	seen := map[string]int{}
+	for _, req := range reqs {
+		if req.Header.Get("AccessKey") != "key" {
+			t.Errorf("request without the access key: %s", req.Path)
+		}
+		seen[req.Path]++
+	}
+	if seen["/purge"] != 27 {
+		t.Errorf("got %d URL purges, want 27", seen["/purge"])
+	}
+	last := reqs[len(reqs)-1]
+	if last.Path != "/pullzone/42/purgeCache" || last.Body != `{"CacheTag":"post-1"}` {
+		t.Errorf("tag purged with %s %s", last.Path, last.Body)
+	}
+	prefix := reqs[len(reqs)-2]
+	if prefix.Query != "url=https%3A%2F%2Fexample.com%2Fblog%2F%2A" {
+		t.Errorf("prefix purged with %s", prefix.Query)
+	}
+	if lines := readDeadLetter(t, dead); len(lines) != 0 {
+		t.Errorf("dead letter written: %v", lines)
+	}
+}
+
+func TestBunnyDeadLetter(t *testing.T) {
+	m := newMockCDN(t, -1, "")
+	b := &Bunny{CDNBase: CDNBase{Retries: intPtr(1)}, PullZoneID: "42", AccessKey: "key"}
+	dead := provisionTestCDN(t, b, m)
+
+	purgeNow(b, &CDNPurge{All: true})
+
+	if n := len(m.received()); n != 2 {
+		t.Fatalf("got %d attempts, want 2", n)
+	}
+	if lines := readDeadLetter(t, dead); len(lines) != 1 || lines[0]["cdn"] != "bunny" {
+		t.Fatalf("dead letter %v, want one bunny purge", lines)
+	}
+}
+
+func TestVarnishPurge(t *testing.T) {
+	m := newMockCDN(t, 1, "")
+	v := &Varnish{}
+	dead := provisionTestCDN(t, v, m)
+
+	purgeNow(v,
+		&CDNPurge{URLs: []string{"https://example.com/a/", "https://example.org/b.php"}},
+		&CDNPurge{Prefixes: []string{"https://example.com/blog/"}},
+		&CDNPurge{Tags: []string{"post-1", "home"}},
+	)
+
+	reqs := m.received()
+	// the URL batch fails on its first host and is sent again whole
+	if len(reqs) != 1+2+1+1 {
+		t.Fatalf("got %d requests, want a failure, 2 URL hosts, a prefix and a tag ban", len(reqs))
+	}
+	for _, req := range reqs {
+		if req.Method != "BAN" {
+			t.Errorf("sent %s, want BAN", req.Method)
+		}
+	}
+	if got := reqs[1].Header.Get("X-Ban-Url"); got != `^(/a/(\?.*)?$)` || reqs[1].Header.Get("X-Ban-Host") != `^example\.com$` {
+		t.Errorf("URL banned with host %s url %s", reqs[1].Header.Get("X-Ban-Host"), got)
+	}
+	if got := reqs[3].Header.Get("X-Ban-Url"); got != "^(/blog/)" {
+		t.Errorf("prefix banned with %s", got)
+	}
+	if got := reqs[4].Header.Get("X-Ban-Tags"); got != `(^|,)\s*(post-1|home)\s*(,|$)` {
+		t.Errorf("tags banned with %s", got)
+	}
+	if lines := readDeadLetter(t, dead); len(lines) != 0 {
+		t.Errorf("dead letter written: %v", lines)
+	}
+}
+
+func TestVarnishDeadLetter(t *testing.T) {
+	m := newMockCDN(t, -1, "")
+	v := &Varnish{CDNBase: CDNBase{Retries: intPtr(1)}}
+	dead := provisionTestCDN(t, v, m)
+
+	purgeNow(v, &CDNPurge{Tags: []string{"home"}})
+
+	if n := len(m.received()); n != 2 {
+		t.Fatalf("got %d attempts, want 2", n)
+	}
+	if lines := readDeadLetter(t, dead); len(lines) != 1 || lines[0]["cdn"] != "varnish" {
+		t.Fatalf("dead letter %v, want one varnish purge", lines)
+	}
+}
+
+func TestCDNFlushDeadline(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	cf := &Cloudflare{ZoneID: "zone", APIToken: "token"}
+	dead := provisionTestCDN(t, cf, &mockCDN{Server: srv})
+	cf.enqueue(cf, &CDNPurge{URLs: testURLs(65)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	cf.flush(ctx, cf)
+
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("flush took %v past its deadline", took)
+	}
+	if lines := readDeadLetter(t, dead); len(lines) != 3 {
+		t.Fatalf("dead letter has %d batches, want all 3", len(lines))
+	}
+}
+
+func TestSetEdgeTags(t *testing.T) {
+	hdr := http.Header{}
+	headers := []cdnTagHeader{{name: "Cache-Tag", sep: ","}, {name: "Surrogate-Key", sep: " "}}
+
+	setEdgeTags(hdr, headers, nil)
+	if len(hdr) != 0 {
+		t.Fatalf("untagged page got %v", hdr)
+	}
+
+	setEdgeTags(hdr, headers, []string{"home", "post-1"})
+	if hdr.Get("Cache-Tag") != "home,post-1" || hdr.Get("Surrogate-Key") != "home post-1" {
+		t.Errorf("edge tags %v", hdr)
+	}
+}
+
+func TestCDNPurgeRelated(t *testing.T) {
+	rule := PurgeRule{PathPrefix: "/blog/", Also: []string{"/", "/feed/*"}}
+	tests := []struct {
+		name  string
+		query string
+		body  string
+		want  CDNPurge
+	}{
+		{"batch", "", `{"urls":["/blog/post/"]}`, CDNPurge{URLs: []string{"https://example.com/blog/post/", "https://example.com/"}, Prefixes: []string{"https://example.com/feed/"}}},
+		{"tags", "?tags=post-1", "", CDNPurge{URLs: []string{"https://example.com/"}, Prefixes: []string{"https://example.com/feed/"}, Tags: []string{"post-1"}}},
+		{"batch without related", "?related=0", `{"urls":["/blog/post/"]}`, CDNPurge{URLs: []string{"https://example.com/blog/post/"}}},
+		{"tags without related", "?tags=post-1&related=0", "", CDNPurge{Tags: []string{"post-1"}}},
+	}
+	for _, tt := range tests {
+		c := newTestCache(t, &Cache{TTL: 60, PurgeRules: []PurgeRule{rule}})
+		c.Store.Set("/blog/post/::", c.Store.Generation(), http.Header{}, testMeta("post-1"), []byte("post"))
+		cf := &Cloudflare{ZoneID: "zone", APIToken: "token", CDNBase: CDNBase{Delay: caddy.Duration(time.Hour)}}
+		provisionTestCDN(t, cf, newMockCDN(t, 0, `{"success":true}`))
+		c.cdns = []CDNDriver{cf}
+
+		r := httptest.NewRequest("POST", c.PurgePath+"/"+tt.query, strings.NewReader(tt.body))
+		if tt.body != "" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		purge, err := c.preparePurge(httptest.NewRecorder(), r, "/", "https://example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		purge()
+
+		// take the purge off the queue, nothing is sent
+		cf.queue.mu.Lock()
+		got := *cf.queue.pending
+		cf.queue.pending = nil
+		cf.queue.timer.Stop()
+		cf.queue.timer = nil
+		cf.queue.mu.Unlock()
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: CDN purge %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
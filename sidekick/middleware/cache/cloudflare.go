@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(Cloudflare{})
+}
+
+// Cloudflare purges a Cloudflare zone. Tag purges match the Cache-Tag header
+// the cache adds to responses, Cloudflare strips it before the client.
+type Cloudflare struct {
+	CDNBase
+	ZoneID   string
+	APIToken string
+}
+
+// CaddyModule returns the Caddy module information.
+func (Cloudflare) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.wp_cache.cdn.cloudflare",
+		New: func() caddy.Module {
+			return new(Cloudflare)
+		},
+	}
+}
+
+// UnmarshalCaddyfile parses a cloudflare block:
+//
+//	cdn cloudflare {
+//		zone_id <id>
+//		api_token <token>
+//		base_url https://api.cloudflare.com/client/v4
+//		batch_size 30
+//		delay 2s
+//		retries 3
+//		timeout 15s
+//	}
+func (cf *Cloudflare) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // driver name
+	return parseBlock(d, func(key string, args []string) error {
+		if ok, err := cf.parseOption(d, key, args); ok {
+			return err
+		}
+		switch key {
+		case "zone_id":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			cf.ZoneID = args[0]
+
+		case "api_token":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			cf.APIToken = args[0]
+
+		default:
+			return d.Errf("unknown cloudflare option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Provision fills the credentials from CLOUDFLARE_ZONE_ID and CLOUDFLARE_API_TOKEN
+func (cf *Cloudflare) Provision(ctx caddy.Context) error {
+	if cf.ZoneID == "" {
+		cf.ZoneID = os.Getenv("CLOUDFLARE_ZONE_ID")
+	}
+	if cf.APIToken == "" {
+		cf.APIToken = os.Getenv("CLOUDFLARE_API_TOKEN")
+	}
+	if cf.ZoneID == "" || cf.APIToken == "" {
+		return errors.New("cloudflare needs a zone_id and an api_token")
+	}
+	// the API takes up to 30 files, prefixes or tags per call
+	cf.provision("cloudflare", 30, "https://api.cloudflare.com/client/v4")
+	cf.tags = cdnTagHeader{name: "Cache-Tag", sep: ","}
+	return nil
+}
+
+// Purge calls purge_cache with one kind of target, the API doesn't mix them
+func (cf *Cloudflare) Purge(ctx context.Context, p *CDNPurge) error {
+	body := map[string]any{}
+	switch {
+	case p.All:
+		body["purge_everything"] = true
+	case len(p.URLs) > 0:
+		body["files"] = p.URLs
+	case len(p.Prefixes) > 0:
+		// prefixes go without the scheme
+		prefixes := make([]string, len(p.Prefixes))
+		for i, prefix := range p.Prefixes {
+			_, prefixes[i], _ = strings.Cut(prefix, "://")
+		}
+		body["prefixes"] = prefixes
+	case len(p.Tags) > 0:
+		body["tags"] = p.Tags
+	}
+	buf, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", cf.BaseURL+"/zones/"+cf.ZoneID+"/purge_cache", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cf.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+	resBody, err := cf.do(req)
+	if err != nil {
+		return err
+	}
+
+	res := struct {
+		Success bool            `json:"success"`
+		Errors  json.RawMessage `json:"errors"`
+	}{}
+	if err := json.Unmarshal(resBody, &res); err != nil {
+		return err
+	}
+	if !res.Success {
+		return fmt.Errorf("cloudflare purge failed: %s", res.Errors)
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ CDNDriver             = (*Cloudflare)(nil)
+	_ caddy.Provisioner     = (*Cloudflare)(nil)
+	_ caddyfile.Unmarshaler = (*Cloudflare)(nil)
+)
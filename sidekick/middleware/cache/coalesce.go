@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// flight is a miss being rendered by the origin,
+// other requests for the same key wait for it instead of hitting PHP too
+type flight struct {
+	done chan struct{}
+}
+
+// joinFlight makes the request the leader of the key,
+// or returns the flight of the current leader to wait on
+func (c *Cache) joinFlight(cacheKey string) (*flight, bool) {
+	f := &flight{done: make(chan struct{})}
+	leader, loaded := c.flights.LoadOrStore(cacheKey, f)
+	return leader, !loaded
+}
+
+// leaveFlight wakes up the waiters once the leader stored its response
+func (c *Cache) leaveFlight(cacheKey string, f *flight) {
+	c.flights.Delete(cacheKey)
+	close(f.done)
+}
+
+// waitFlight waits for the leader to finish, false on timeout or when the client went away
+func (c *Cache) waitFlight(ctx context.Context, f *flight) bool {
+	timer := time.NewTimer(time.Duration(c.CoalesceTimeout))
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// slowOrigin renders the path, the first render waits for release
+func slowOrigin(renders *atomic.Int32, release chan struct{}) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if renders.Add(1) == 1 {
+			<-release
+		}
+		w.Write([]byte(r.URL.Path))
+		return nil
+	})
+}
+
+func TestCoalesceWaitersGetLeaderEntry(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, CoalesceTimeout: caddy.Duration(5 * time.Second), CacheResponseCodes: []string{"2"}})
+	var renders atomic.Int32
+	release := make(chan struct{})
+	next := slowOrigin(&renders, release)
+
+	var wg sync.WaitGroup
+	states := make([]string, 4)
+	for i := range states {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serveGet(c, next, "/a/")
+			if w.Body.String() != "/a/" {
+				t.Errorf("request %d got %q", i, w.Body.String())
+			}
+			states[i] = w.Header().Get(c.CacheHeaderName)
+		}()
+		if i == 0 {
+			waitFor(t, "the leader to render", func() bool { return renders.Load() == 1 })
+		}
+	}
+	// let the waiters join the flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := renders.Load(); n != 1 {
+		t.Errorf("the miss was rendered %d times, want once", n)
+	}
+	if states[0] != "MISS" {
+		t.Errorf("leader answered %s, want MISS", states[0])
+	}
+	for i, state := range states[1:] {
+		if state != "COALESCED" {
+			t.Errorf("waiter %d answered %s, want COALESCED", i+1, state)
+		}
+	}
+}
+
+func TestCoalesceWaitersTimeOut(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, CoalesceTimeout: caddy.Duration(20 * time.Millisecond), CacheResponseCodes: []string{"2"}})
+	var renders atomic.Int32
+	release := make(chan struct{})
+	next := slowOrigin(&renders, release)
+
+	leader := make(chan struct{})
+	go func() {
+		defer close(leader)
+		serveGet(c, next, "/a/")
+	}()
+	// the leader stores its response before the files are cleaned up
+	defer func() {
+		close(release)
+		<-leader
+	}()
+	waitFor(t, "the leader to render", func() bool { return renders.Load() == 1 })
+
+	start := time.Now()
+	w := serveGet(c, next, "/a/")
+	if w.Header().Get(c.CacheHeaderName) != "MISS" || w.Body.String() != "/a/" {
+		t.Errorf("timed out waiter answered %s %q, want its own render", w.Header().Get(c.CacheHeaderName), w.Body.String())
+	}
+	if n := renders.Load(); n != 2 {
+		t.Errorf("rendered %d times, want the waiter to render after its timeout", n)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waiter held %v past its 20ms timeout", waited)
+	}
+}
+
+func TestWaitFlightClientGone(t *testing.T) {
+	c := &Cache{CoalesceTimeout: caddy.Duration(time.Minute)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if c.waitFlight(ctx, &flight{done: make(chan struct{})}) {
+		t.Error("waitFlight reported the leader done after the client went away")
+	}
+}
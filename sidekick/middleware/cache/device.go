@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// DefaultDeviceRules roughly follows wp_is_mobile(), with tablets split out.
+// Rules are tried in order, the first match wins.
+var DefaultDeviceRules = []DeviceRule{
+	{Class: "tablet", Pattern: `(?i)ipad|tablet|kindle|silk/|playbook`},
+	{Class: "mobile", Pattern: `(?i)mobile|iphone|ipod|android.*mobi|blackberry|bb10|opera mini|opera mobi|iemobile|windows phone|webos`},
+	// android without "mobile" in the user agent is a tablet
+	{Class: "tablet", Pattern: `(?i)android`},
+}
+
+const (
+	// DefaultDeviceHeader carries the device class to PHP unless configured otherwise
+	DefaultDeviceHeader = "X-WPSidekick-Device"
+	// deviceNameHeader tells PHP which header carries the class
+	deviceNameHeader = "X-WPSidekick-Device-Header"
+	// deviceMobileHeader tells PHP whether the class is other than the default, "1" or "0"
+	deviceMobileHeader = "X-WPSidekick-Device-Mobile"
+)
+
+// DeviceRule maps user agents matching Pattern to a device class
+type DeviceRule struct {
+	Class   string
+	Pattern string
+
+	rx *regexp.Regexp
+}
+
+// DeviceDetect classifies the User-Agent into a device class, which becomes
+// part of the cache key and is passed to PHP as a request header.
+type DeviceDetect struct {
+	// Header is the request header carrying the class to PHP
+	Header string
+	// Default is the class when no rule matches
+	Default string
+	Rules   []DeviceRule
+}
+
+// UnmarshalCaddyfile parses a device_detect block:
+//
+//	device_detect {
+//		header X-WPSidekick-Device
+//		default desktop
+//		rule <class> <regex>   # replaces the default rules, tried in order
+//	}
+func (dd *DeviceDetect) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	rulesSet := false
+	return parseBlock(d, func(key string, args []string) error {
+		switch key {
+		case "header":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			dd.Header = args[0]
+
+		case "default":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			dd.Default = args[0]
+
+		case "rule":
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			if !rulesSet {
+				dd.Rules = nil
+				rulesSet = true
+			}
+			pattern := strings.Join(args[1:], " ")
+			if _, err := regexp.Compile(pattern); err != nil {
+				return d.Errf("invalid device rule '%s': %v", pattern, err)
+			}
+			dd.Rules = append(dd.Rules, DeviceRule{Class: args[0], Pattern: pattern})
+
+		default:
+			return d.Errf("unknown device_detect option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Provision fills defaults and compiles the rules
+func (dd *DeviceDetect) Provision() error {
+	if dd.Header == "" {
+		dd.Header = DefaultDeviceHeader
+	}
+	dd.Header = http.CanonicalHeaderKey(dd.Header)
+	if dd.Default == "" {
+		dd.Default = "desktop"
+	}
+	if dd.Rules == nil {
+		dd.Rules = append([]DeviceRule(nil), DefaultDeviceRules...)
+	}
+	for i := range dd.Rules {
+		rx, err := regexp.Compile(dd.Rules[i].Pattern)
+		if err != nil {
+			return err
+		}
+		dd.Rules[i].rx = rx
+	}
+	return nil
+}
+
+// Classify returns the device class of the user agent
+func (dd *DeviceDetect) Classify(ua string) string {
+	for _, rule := range dd.Rules {
+		if rule.rx.MatchString(ua) {
+			return rule.Class
+		}
+	}
+	return dd.Default
+}
+
+// Apply classifies the request and sets the class header, replacing any sent by the client,
+// along with the name of the header and whether wp_is_mobile() holds for PHP
+func (dd *DeviceDetect) Apply(r *http.Request) {
+	class := dd.Classify(r.UserAgent())
+	r.Header.Set(dd.Header, class)
+	r.Header.Set(deviceNameHeader, dd.Header)
+	mobile := "0"
+	if class != dd.Default {
+		mobile = "1"
+	}
+	r.Header.Set(deviceMobileHeader, mobile)
+}
+
+// stripDeviceHeaders drops the class headers a client sent while detection is off,
+// PHP would otherwise render the page for a class the cache key doesn't hold
+func stripDeviceHeaders(r *http.Request) {
+	r.Header.Del(DefaultDeviceHeader)
+	r.Header.Del(deviceNameHeader)
+	r.Header.Del(deviceMobileHeader)
+}
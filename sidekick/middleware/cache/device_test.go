@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeviceDetectApply(t *testing.T) {
+	dd := &DeviceDetect{Header: "X-Device"}
+	if err := dd.Provision(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148")
+	r.Header.Set("X-Device", "desktop")
+	dd.Apply(r)
+
+	if got := r.Header.Get("X-Device"); got != "mobile" {
+		t.Errorf("class header = %q, want mobile", got)
+	}
+	if got := r.Header.Get(deviceNameHeader); got != "X-Device" {
+		t.Errorf("header name passed to PHP = %q, want X-Device", got)
+	}
+	if got := r.Header.Get(deviceMobileHeader); got != "1" {
+		t.Errorf("mobile flag of a phone = %q, want 1", got)
+	}
+}
+
+func TestDeviceDetectMobileFlag(t *testing.T) {
+	// the default class isn't mobile, whatever it is called
+	dd := &DeviceDetect{Default: "wide", Rules: []DeviceRule{{Class: "phone", Pattern: `(?i)iphone`}}}
+	if err := dd.Provision(); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)": "1",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64)":              "0",
+	}
+	for ua, want := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", ua)
+		r.Header.Set(deviceMobileHeader, "1")
+		dd.Apply(r)
+		if got := r.Header.Get(deviceMobileHeader); got != want {
+			t.Errorf("mobile flag of %q = %q, want %s", ua, got, want)
+		}
+	}
+}
+
+func TestStripDeviceHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(DefaultDeviceHeader, "mobile")
+	r.Header.Set(deviceNameHeader, DefaultDeviceHeader)
+	r.Header.Set(deviceMobileHeader, "1")
+	stripDeviceHeaders(r)
+
+	if r.Header.Get(DefaultDeviceHeader) != "" || r.Header.Get(deviceNameHeader) != "" || r.Header.Get(deviceMobileHeader) != "" {
+		t.Errorf("client device headers kept: %v", r.Header)
+	}
+}
@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// purgeBodyMaxSize bounds the JSON body of a batch purge
+const purgeBodyMaxSize = 1 << 20
+
+// servePurge answers a request to the purge path. It reports whether the
+// request was handled, methods other than GET and POST fall through to the site.
+func (c *Cache) servePurge(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "POST" {
+		return false
+	}
+	if err := c.checkClient(r); err != nil {
+		c.logger.Warn("wp cache - purge - refused", zap.String("path", r.URL.Path), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return true
+	}
+
+	// listing takes the read-only keys too, purging only the purge keys
+	keys := c.purgeKeys
+	if r.Method == "GET" {
+		keys = append(slices.Clip(c.listKeys), c.purgeKeys...)
+	}
+	if err := c.verifyPurge(r, keys); err != nil {
+		c.logger.Warn("wp cache - purge - refused", zap.String("path", r.URL.Path), zap.Error(err))
+		if err == ErrPurgeTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+		return true
+	}
+	// a forward of a purge this instance ran already, through a peer URL reaching itself
+	if r.Method == "POST" && r.Header.Get(peerForwardedHeader) == c.instance {
+		w.Header().Set(peerForwardedHeader, c.instance)
+		w.Write([]byte("OK"))
+		return true
+	}
+	if err := c.checkRateLimit(r); err != nil {
+		c.logger.Warn("wp cache - purge - refused", zap.String("path", r.URL.Path), zap.Error(err))
+		w.Header().Set("Retry-After", strconv.Itoa(60/c.PurgeRateLimit+1))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return true
+	}
+
+	db := c.Store
+	switch r.Method {
+	case "GET":
+		cacheList := db.List()
+		json.NewEncoder(w).Encode(cacheList)
+		return true
+
+	case "POST":
+		// sync waits for the purge and reports what it removed
+		sync := c.PurgeSync
+		if query := r.URL.Query(); query.Has("sync") {
+			sync = parseBool(query.Get("sync"))
+		}
+
+		// verifyPurge buffered the body, keep a copy to forward to peers
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		purge, err := c.preparePurge(w, r, strings.Replace(r.URL.Path, c.PurgePath, "", 1), c.siteURL(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+		purge = c.withPeers(purge, r, requestURI(r), r.Host, body)
+
+		if !sync {
+			go purge()
+			w.Write([]byte("OK"))
+			return true
+		}
+		writePurgeResult(w, purge())
+		return true
+	}
+	return false
+}
+
+// preparePurge reads what a purge request asks for and returns the purge to run.
+// A JSON body is a PurgeBatch, otherwise ?tags= or pathToPurge select the entries,
+// ?soft=1 expires them instead and ?mode= picks how pathToPurge matches.
+// Path, tag and batch purges take the related pages of the purge rules along, unless ?related=0.
+// The CDNs are purged the same way, with URLs built on site.
+func (c *Cache) preparePurge(w http.ResponseWriter, r *http.Request, pathToPurge, site string) (func() *PurgeResult, error) {
+	db := c.Store
+	query := r.URL.Query()
+	// soft purge only marks entries expired, stale serving keeps using them
+	soft := parseBool(query.Get("soft"))
+	// mode picks exact, subtree or prefix matching of the purged path
+	modeName := query.Get("mode")
+	if modeName == "" {
+		modeName = c.PurgeMode
+	}
+	mode, err := ParsePurgeMode(modeName)
+	if err != nil {
+		return nil, err
+	}
+	// related opts a purge out of the purge rules
+	related := !query.Has("related") || parseBool(query.Get("related"))
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		// a batch of urls, prefixes, regexes, hosts and tags purged in one pass
+		batch := &PurgeBatch{}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, purgeBodyMaxSize)).Decode(batch)
+		if batch.Mode == "" {
+			batch.Mode = string(mode)
+		}
+		if err == nil {
+			err = db.checkBatch(batch)
+		}
+		if err != nil {
+			c.logger.Warn("wp cache - purge - invalid batch", zap.Error(err))
+			return nil, err
+		}
+		c.logger.Debug("wp cache - purge batch", zap.Any("batch", batch), zap.Bool("soft", soft), zap.Bool("related", related))
+		cdn := cdnPurgeBatch(site, batch)
+		if related && site != "" {
+			cdn.merge(cdnPurgeRelated(site, db.Related(db.batchPaths(batch)...)))
+		}
+		return c.withCDN(func() *PurgeResult {
+			// the batch is checked, so there's no error to handle
+			if soft {
+				res, _ := db.SoftPurgeBatch(batch, related)
+				return res
+			}
+			res, _ := db.PurgeBatch(batch, related)
+			return res
+		}, r, cdn), nil
+	}
+
+	if tags := query.Get("tags"); tags != "" {
+		// purge every entry carrying any of the tags
+		c.logger.Debug("wp cache - purge tags", zap.String("tags", tags), zap.Bool("soft", soft), zap.Bool("related", related))
+		cdn := &CDNPurge{Tags: parseTags(tags)}
+		if related && site != "" {
+			cdn.merge(cdnPurgeRelated(site, db.Related(db.taggedPaths(cdn.Tags)...)))
+		}
+		return c.withCDN(func() *PurgeResult {
+			if soft {
+				return db.SoftPurgeTags(parseTags(tags), related)
+			}
+			return db.PurgeTags(parseTags(tags), related)
+		}, r, cdn), nil
+	}
+
+	c.logger.Debug("wp cache - purge", zap.String("path", pathToPurge), zap.String("mode", string(mode)), zap.Bool("soft", soft), zap.Bool("related", related))
+
+	// the root purges everything, unless only the home page is asked for
+	flush := len(pathToPurge) < 2 && mode != PurgeExact
+	if !flush && !db.cacheKey.Path {
+		return nil, ErrPurgePaths
+	}
+	cdn := cdnPurgePath(site, pathToPurge, mode)
+	if flush {
+		cdn = &CDNPurge{All: true}
+	} else if related && cdn != nil {
+		cdn.merge(cdnPurgeRelated(site, db.Related(pathToPurge)))
+	}
+
+	// responses rendering during the purge are dropped by their generation
+	return c.withCDN(func() *PurgeResult {
+		switch {
+		case flush && soft:
+			return db.SoftFlush()
+		case flush:
+			return db.Flush()
+		case soft:
+			return db.SoftPurge(pathToPurge, mode, related)
+		default:
+			return db.Purge(pathToPurge, mode, related)
+		}
+	}, r, cdn), nil
+}
+
+// writePurgeResult answers with the JSON report, 500 when a file couldn't be purged
+// and 502 when a peer didn't acknowledge
+func writePurgeResult(w http.ResponseWriter, res *PurgeResult) {
+	w.Header().Set("Content-Type", "application/json")
+	if len(res.Errors) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else if slices.ContainsFunc(res.Peers, func(ack PeerAck) bool { return !ack.OK }) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// failingStorage is a memory tier whose purges fail
+type failingStorage struct {
+	*MemoryStorage
+}
+
+func (failingStorage) Purge(prefix string, match func(key string) bool) (int, []PurgeError) {
+	return 0, []PurgeError{{Path: "+a+", Error: "permission denied"}}
+}
+
+// postPurge sends a purge signed with the key "secret" to c
+func postPurge(c *Cache, uri, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", uri, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	r.Header.Set(c.PurgeKeyHeader, SignPurge("secret", "POST", uri, []byte(body), time.Now()))
+	w := httptest.NewRecorder()
+	c.servePurge(w, r)
+	return w
+}
+
+func TestSyncPurgeReport(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, PurgeKey: "secret"})
+	for _, key := range []string{"/a/::", "/a/b/::", "/c/::"} {
+		c.Store.Set(key, c.Store.Generation(), http.Header{}, testMeta(), []byte(key))
+	}
+
+	w := postPurge(c, c.PurgePath+"/a/?sync=1", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("sync purge answered %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	var report map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("report %q: %v", w.Body, err)
+	}
+	if report["mem"] != 2.0 || report["disk"] != 2.0 {
+		t.Errorf("report %v, want mem 2 and disk 2", report)
+	}
+	if _, ok := report["duration_ms"].(float64); !ok {
+		t.Errorf("report %v has no duration_ms", report)
+	}
+	if _, ok := report["errors"]; ok {
+		t.Errorf("report %v lists errors", report)
+	}
+
+	// a batch reports the same way
+	w = postPurge(c, c.PurgePath+"/?sync=1", `{"urls":["/c/"]}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || report["mem"] != 1.0 {
+		t.Errorf("batch report %q, %v", w.Body, err)
+	}
+}
+
+func TestAsyncPurgeAnswersOK(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, PurgeKey: "secret"})
+	if w := postPurge(c, c.PurgePath+"/a/", ""); w.Code != http.StatusOK || w.Body.String() != "OK" {
+		t.Errorf("purge without sync answered %d %q", w.Code, w.Body)
+	}
+}
+
+func TestSyncPurgeErrors(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, PurgeKey: "secret", PurgeSync: true})
+	c.Store = NewStore("", StoreOptions{Tiers: []Storage{failingStorage{NewMemoryStorage(10, 0)}}}, zap.NewNop())
+
+	w := postPurge(c, c.PurgePath+"/a/", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("failed purge answered %d, want 500", w.Code)
+	}
+	var report PurgeResult
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("report %q: %v", w.Body, err)
+	}
+	if len(report.Errors) != 1 || report.Errors[0].Path != "+a+" || report.Errors[0].Error != "permission denied" {
+		t.Errorf("report errors %+v", report.Errors)
+	}
+}
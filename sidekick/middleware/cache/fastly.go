@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(Fastly{})
+}
+
+// Fastly purges a Fastly service. Tags are surrogate keys, Fastly has no
+// prefix purge so a prefix only purges the page at it, tag the pages instead.
+// The cache adds the Surrogate-Key header the keys are matched against.
+type Fastly struct {
+	CDNBase
+	ServiceID string
+	APIToken  string
+	// Soft marks content stale instead of removing it
+	Soft bool
+}
+
+// CaddyModule returns the Caddy module information.
+func (Fastly) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.wp_cache.cdn.fastly",
+		New: func() caddy.Module {
+			return new(Fastly)
+		},
+	}
+}
+
+// UnmarshalCaddyfile parses a fastly block:
+//
+//	cdn fastly {
+//		service_id <id>
+//		api_token <token>
+//		soft
+//		base_url https://api.fastly.com
+//	}
+func (f *Fastly) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // driver name
+	return parseBlock(d, func(key string, args []string) error {
+		if ok, err := f.parseOption(d, key, args); ok {
+			return err
+		}
+		switch key {
+		case "service_id":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			f.ServiceID = args[0]
+
+		case "api_token":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			f.APIToken = args[0]
+
+		case "soft":
+			f.Soft = len(args) == 0 || parseBool(args[0])
+
+		default:
+			return d.Errf("unknown fastly option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Provision fills the credentials from FASTLY_SERVICE_ID and FASTLY_API_TOKEN
+func (f *Fastly) Provision(ctx caddy.Context) error {
+	if f.ServiceID == "" {
+		f.ServiceID = os.Getenv("FASTLY_SERVICE_ID")
+	}
+	if f.APIToken == "" {
+		f.APIToken = os.Getenv("FASTLY_API_TOKEN")
+	}
+	if f.ServiceID == "" || f.APIToken == "" {
+		return errors.New("fastly needs a service_id and an api_token")
+	}
+	// surrogate key purges take up to 256 keys
+	f.provision("fastly", 256, "https://api.fastly.com")
+	f.tags = cdnTagHeader{name: "Surrogate-Key", sep: " "}
+	ctx.Logger(f).Warn("wp cache - cdn - fastly has no prefix purge, subtree and prefix purges only purge the page at the path, tag pages to purge what is below it")
+	return nil
+}
+
+// Purge purges the URLs one by one, the tags as one surrogate key purge and
+// everything with purge_all. Fastly has no prefix purge, a prefix purges the
+// page at it rather than everything.
+func (f *Fastly) Purge(ctx context.Context, p *CDNPurge) error {
+	if p.All {
+		return f.post(ctx, "/service/"+f.ServiceID+"/purge_all", nil)
+	}
+	if len(p.Tags) > 0 {
+		return f.post(ctx, "/service/"+f.ServiceID+"/purge", http.Header{
+			"Surrogate-Key": {strings.Join(p.Tags, " ")},
+		})
+	}
+	for _, u := range append(slices.Clip(p.URLs), p.Prefixes...) {
+		_, hostPath, _ := strings.Cut(u, "://")
+		if err := f.post(ctx, "/purge/"+hostPath, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Fastly) post(ctx context.Context, apiPath string, hdr http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", f.BaseURL+apiPath, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range hdr {
+		req.Header[name] = values
+	}
+	req.Header.Set("Fastly-Key", f.APIToken)
+	req.Header.Set("Accept", "application/json")
+	if f.Soft {
+		req.Header.Set("Fastly-Soft-Purge", "1")
+	}
+	_, err = f.do(req)
+	return err
+}
+
+// Interface guards
+var (
+	_ CDNDriver             = (*Fastly)(nil)
+	_ caddy.Provisioner     = (*Fastly)(nil)
+	_ caddyfile.Unmarshaler = (*Fastly)(nil)
+)
@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(FileStorage{})
+}
+
+const (
+	CACHE_DIR = "sidekick-cache"
+)
+
+// FileStorage keeps entries on disk under Path/sidekick-cache, one directory
+// per flattened key holding .meta, .vary and a file per content encoding
+type FileStorage struct {
+	// Path is the cache location, CACHE_LOC by default
+	Path string
+}
+
+// NewFileStorage returns a provisioned file tier
+func NewFileStorage(loc string) *FileStorage {
+	f := &FileStorage{Path: loc}
+	f.Provision(caddy.Context{})
+	return f
+}
+
+// CaddyModule returns the Caddy module information.
+func (FileStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.wp_cache.storage.file",
+		New: func() caddy.Module {
+			return new(FileStorage)
+		},
+	}
+}
+
+// UnmarshalCaddyfile parses a file block:
+//
+//	storage file {
+//		path /var/www/html/wp-content/cache
+//	}
+func (f *FileStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // backend name
+	return parseBlock(d, func(key string, args []string) error {
+		switch key {
+		case "path":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			f.Path = args[0]
+
+		default:
+			return d.Errf("unknown file storage option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Provision creates the cache directory
+func (f *FileStorage) Provision(ctx caddy.Context) error {
+	if f.Path == "" {
+		f.Path = os.Getenv("CACHE_LOC")
+	}
+	return os.MkdirAll(path.Join(f.Path, CACHE_DIR), 0o755)
+}
+
+func (f *FileStorage) dir(key string) string {
+	return path.Join(f.Path, CACHE_DIR, key)
+}
+
+func (f *FileStorage) Get(key, ce string) (*CacheMeta, []byte, error) {
+	meta := &CacheMeta{}
+	if err := meta.LoadFromFile(path.Join(f.dir(key), ".meta")); err != nil {
+		return nil, nil, notFound(err)
+	}
+	value, err := os.ReadFile(path.Join(f.dir(key), "."+ce))
+	if err != nil {
+		return nil, nil, notFound(err)
+	}
+	return meta, value, nil
+}
+
+// Set replaces the files by rename, so a refresh never exposes a half written entry.
+// The key keeps one .meta, the bodies of other encodings of an earlier render are removed.
+func (f *FileStorage) Set(key, ce string, meta *CacheMeta, value []byte) error {
+	basePath := f.dir(key)
+	os.MkdirAll(basePath, 0o755)
+	if old, err := f.Meta(key); err == nil && meta.replaces(old) {
+		for _, other := range CachedContentEncoding {
+			if other != ce {
+				os.Remove(path.Join(basePath, "."+other))
+			}
+		}
+	}
+	if err := writeFileAtomic(path.Join(basePath, "."+ce), value); err != nil {
+		return err
+	}
+	return meta.WriteToFile(path.Join(basePath, ".meta"))
+}
+
+func (f *FileStorage) Meta(key string) (*CacheMeta, error) {
+	meta := &CacheMeta{}
+	if err := meta.LoadFromFile(path.Join(f.dir(key), ".meta")); err != nil {
+		// also the base directory of a varied key, entries are in the variant directories
+		return nil, notFound(err)
+	}
+	return meta, nil
+}
+
+// Expire rewrites the meta file, the store holds off writes meanwhile
+func (f *FileStorage) Expire(key string, expires int64) (int, error) {
+	fp := path.Join(f.dir(key), ".meta")
+	meta := &CacheMeta{}
+	if err := meta.LoadFromFile(fp); err != nil {
+		return 0, notFound(err)
+	}
+	meta.softExpire(expires)
+	if err := meta.WriteToFile(fp); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// Delete counts one per directory
+func (f *FileStorage) Delete(key string) (int, error) {
+	fp := f.dir(key)
+	if _, err := os.Stat(fp); err != nil {
+		return 0, nil
+	}
+	if err := os.RemoveAll(fp); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (f *FileStorage) Purge(prefix string, match func(key string) bool) (int, []PurgeError) {
+	basePath := path.Join(f.Path, CACHE_DIR)
+	files, err := os.ReadDir(basePath)
+	if err != nil {
+		return 0, []PurgeError{{Path: basePath, Error: err.Error()}}
+	}
+	n := 0
+	var errs []PurgeError
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), prefix) || !match(file.Name()) {
+			continue
+		}
+		fp := path.Join(basePath, file.Name())
+		if err := os.RemoveAll(fp); err != nil {
+			errs = append(errs, PurgeError{Path: fp, Error: err.Error()})
+			continue
+		}
+		n++
+	}
+	return n, errs
+}
+
+func (f *FileStorage) Flush() (int, error) {
+	basePath := path.Join(f.Path, CACHE_DIR)
+	files, err := os.ReadDir(basePath)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	var errs []error
+	for _, file := range files {
+		if err := os.RemoveAll(path.Join(basePath, file.Name())); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		n++
+	}
+	return n, errors.Join(errs...)
+}
+
+// List leaves out the base directories of varied keys, they hold no encodings
+func (f *FileStorage) List() (map[string][]string, error) {
+	basePath := path.Join(f.Path, CACHE_DIR)
+	files, err := os.ReadDir(basePath)
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string][]string)
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		fp := path.Join(basePath, file.Name())
+		for _, ce := range CachedContentEncoding {
+			if _, err := os.Stat(path.Join(fp, "."+ce)); err == nil {
+				list[file.Name()] = append(list[file.Name()], ce)
+			}
+		}
+	}
+	return list, nil
+}
+
+// Vary reads the .vary file of the key, a key cached without one varies on nothing
+func (f *FileStorage) Vary(key string) ([]string, error) {
+	basePath := f.dir(key)
+	fields := []string{}
+	buf, err := os.ReadFile(path.Join(basePath, ".vary"))
+	if err == nil {
+		json.Unmarshal(buf, &fields)
+	} else if _, err := os.Stat(basePath); err != nil {
+		return nil, ErrCacheNotFound
+	}
+	return fields, nil
+}
+
+func (f *FileStorage) SetVary(key string, fields []string) error {
+	basePath := f.dir(key)
+	os.MkdirAll(basePath, 0o755)
+	buf, _ := json.Marshal(fields)
+	return writeFileAtomic(path.Join(basePath, ".vary"), buf)
+}
+
+// notFound turns a missing file into ErrCacheNotFound
+func notFound(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrCacheNotFound
+	}
+	return err
+}
+
+// writeFileAtomic writes to a temporary file next to fp and renames it into place
+func writeFileAtomic(fp string, data []byte) error {
+	fd, err := os.CreateTemp(path.Dir(fp), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(fd.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), fp)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
+
+// Interface guards
+var (
+	_ Storage               = (*FileStorage)(nil)
+	_ caddy.Provisioner     = (*FileStorage)(nil)
+	_ caddyfile.Unmarshaler = (*FileStorage)(nil)
+)
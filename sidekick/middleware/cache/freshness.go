@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Freshness is what the origin response headers say about caching it
+type Freshness struct {
+	// Cacheable is false on no-store, private or no-cache
+	Cacheable bool
+	// Explicit is true when the origin gave a lifetime, TTL is then valid
+	Explicit bool
+	TTL      int64
+}
+
+// parseDirectives splits a Cache-Control style header into lower-cased directives
+func parseDirectives(values []string) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			directives[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return directives
+}
+
+// maxAge returns the seconds of a max-age style directive
+func maxAge(directives map[string]string, name string) (int64, bool) {
+	arg, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return n, true
+}
+
+// OriginFreshness reads Surrogate-Control, Cache-Control and Expires, in that order of precedence.
+// Surrogate-Control is meant for caches like this one, so it overrides Cache-Control.
+func OriginFreshness(hdr http.Header, now time.Time) Freshness {
+	f := Freshness{Cacheable: true}
+
+	if sc := hdr.Values("Surrogate-Control"); len(sc) > 0 {
+		directives := parseDirectives(sc)
+		if _, ok := directives["no-store"]; ok {
+			f.Cacheable = false
+			return f
+		}
+		if ttl, ok := maxAge(directives, "max-age"); ok {
+			f.Explicit, f.TTL = true, ttl
+			return f.age(hdr)
+		}
+	}
+
+	directives := parseDirectives(hdr.Values("Cache-Control"))
+	for _, name := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := directives[name]; ok {
+			f.Cacheable = false
+			return f
+		}
+	}
+
+	// s-maxage is for shared caches and wins over max-age
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if ttl, ok := maxAge(directives, name); ok {
+			f.Explicit, f.TTL = true, ttl
+			return f.age(hdr)
+		}
+	}
+
+	if expires := hdr.Get("Expires"); expires != "" {
+		f.Explicit = true
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// invalid dates like "0" mean already expired
+			return f
+		}
+		// measure against the origin clock when it sent one
+		if date, err := http.ParseTime(hdr.Get("Date")); err == nil {
+			now = date
+		}
+		if d := t.Sub(now); d > 0 {
+			f.TTL = int64(d / time.Second)
+		}
+	}
+
+	return f
+}
+
+// age takes off the time the response already spent in an upstream cache
+func (f Freshness) age(hdr http.Header) Freshness {
+	if age, err := strconv.ParseInt(hdr.Get("Age"), 10, 64); err == nil && age > 0 {
+		f.TTL = max(f.TTL-age, 0)
+	}
+	return f
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestOriginFreshness(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	date := func(d time.Duration) string {
+		return now.Add(d).Format(http.TimeFormat)
+	}
+
+	tests := []struct {
+		name string
+		hdr  http.Header
+		want Freshness
+	}{
+		{"no headers", http.Header{}, Freshness{Cacheable: true}},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, Freshness{}},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, Freshness{}},
+		{"no-cache", http.Header{"Cache-Control": {"No-Cache"}}, Freshness{}},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, Freshness{true, true, 60}},
+		{"s-maxage over max-age", http.Header{"Cache-Control": {"max-age=60, s-maxage=300"}}, Freshness{true, true, 300}},
+		{"max-age 0", http.Header{"Cache-Control": {"max-age=0"}}, Freshness{true, true, 0}},
+		{"age", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, Freshness{true, true, 40}},
+		{"age past max-age", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"90"}}, Freshness{true, true, 0}},
+		{"expires", http.Header{"Expires": {date(2 * time.Minute)}}, Freshness{true, true, 120}},
+		{"expires against date", http.Header{"Expires": {date(2 * time.Minute)}, "Date": {date(time.Minute)}}, Freshness{true, true, 60}},
+		{"expires in the past", http.Header{"Expires": {date(-time.Minute)}}, Freshness{true, true, 0}},
+		{"invalid expires", http.Header{"Expires": {"0"}}, Freshness{true, true, 0}},
+		{"max-age over expires", http.Header{"Cache-Control": {"max-age=60"}, "Expires": {date(time.Hour)}}, Freshness{true, true, 60}},
+		{"surrogate-control over cache-control", http.Header{"Surrogate-Control": {"max-age=600"}, "Cache-Control": {"private"}}, Freshness{true, true, 600}},
+		{"surrogate-control no-store", http.Header{"Surrogate-Control": {"no-store"}, "Cache-Control": {"max-age=60"}}, Freshness{}},
+		{"surrogate-control without max-age", http.Header{"Surrogate-Control": {"content=\"ESI/1.0\""}, "Cache-Control": {"max-age=60"}}, Freshness{true, true, 60}},
+	}
+	for _, tt := range tests {
+		if got := OriginFreshness(tt.hdr, now); got != tt.want {
+			t.Errorf("%s: OriginFreshness = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTrustOrigin(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 3600, TrustOrigin: true, CacheResponseCodes: []string{"2"}})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.URL.Path == "/private/" {
+			w.Header().Set("Cache-Control", "private")
+		} else {
+			w.Header().Set("Surrogate-Control", "max-age=30")
+		}
+		w.Write([]byte(r.URL.Path))
+		return nil
+	})
+
+	if w := serveGet(c, next, "/private/"); w.Header().Get(c.CacheHeaderName) != "BYPASS" {
+		t.Errorf("private response: %s, want BYPASS", w.Header().Get(c.CacheHeaderName))
+	}
+	if _, _, err := c.Store.Get("/private/::", http.Header{}, "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("private response was stored: %v", err)
+	}
+
+	w := serveGet(c, next, "/a/")
+	if w.Header().Get("Surrogate-Control") != "" {
+		t.Error("Surrogate-Control passed on to the client")
+	}
+	_, meta, err := c.Store.Get("/a/::", http.Header{}, "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := meta.Expires - time.Now().Unix(); ttl < 28 || ttl > 30 {
+		t.Errorf("entry expires in %ds, want the 30s of Surrogate-Control over the TTL", ttl)
+	}
+}
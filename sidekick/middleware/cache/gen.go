@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"slices"
+)
+
+// purgeLogSize bounds the purges remembered for in-flight writes,
+// a write older than the log is dropped as it can't be checked
+const purgeLogSize = 4096
+
+// purgeRecord is a purge or flush that ran at generation gen
+type purgeRecord struct {
+	gen   uint64
+	match func(key string, meta *CacheMeta) bool
+}
+
+// Generation returns the current purge generation of the store. A write
+// records it when the request starts and Set drops the write if a purge
+// covering the key ran since.
+func (d *Store) Generation() uint64 {
+	d.genMu.RLock()
+	defer d.genMu.RUnlock()
+	return d.gen
+}
+
+// recordPurge starts a new generation for a purge matching flattened keys.
+// Sets in progress finish before it, so the purge that follows sees their entries.
+func (d *Store) recordPurge(match func(key string, meta *CacheMeta) bool) {
+	d.genMu.Lock()
+	defer d.genMu.Unlock()
+
+	d.gen++
+	d.purgeLog = append(d.purgeLog, purgeRecord{gen: d.gen, match: match})
+	if len(d.purgeLog) > purgeLogSize {
+		drop := len(d.purgeLog) - purgeLogSize
+		d.purgeFloor = d.purgeLog[drop-1].gen
+		d.purgeLog = slices.Delete(d.purgeLog, 0, drop)
+	}
+}
+
+// purgedSince reports whether a purge covering the entry ran after generation gen,
+// the caller holds genMu
+func (d *Store) purgedSince(key string, meta *CacheMeta, gen uint64) bool {
+	if gen < d.purgeFloor {
+		return true
+	}
+	// the log is ordered, walk back until the writer's generation
+	for i := len(d.purgeLog) - 1; i >= 0 && d.purgeLog[i].gen > gen; i-- {
+		if d.purgeLog[i].match(key, meta) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchKeys matches flattened keys with match, whatever the entry
+func matchKeys(match func(key string) bool) func(string, *CacheMeta) bool {
+	return func(key string, _ *CacheMeta) bool {
+		return match(key)
+	}
+}
+
+// matchAll matches every key, for flushes
+func matchAll(string, *CacheMeta) bool {
+	return true
+}
+
+// matchTags matches entries carrying any of the tags
+func matchTags(tags []string) func(string, *CacheMeta) bool {
+	return func(_ string, meta *CacheMeta) bool {
+		for _, tag := range meta.Tags {
+			if slices.Contains(tags, tag) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// keyExtrasMaxLen bounds the readable part of a key appended after the path,
+// longer extras are hashed so the disk directory name stays within limits.
+// The host stays readable in front of the hash, batch purges match it.
+const keyExtrasMaxLen = 128
+
+// CacheKey selects which parts of a request make up its cache key.
+// The request path always comes first so prefix purging keeps working.
+type CacheKey struct {
+	Path     bool
+	Host     bool
+	Scheme   bool
+	QueryAll bool
+	Query    []string
+	Headers  []string
+	Cookies  []string
+
+	normalize *QueryNormalize
+	// request header holding the device class, when detection is on
+	deviceHeader string
+}
+
+// DefaultCacheKey keys entries by request path only
+func DefaultCacheKey() *CacheKey {
+	return &CacheKey{Path: true}
+}
+
+// UnmarshalCaddyfile parses a cache_key block:
+//
+//	cache_key {
+//		path [on|off]
+//		host
+//		scheme
+//		query * | <name>[,<name>...]
+//		header <name>[,<name>...]
+//		cookie <name>[,<name>...]
+//	}
+func (k *CacheKey) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	k.Path = true
+	return parseBlock(d, func(key string, args []string) error {
+		switch key {
+		case "path":
+			k.Path = len(args) == 0 || parseBool(args[0])
+
+		case "host":
+			k.Host = len(args) == 0 || parseBool(args[0])
+
+		case "scheme":
+			k.Scheme = len(args) == 0 || parseBool(args[0])
+
+		case "query":
+			names := splitList(args)
+			if slices.Contains(names, "*") {
+				k.QueryAll = true
+				k.Query = nil
+			} else {
+				k.Query = append(k.Query, names...)
+			}
+
+		case "header":
+			for _, name := range splitList(args) {
+				k.Headers = append(k.Headers, http.CanonicalHeaderKey(name))
+			}
+
+		case "cookie":
+			k.Cookies = append(k.Cookies, splitList(args)...)
+
+		default:
+			return d.Errf("unknown cache_key option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Build returns the cache key for the request, in the form
+// "<path>::<extras>" where extras holds the other selected parts.
+func (k *CacheKey) Build(r *http.Request) string {
+	reqPath := ""
+	if k.Path {
+		reqPath = r.URL.Path
+	}
+
+	extras := make([]string, 0, 4)
+	if k.Scheme {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		extras = append(extras, "scheme="+scheme)
+	}
+
+	if k.Host {
+		extras = append(extras, "host="+url.QueryEscape(strings.ToLower(r.Host)))
+	}
+
+	if k.QueryAll || len(k.Query) > 0 {
+		query := k.normalize.Normalize(r.URL.Query())
+		if !k.QueryAll {
+			for name := range query {
+				if !slices.Contains(k.Query, name) {
+					delete(query, name)
+				}
+			}
+		}
+		if len(query) > 0 {
+			// url.Values.Encode sorts by key, so parameter order doesn't matter
+			extras = append(extras, "q="+url.QueryEscape(query.Encode()))
+		}
+	}
+
+	if k.deviceHeader != "" {
+		extras = append(extras, "device="+url.QueryEscape(r.Header.Get(k.deviceHeader)))
+	}
+
+	for _, name := range k.Headers {
+		if v := r.Header.Get(name); v != "" {
+			extras = append(extras, "h."+name+"="+url.QueryEscape(v))
+		}
+	}
+
+	for _, name := range k.Cookies {
+		if c, err := r.Cookie(name); err == nil {
+			extras = append(extras, "c."+name+"="+url.QueryEscape(c.Value))
+		}
+	}
+
+	extra := strings.Join(extras, "&")
+	if len(extra) > keyExtrasMaxLen {
+		hashed := extras
+		host := ""
+		if k.Host {
+			i := slices.IndexFunc(extras, func(e string) bool { return strings.HasPrefix(e, "host=") })
+			host = extras[i] + "&"
+			hashed = slices.Delete(slices.Clone(extras), i, i+1)
+		}
+		hash := sha256.Sum256([]byte(strings.Join(hashed, "&")))
+		extra = fmt.Sprintf("%s%x", host, hash[:16])
+	}
+
+	return reqPath + "::" + extra
+}
+
+// parseBlock walks a nested block opened after the current token,
+// calling fn with every subdirective and its arguments. A missing block keeps the defaults.
+func parseBlock(d *caddyfile.Dispenser, fn func(key string, args []string) error) error {
+	if !d.Next() {
+		return nil
+	}
+	if d.Val() != "{" {
+		d.Prev()
+		return nil
+	}
+	for d.Next() {
+		key := d.Val()
+		if key == "}" {
+			return nil
+		}
+		if err := fn(key, d.RemainingArgs()); err != nil {
+			return err
+		}
+	}
+	return d.EOFErr()
+}
+
+// splitList flattens arguments given either space or comma separated
+func splitList(args []string) []string {
+	list := make([]string, 0, len(args))
+	for _, arg := range args {
+		for _, v := range strings.Split(arg, ",") {
+			v = strings.TrimSpace(v)
+			if v != "" {
+				list = append(list, v)
+			}
+		}
+	}
+	return list
+}
+
+func parseBool(v string) bool {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "true", "on", "yes", "1":
+		return true
+	}
+	return false
+}
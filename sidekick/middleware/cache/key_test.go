@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCacheKeyBuild(t *testing.T) {
+	tests := []struct {
+		name string
+		key  *CacheKey
+		url  string
+		want string
+	}{
+		{"default", DefaultCacheKey(), "/blog/?b=2", "/blog/::"},
+		{"path off", &CacheKey{Host: true}, "http://example.com/blog/", "::host=example.com"},
+		{"host and scheme", &CacheKey{Path: true, Host: true, Scheme: true}, "https://Example.com/a/", "/a/::scheme=https&host=example.com"},
+		{"named query", &CacheKey{Path: true, Query: []string{"page"}}, "/a/?x=1&page=2", "/a/::q=page%3D2"},
+		{"named query missing", &CacheKey{Path: true, Query: []string{"page"}}, "/a/?x=1", "/a/::"},
+		{"all queries sorted", &CacheKey{Path: true, QueryAll: true}, "/a/?b=2&a=1", "/a/::q=a%3D1%26b%3D2"},
+		{"header", &CacheKey{Path: true, Headers: []string{"Accept-Language"}}, "/a/", "/a/::h.Accept-Language=de"},
+		{"cookie", &CacheKey{Path: true, Cookies: []string{"currency"}}, "/a/", "/a/::c.currency=EUR"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.Header.Set("Accept-Language", "de")
+		r.Header.Set("Cookie", "currency=EUR; session=1")
+		if got := tt.key.Build(r); got != tt.want {
+			t.Errorf("%s: Build = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCacheKeyFoldCaseQuery(t *testing.T) {
+	c := newTestCache(t, &Cache{
+		CacheKey:       &CacheKey{Path: true, Query: []string{"Page"}},
+		QueryNormalize: &QueryNormalize{FoldCase: true},
+	})
+	if got := c.CacheKey.Build(httptest.NewRequest("GET", "/a/?PAGE=2&x=1", nil)); got != "/a/::q=page%3D2" {
+		t.Errorf("Build = %q, want the page parameter keyed", got)
+	}
+}
+
+func TestCacheKeyHashesLongExtras(t *testing.T) {
+	k := &CacheKey{Path: true, Headers: []string{"X-Long"}}
+	build := func(v string) string {
+		r := httptest.NewRequest("GET", "/a/", nil)
+		r.Header.Set("X-Long", v)
+		return k.Build(r)
+	}
+
+	a, b := build(strings.Repeat("a", 200)), build(strings.Repeat("b", 200))
+	extra := strings.TrimPrefix(a, "/a/::")
+	if len(extra) != 32 || strings.Contains(extra, "=") {
+		t.Errorf("long extras kept readable: %q", a)
+	}
+	if a == b {
+		t.Errorf("different long extras hashed to one key %q", a)
+	}
+	if a != build(strings.Repeat("a", 200)) {
+		t.Error("the same extras hashed to different keys")
+	}
+
+	// the host stays readable for batch purges by host
+	k.Host = true
+	hosted := build(strings.Repeat("a", 200))
+	extra, ok := strings.CutPrefix(hosted, "/a/::host=example.com&")
+	if !ok || len(extra) != 32 || strings.Contains(extra, "=") {
+		t.Errorf("long extras with a host keyed %q", hosted)
+	}
+}
+
+func TestCacheKeyUnmarshalCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`cache_key {
+		host
+		query page, s
+		header accept-language
+		cookie currency
+	}`)
+	d.Next()
+	k := DefaultCacheKey()
+	if err := k.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if !k.Path || !k.Host || k.Scheme || k.QueryAll {
+		t.Errorf("parsed %+v", k)
+	}
+	if strings.Join(k.Query, ",") != "page,s" || strings.Join(k.Headers, ",") != "Accept-Language" || strings.Join(k.Cookies, ",") != "currency" {
+		t.Errorf("parsed lists %v %v %v", k.Query, k.Headers, k.Cookies)
+	}
+}
+
+func TestCacheKeyPathOff(t *testing.T) {
+	pathOff := func() *CacheKey { return &CacheKey{Host: true} }
+	refused := []*Cache{
+		{CacheKey: pathOff(), PurgeRules: []PurgeRule{{PathPrefix: "/blog/", Also: []string{"/"}}}},
+		{CacheKey: pathOff(), TTLRules: []TTLRule{{PathPrefix: "/shop/", TTL: 60}}},
+	}
+	for _, c := range refused {
+		c.Loc = t.TempDir()
+		if err := c.Provision(caddy.Context{}); err == nil {
+			c.Cleanup()
+			t.Errorf("provisioned path rules without the path in the key: %+v %+v", c.PurgeRules, c.TTLRules)
+		}
+	}
+
+	c := newTestCache(t, &Cache{TTL: 60, PurgeKey: "secret", CacheKey: pathOff(), TTLRules: []TTLRule{{Status: []string{"404"}, TTL: 60}}})
+	for _, p := range []struct{ uri, body string }{
+		{c.PurgePath + "/blog/", ""},
+		{c.PurgePath + "/?mode=exact", ""},
+		{c.PurgePath + "/", `{"urls":["/blog/"]}`},
+		{c.PurgePath + "/", `{"prefixes":["/blog"]}`},
+	} {
+		if w := postPurge(c, p.uri, p.body); w.Code != http.StatusBadRequest {
+			t.Errorf("purge %s %s answered %d, want 400", p.uri, p.body, w.Code)
+		}
+	}
+	for _, uri := range []string{c.PurgePath + "/", c.PurgePath + "/?tags=post-1"} {
+		if w := postPurge(c, uri, ""); w.Code != http.StatusOK {
+			t.Errorf("purge %s answered %d: %s", uri, w.Code, w.Body)
+		}
+	}
+}
@@ -14,6 +14,8 @@ type LRUCache[K comparable, V any] struct {
 	ll          *list.List
 	cache       map[K]*list.Element
 	currentCost int64
+	// onEvict is called with the entries evicted to make room, under the lock
+	onEvict func(key K, value V)
 
 	// TODO: use concurrent map?
 	// cache *xsync.MapOf[K, *list.Element]
@@ -112,13 +114,16 @@ func (c *LRUCache[K, V]) put(key K, value V, cost int) bool {
 	return false
 }
 
-func (c *LRUCache[K, V]) Delete(key K) {
+// Delete removes the key, returning whether it was present
+func (c *LRUCache[K, V]) Delete(key K) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if elem, ok := c.cache[key]; ok {
 		c.removeElement(elem)
+		return true
 	}
+	return false
 }
 
 func (c *LRUCache[K, V]) removeElement(e *list.Element) {
@@ -136,6 +141,7 @@ func (c *LRUCache[K, V]) evictByCount() {
 	for c.ll.Len() >= c.capacityCount {
 		elem := c.ll.Back()
 		c.removeElement(elem)
+		c.evicted(elem)
 	}
 }
 
@@ -147,6 +153,14 @@ func (c *LRUCache[K, V]) evictByCost() {
 	for c.currentCost > int64(c.capacityCost) {
 		elem := c.ll.Back()
 		c.removeElement(elem)
+		c.evicted(elem)
+	}
+}
+
+func (c *LRUCache[K, V]) evicted(e *list.Element) {
+	if c.onEvict != nil {
+		ent := e.Value.(*entry[K, V])
+		c.onEvict(ent.key, *ent.value)
 	}
 }
 
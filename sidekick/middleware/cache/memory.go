@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(MemoryStorage{})
+}
+
+// MemoryStorage keeps entries in an in-process LRU, bounded by count and by size
+type MemoryStorage struct {
+	MaxSize  int
+	MaxCount int
+
+	cache atomic.Value // *LRUCache[string, *MemCacheItem]
+	// onEvict is told about entries evicted to make room
+	onEvict func(key string, meta *CacheMeta)
+}
+
+type MemCacheItem struct {
+	*CacheMeta
+	value []byte
+}
+
+// NewMemoryStorage returns a provisioned memory tier
+func NewMemoryStorage(maxCount, maxSize int) *MemoryStorage {
+	m := &MemoryStorage{MaxSize: maxSize, MaxCount: maxCount}
+	m.Provision(caddy.Context{})
+	return m
+}
+
+// CaddyModule returns the Caddy module information.
+func (MemoryStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.wp_cache.storage.memory",
+		New: func() caddy.Module {
+			return new(MemoryStorage)
+		},
+	}
+}
+
+// UnmarshalCaddyfile parses a memory block:
+//
+//	storage memory {
+//		max_size 134217728
+//		max_count 32768
+//	}
+func (m *MemoryStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // backend name
+	return parseBlock(d, func(key string, args []string) error {
+		switch key {
+		case "max_size", "max_count":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("invalid %s '%s'", key, args[0])
+			}
+			if key == "max_size" {
+				m.MaxSize = n
+			} else {
+				m.MaxCount = n
+			}
+
+		default:
+			return d.Errf("unknown memory storage option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Provision fills the default limits, 128MB and 32K entries
+func (m *MemoryStorage) Provision(ctx caddy.Context) error {
+	if m.MaxSize == 0 {
+		m.MaxSize = 128 * 1024 * 1024
+	}
+	if m.MaxCount == 0 {
+		m.MaxCount = 32 * 1024
+	}
+	m.cache.Store(m.newCache())
+	return nil
+}
+
+func (m *MemoryStorage) newCache() *LRUCache[string, *MemCacheItem] {
+	cache := NewLRUCache[string, *MemCacheItem](m.MaxCount, m.MaxSize)
+	if fn := m.onEvict; fn != nil {
+		cache.onEvict = func(k string, item *MemCacheItem) {
+			key, _ := splitMemKey(k)
+			// out of the cache lock, fn may look at the tiers
+			go fn(key, item.CacheMeta)
+		}
+	}
+	return cache
+}
+
+// OnEvict sets fn to be called with the key and meta of every entry evicted
+// to make room, it is set up before the storage is used
+func (m *MemoryStorage) OnEvict(fn func(key string, meta *CacheMeta)) {
+	m.onEvict = fn
+	m.cache.Store(m.newCache())
+}
+
+func (m *MemoryStorage) getCache() *LRUCache[string, *MemCacheItem] {
+	return m.cache.Load().(*LRUCache[string, *MemCacheItem])
+}
+
+// Size returns how many entries are held, one per key and content encoding
+func (m *MemoryStorage) Size() int {
+	return m.getCache().Size()
+}
+
+// Cost returns the bytes held
+func (m *MemoryStorage) Cost() int {
+	return m.getCache().Cost()
+}
+
+// Get returns the entry, the meta is shared with other readers and must not be changed
+func (m *MemoryStorage) Get(key, ce string) (*CacheMeta, []byte, error) {
+	item, ok := m.getCache().Get(key + "::" + ce)
+	if !ok {
+		return nil, nil, ErrCacheNotFound
+	}
+	return (*item).CacheMeta, (*item).value, nil
+}
+
+// Set drops the items of other encodings of an earlier render
+func (m *MemoryStorage) Set(key, ce string, meta *CacheMeta, value []byte) error {
+	cache := m.getCache()
+	for _, other := range CachedContentEncoding {
+		if other == ce {
+			continue
+		}
+		if item, ok := cache.Peek(key + "::" + other); ok && meta.replaces((*item).CacheMeta) {
+			cache.Delete(key + "::" + other)
+		}
+	}
+	cache.Put(key+"::"+ce, &MemCacheItem{
+		CacheMeta: meta,
+		value:     value,
+	}, len(value)) // TODO: add header size
+	return nil
+}
+
+func (m *MemoryStorage) Meta(key string) (*CacheMeta, error) {
+	var newest *CacheMeta
+	cache := m.getCache()
+	for _, ce := range CachedContentEncoding {
+		item, ok := cache.Peek(key + "::" + ce)
+		if ok && (newest == nil || (*item).Timestamp > newest.Timestamp) {
+			newest = (*item).CacheMeta
+		}
+	}
+	if newest == nil {
+		return nil, ErrCacheNotFound
+	}
+	return newest, nil
+}
+
+// Expire swaps in copies of the items, they are shared with readers so the meta isn't touched
+func (m *MemoryStorage) Expire(key string, expires int64) (int, error) {
+	n := 0
+	cache := m.getCache()
+	for _, ce := range CachedContentEncoding {
+		item, ok := cache.Peek(key + "::" + ce)
+		if !ok {
+			continue
+		}
+		meta := (*item).CacheMeta.clone()
+		meta.softExpire(expires)
+		cache.Put(key+"::"+ce, &MemCacheItem{
+			CacheMeta: meta,
+			value:     (*item).value,
+		}, len((*item).value))
+		n++
+	}
+	return n, nil
+}
+
+// Delete counts one per content encoding
+func (m *MemoryStorage) Delete(key string) (int, error) {
+	n := 0
+	cache := m.getCache()
+	for _, ce := range CachedContentEncoding {
+		if cache.Delete(key + "::" + ce) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemoryStorage) Purge(prefix string, match func(key string) bool) (int, []PurgeError) {
+	cache := m.getCache()
+	rmKeys := make([]string, 0, 4)
+	cache.Range(func(k string, _ *MemCacheItem) bool {
+		if !strings.HasPrefix(k, prefix) {
+			return true
+		}
+		if key, _ := splitMemKey(k); match(key) {
+			rmKeys = append(rmKeys, k)
+		}
+		return true
+	})
+	n := 0
+	for _, k := range rmKeys {
+		if cache.Delete(k) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemoryStorage) Flush() (int, error) {
+	n := m.Size()
+	m.cache.Store(m.newCache())
+	return n, nil
+}
+
+func (m *MemoryStorage) List() (map[string][]string, error) {
+	list := make(map[string][]string)
+	m.getCache().Range(func(k string, _ *MemCacheItem) bool {
+		key, ce := splitMemKey(k)
+		list[key] = append(list[key], ce)
+		return true
+	})
+	return list, nil
+}
+
+// rangeItems calls fn with every item, by flattened key and content encoding
+func (m *MemoryStorage) rangeItems(fn func(key, ce string, item *MemCacheItem) bool) {
+	m.getCache().Range(func(k string, item *MemCacheItem) bool {
+		key, ce := splitMemKey(k)
+		return fn(key, ce, item)
+	})
+}
+
+// Vary isn't kept in memory, the store remembers it
+func (m *MemoryStorage) Vary(key string) ([]string, error) {
+	return nil, ErrCacheNotFound
+}
+
+func (m *MemoryStorage) SetVary(key string, fields []string) error {
+	return nil
+}
+
+// Interface guards
+var (
+	_ Storage               = (*MemoryStorage)(nil)
+	_ caddy.Provisioner     = (*MemoryStorage)(nil)
+	_ caddyfile.Unmarshaler = (*MemoryStorage)(nil)
+)
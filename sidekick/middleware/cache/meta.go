@@ -44,8 +44,10 @@ var (
 		"Server",
 		"X-Powered-By",
 
-		// TODO:
+		// replayed on hit, entries are stored per variant
 		"Vary",
+
+		// TODO:
 		"Link",
 		"Expires",
 		"Age",
@@ -87,6 +89,14 @@ type CacheMeta struct {
 	StateCode int        `json:"c,omitempty"`
 	Header    [][]string `json:"h,omitempty"`
 	Timestamp int64      `json:"t,omitempty"`
+	// unix nanoseconds of the render, orders renders within the same second
+	Rendered int64 `json:"n,omitempty"`
+	// unix time the entry expires, 0 falls back to the store TTL
+	Expires int64 `json:"e,omitempty"`
+	// purge tags sent by the origin
+	Tags []string `json:"g,omitempty"`
+	// expired by a soft purge, served stale for at least softPurgeStale
+	SoftPurged bool `json:"p,omitempty"`
 
 	contentEncoding string
 }
@@ -109,10 +119,12 @@ func NewCacheMeta(stateCode int, hdr http.Header, data []byte) *CacheMeta {
 	}
 
 	// TODO: pool
+	now := time.Now()
 	meta := &CacheMeta{
 		StateCode: stateCode,
 		Header:    make([][]string, 0, 8),
-		Timestamp: time.Now().Unix(),
+		Timestamp: now.Unix(),
+		Rendered:  now.UnixNano(),
 
 		contentEncoding: ce,
 	}
@@ -142,14 +154,59 @@ func (m *CacheMeta) SetHeader(hdr http.Header) {
 	}
 }
 
+// softExpire marks the entry soft purged, expiring at expires
+func (m *CacheMeta) softExpire(expires int64) {
+	m.Expires = expires
+	m.SoftPurged = true
+}
+
+// clone copies the stored fields
+func (m *CacheMeta) clone() *CacheMeta {
+	return &CacheMeta{
+		StateCode: m.StateCode,
+		Header:    m.Header,
+		Timestamp: m.Timestamp,
+		Rendered:  m.Rendered,
+		Expires:   m.Expires,
+		Tags:      m.Tags,
+
+		SoftPurged:      m.SoftPurged,
+		contentEncoding: m.contentEncoding,
+	}
+}
+
+// replaces reports whether m is of a later render than old. The bodies of the other
+// encodings stored with old are then stale, a fill of another encoding of the same
+// render keeps them.
+func (m *CacheMeta) replaces(old *CacheMeta) bool {
+	if m.Rendered != 0 && old.Rendered != 0 {
+		return m.Rendered > old.Rendered
+	}
+	// stored before renders were timed to the nanosecond
+	return m.Timestamp > old.Timestamp
+}
+
+// GetHeader returns the cached value of a response header
+func (m *CacheMeta) GetHeader(name string) string {
+	for _, kv := range m.Header {
+		if len(kv) == 2 && kv[0] == name {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+// VaryFields returns the request header names the response varies on
+func (m *CacheMeta) VaryFields() []string {
+	return parseVary(m.GetHeader("Vary"))
+}
+
 func (m *CacheMeta) WriteToFile(fp string) error {
-	fd, err := os.OpenFile(fp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	buf, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
-	enc := json.NewEncoder(fd)
-	return enc.Encode(m)
+	return writeFileAtomic(fp, append(buf, '\n'))
 }
 
 func (m *CacheMeta) LoadFromFile(fp string) error {
@@ -160,4 +217,4 @@ func (m *CacheMeta) LoadFromFile(fp string) error {
 	defer fd.Close()
 	dec := json.NewDecoder(fd)
 	return dec.Decode(m)
-}
\ No newline at end of file
+}
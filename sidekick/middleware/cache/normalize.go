@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// DefaultQueryDrop lists the tracking parameters removed before keying
+var DefaultQueryDrop = []string{
+	"utm_*",
+	"fbclid",
+	"gclid",
+	"dclid",
+	"msclkid",
+	"mc_cid",
+	"mc_eid",
+	"_ga",
+	"_gl",
+}
+
+// QueryNormalize cleans the query string before it becomes part of the cache key,
+// so links that differ only in tracking parameters or ordering share one entry.
+// The query passed to the origin is left untouched.
+type QueryNormalize struct {
+	// Drop lists parameter names to remove, a trailing * matches a prefix
+	Drop []string
+	// DropEmpty removes parameters without a value. By default "?s=", WordPress's
+	// empty search, is kept apart from no "s", and an empty value only collapses
+	// into the other values of its parameter.
+	DropEmpty bool
+	// FoldCase lower-cases parameter names and values
+	FoldCase bool
+}
+
+// DefaultQueryNormalize drops the common tracking parameters
+func DefaultQueryNormalize() *QueryNormalize {
+	return &QueryNormalize{Drop: slices.Clone(DefaultQueryDrop)}
+}
+
+// UnmarshalCaddyfile parses a query_normalize block:
+//
+//	query_normalize {
+//		drop <name>[,<name>...]   # replaces the default list, utm_* style wildcards allowed
+//		drop_empty
+//		fold_case
+//	}
+func (n *QueryNormalize) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	dropSet := false
+	return parseBlock(d, func(key string, args []string) error {
+		switch key {
+		case "drop":
+			if !dropSet {
+				n.Drop = nil
+				dropSet = true
+			}
+			n.Drop = append(n.Drop, splitList(args)...)
+
+		case "drop_empty":
+			n.DropEmpty = len(args) == 0 || parseBool(args[0])
+
+		case "fold_case":
+			n.FoldCase = len(args) == 0 || parseBool(args[0])
+
+		default:
+			return d.Errf("unknown query_normalize option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Normalize returns a cleaned copy of the query. Values of a parameter are sorted,
+// parameter names are ordered when the key is built by url.Values.Encode.
+func (n *QueryNormalize) Normalize(query url.Values) url.Values {
+	if n == nil {
+		return query
+	}
+
+	out := make(url.Values, len(query))
+	for name, values := range query {
+		if n.FoldCase {
+			name = strings.ToLower(name)
+		}
+		if n.dropped(name) {
+			continue
+		}
+
+		for _, v := range values {
+			if n.FoldCase {
+				v = strings.ToLower(v)
+			}
+			// collapse repeated values, "a=1&a=1" is the same as "a=1"
+			if slices.Contains(out[name], v) {
+				continue
+			}
+			out[name] = append(out[name], v)
+		}
+		// and empty values into the others, "a=&a=1" is the same as "a=1"
+		if len(out[name]) > 1 || n.DropEmpty {
+			out[name] = slices.DeleteFunc(out[name], func(v string) bool { return v == "" })
+		}
+		if len(out[name]) > 0 {
+			slices.Sort(out[name])
+		} else {
+			delete(out, name)
+		}
+	}
+	return out
+}
+
+func (n *QueryNormalize) dropped(name string) bool {
+	for _, pattern := range n.Drop {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
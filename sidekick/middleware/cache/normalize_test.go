@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestQueryNormalize(t *testing.T) {
+	tests := []struct {
+		name  string
+		n     *QueryNormalize
+		query string
+		want  url.Values
+	}{
+		{"drops tracking", DefaultQueryNormalize(), "utm_source=x&utm_campaign=y&fbclid=1&p=2", url.Values{"p": {"2"}}},
+		{"sorts and collapses values", DefaultQueryNormalize(), "c=2&c=1&c=2", url.Values{"c": {"1", "2"}}},
+		{"keeps empty", DefaultQueryNormalize(), "s=&p=2", url.Values{"s": {""}, "p": {"2"}}},
+		{"collapses empty", DefaultQueryNormalize(), "s=&s=&c=&c=1", url.Values{"s": {""}, "c": {"1"}}},
+		{"drop_empty", &QueryNormalize{DropEmpty: true}, "s=&p=2", url.Values{"p": {"2"}}},
+		{"fold_case", &QueryNormalize{FoldCase: true, Drop: []string{"utm_*"}}, "UTM_Source=x&Color=Red", url.Values{"color": {"red"}}},
+		{"case kept", DefaultQueryNormalize(), "Color=Red", url.Values{"Color": {"Red"}}},
+		{"nil", nil, "utm_source=x", url.Values{"utm_source": {"x"}}},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		if got := tt.n.Normalize(query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Normalize(%q) = %v, want %v", tt.name, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestQueryNormalizeKeys(t *testing.T) {
+	k := &CacheKey{Path: true, QueryAll: true, normalize: DefaultQueryNormalize()}
+	build := func(target string) string {
+		return k.Build(httptest.NewRequest("GET", target, nil))
+	}
+
+	want := build("/a/?a=1&b=2")
+	for _, target := range []string{"/a/?b=2&a=1", "/a/?utm_source=news&a=1&b=2&gclid=x", "/a/?a=1&a=&b=2"} {
+		if got := build(target); got != want {
+			t.Errorf("key of %s = %q, want %q", target, got, want)
+		}
+	}
+	if got := build("/a/?utm_source=news"); got != "/a/::" {
+		t.Errorf("tracking only query keyed %q", got)
+	}
+
+	// the empty search renders the search template, not the home page
+	if build("/?s=") == build("/") {
+		t.Error("/?s= shares the key of /")
+	}
+	k.Query, k.QueryAll = []string{"s"}, false
+	if build("/?s=") == build("/") {
+		t.Error("/?s= shares the key of / with query s")
+	}
+}
+
+func TestQueryNormalizeDropReplacesDefaults(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`query_normalize {
+		drop ref, src_*
+		drop_empty
+	}`)
+	d.Next()
+	n := DefaultQueryNormalize()
+	if err := n.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(n.Drop, []string{"ref", "src_*"}) || !n.DropEmpty || n.FoldCase {
+		t.Fatalf("parsed %+v", n)
+	}
+
+	query, _ := url.ParseQuery("ref=a&src_x=b&utm_source=c")
+	if got := n.Normalize(query); !reflect.DeepEqual(got, url.Values{"utm_source": {"c"}}) {
+		t.Errorf("Normalize = %v, want only utm_source kept", got)
+	}
+}
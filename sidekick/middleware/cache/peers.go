@@ -0,0 +1,317 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/puzpuzpuz/xsync"
+	"go.uber.org/zap"
+)
+
+// peerForwardedHeader marks a purge forwarded by a peer, it is never forwarded again.
+// It carries the instance ID of the sender, an instance answers its own forwards
+// with it so the sender knows the peer is itself.
+const peerForwardedHeader = "X-WPSidekick-Purge-Forwarded"
+
+// newInstanceID returns the ID telling a handler apart from the replicas
+// sharing its host or address
+func newInstanceID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Peers are the other replicas every purge and flush is forwarded to,
+// through their purge path and signed with the first purge key
+type Peers struct {
+	// Static are base URLs of peers, e.g. "http://10.0.0.2:80"
+	Static []string
+	// SRV is a DNS SRV name listing peers, e.g. "_http._tcp.wordpress.internal"
+	SRV string
+	// Scheme of the peers found through SRV
+	Scheme string
+	// Retries is how many times a failed forward is tried again, 3 when unset
+	Retries *int
+	// Timeout bounds each attempt
+	Timeout caddy.Duration
+	// Host is the virtual host sent to peers, defaults to the host of the
+	// purge request, or of the peer URL for purges through the admin API
+	Host string
+
+	client  *http.Client
+	retries int
+	// the peer URLs that answered a forward as this instance, they are skipped
+	self *xsync.MapOf[string, bool]
+}
+
+// PeerAck reports how forwarding a purge to a peer went
+type PeerAck struct {
+	Peer     string `json:"peer"`
+	OK       bool   `json:"ok"`
+	Status   int    `json:"status,omitempty"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+
+	// the peer is this instance
+	self bool
+}
+
+// UnmarshalCaddyfile parses a peers block:
+//
+//	peers {
+//		static http://10.0.0.2 http://10.0.0.3
+//		srv _http._tcp.wordpress.internal
+//		scheme http
+//		retries 3
+//		timeout 5s
+//		host example.com
+//	}
+func (p *Peers) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return parseBlock(d, func(key string, args []string) error {
+		switch key {
+		case "static":
+			for _, peer := range splitList(args) {
+				if _, err := url.Parse(peer); err != nil {
+					return d.Errf("invalid peer '%s': %v", peer, err)
+				}
+				p.Static = append(p.Static, peer)
+			}
+
+		case "srv":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			p.SRV = args[0]
+
+		case "scheme":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			p.Scheme = args[0]
+
+		case "retries":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				return d.Errf("invalid retries '%s'", args[0])
+			}
+			p.Retries = &n
+
+		case "host":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			p.Host = args[0]
+
+		case "timeout":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return d.Errf("invalid timeout '%s'", args[0])
+			}
+			p.Timeout = caddy.Duration(dur)
+
+		default:
+			return d.Errf("unknown peers option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Provision fills defaults
+func (p *Peers) Provision() {
+	if p.Scheme == "" {
+		p.Scheme = "http"
+	}
+	p.retries = 3
+	if p.Retries != nil {
+		p.retries = *p.Retries
+	}
+	if p.Timeout == 0 {
+		p.Timeout = caddy.Duration(5 * time.Second)
+	}
+	p.client = &http.Client{
+		Timeout: time.Duration(p.Timeout),
+		// a redirect would lose the signature, count it as a failure
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	p.self = xsync.NewMapOf[bool]()
+}
+
+// list returns the peer base URLs, looking up SRV every time so replicas can come and go
+func (p *Peers) list(ctx context.Context) ([]string, error) {
+	peers := append([]string(nil), p.Static...)
+	if p.SRV != "" {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", p.SRV)
+		if err != nil {
+			return peers, err
+		}
+		for _, rec := range records {
+			host := strings.TrimSuffix(rec.Target, ".")
+			peers = append(peers, p.Scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(rec.Port))))
+		}
+		// forget the replicas that are gone
+		p.self.Range(func(peer string, _ bool) bool {
+			if !slices.Contains(peers, peer) {
+				p.self.Delete(peer)
+			}
+			return true
+		})
+	}
+	return peers, nil
+}
+
+// isSelf reports whether the peer answered a forward as this instance. Addresses
+// can't tell, replicas may share a host, or reach each other through a proxy.
+func (p *Peers) isSelf(peer string) bool {
+	self, _ := p.self.Load(peer)
+	return self
+}
+
+// withPeers wraps a purge so it is forwarded to the peers once done here,
+// unless it came from a peer itself
+func (c *Cache) withPeers(purge func() *PurgeResult, r *http.Request, uri, host string, body []byte) func() *PurgeResult {
+	if c.Peers == nil || r.Header.Get(peerForwardedHeader) != "" {
+		return purge
+	}
+	return func() *PurgeResult {
+		res := purge()
+		res.Peers = c.forwardPurge(uri, host, body)
+		return res
+	}
+}
+
+// forwardPurge sends the purge to every peer at once and waits for their answers.
+// uri is the purge path request URI, host the virtual host of the site.
+func (c *Cache) forwardPurge(uri, host string, body []byte) []PeerAck {
+	p := c.Peers
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.Timeout)*time.Duration(p.retries+1)*2)
+	defer cancel()
+
+	peers, err := p.list(ctx)
+	if err != nil {
+		c.logger.Error("wp cache - peers - lookup failed", zap.String("srv", p.SRV), zap.Error(err))
+	}
+
+	// the peer answers once it purged, so the ack means the purge is done there
+	if u, err := url.Parse(uri); err == nil {
+		query := u.Query()
+		query.Set("sync", "1")
+		u.RawQuery = query.Encode()
+		uri = u.RequestURI()
+	}
+
+	acks := make([]PeerAck, 0, len(peers))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		if p.isSelf(peer) {
+			continue
+		}
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			ack := c.forwardPeer(ctx, peer, uri, host, body)
+			if ack.self {
+				p.self.Store(peer, true)
+				return
+			}
+			if !ack.OK {
+				c.logger.Error("wp cache - peers - forward failed", zap.String("peer", peer), zap.String("error", ack.Error))
+			}
+			mu.Lock()
+			acks = append(acks, ack)
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+	return acks
+}
+
+// forwardPeer sends the purge to one peer, retrying with backoff when the peer
+// couldn't be reached or a gateway in front of it answered 502, 503 or 504.
+// Every attempt is signed anew, the peer refuses a replayed signature.
+func (c *Cache) forwardPeer(ctx context.Context, peer, uri, host string, body []byte) PeerAck {
+	p := c.Peers
+	ack := PeerAck{Peer: peer}
+	if len(c.purgeKeys) == 0 {
+		ack.Error = ErrPurgeNoKey.Error()
+		return ack
+	}
+	backoff := 200 * time.Millisecond
+	for ack.Attempts <= p.retries {
+		if ack.Attempts > 0 {
+			select {
+			case <-ctx.Done():
+				ack.Error = ctx.Err().Error()
+				return ack
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		ack.Attempts++
+
+		req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(peer, "/")+uri, bytes.NewReader(body))
+		if err != nil {
+			ack.Error = err.Error()
+			return ack
+		}
+		req.Host = host
+		if p.Host != "" {
+			req.Host = p.Host
+		}
+		req.Header.Set(c.PurgeKeyHeader, SignPurge(string(c.purgeKeys[0]), "POST", uri, body, time.Now()))
+		req.Header.Set(peerForwardedHeader, c.instance)
+		if len(body) > 0 {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			ack.Error = err.Error()
+			continue
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		ack.Status = resp.StatusCode
+		if resp.Header.Get(peerForwardedHeader) == c.instance {
+			ack.self = true
+			return ack
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			ack.OK = true
+			ack.Error = ""
+			return ack
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			// the peer wasn't reached, try again
+			ack.Error = fmt.Sprintf("peer answered %d", resp.StatusCode)
+		default:
+			// refused, or ran the purge and failed part of it, trying again
+			// would purge it and its CDNs once more
+			ack.Error = fmt.Sprintf("peer answered %d", resp.StatusCode)
+			return ack
+		}
+	}
+	return ack
+}
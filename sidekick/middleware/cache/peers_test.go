@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func TestPeersRetriesZero(t *testing.T) {
+	p := &Peers{}
+	d := caddyfile.NewTestDispenser(`peers {
+		static http://127.0.0.1:1
+		retries 0
+	}`)
+	d.Next()
+	if err := p.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	p.Provision()
+	if p.retries != 0 {
+		t.Fatalf("retries 0 provisioned as %d", p.retries)
+	}
+
+	p = &Peers{}
+	p.Provision()
+	if p.retries != 3 {
+		t.Fatalf("unset retries provisioned as %d, want 3", p.retries)
+	}
+}
+
+// newTestCache provisions c with its files in a temporary directory, and quiet
+func newTestCache(t *testing.T, c *Cache) *Cache {
+	t.Helper()
+	c.Loc = t.TempDir()
+	if err := c.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	c.logger = zap.NewNop()
+	c.Store.logger = c.logger
+	t.Cleanup(func() { c.Cleanup() })
+	return c
+}
+
+// servePurges serves the purge path of c on a port of 127.0.0.1
+func servePurges(t *testing.T, c *Cache) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.servePurge(w, r) {
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPeersOnOneHost(t *testing.T) {
+	// two replicas on one host, each listing both as peers
+	a := newTestCache(t, &Cache{Zone: "peers-a", TTL: 60, PurgeKey: "secret", PurgeSync: true})
+	b := newTestCache(t, &Cache{Zone: "peers-b", TTL: 60, PurgeKey: "secret"})
+	srvA, srvB := servePurges(t, a), servePurges(t, b)
+	a.Peers = &Peers{Static: []string{srvA.URL, srvB.URL}}
+	a.Peers.Provision()
+
+	b.Store.Set("/post/::", b.Store.Generation(), http.Header{}, testMeta(), []byte("post"))
+
+	for i := 0; i < 2; i++ {
+		acks := a.forwardPurge(a.PurgePath+"/post/", "example.com", nil)
+		if len(acks) != 1 || acks[0].Peer != srvB.URL || !acks[0].OK {
+			t.Fatalf("purge %d acks %+v, want one from the other port", i, acks)
+		}
+	}
+	if !a.Peers.isSelf(srvA.URL) || a.Peers.isSelf(srvB.URL) {
+		t.Errorf("self peers %v", a.Peers.self)
+	}
+	if _, _, err := b.Store.Get("/post/::", http.Header{}, "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("the replica on the other port wasn't purged, err %v", err)
+	}
+}
+
+func TestPeerRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+		ok       bool
+	}{
+		// the peer ran the purge and part of it failed, running it again purges its CDNs again
+		{"partial failure", []int{http.StatusInternalServerError, http.StatusOK}, 1, false},
+		{"refused", []int{http.StatusForbidden, http.StatusOK}, 1, false},
+		{"unavailable", []int{http.StatusServiceUnavailable, http.StatusOK}, 2, true},
+		{"bad gateway", []int{http.StatusBadGateway, http.StatusGatewayTimeout}, 2, false},
+	}
+	for _, tt := range tests {
+		var n atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.statuses[n.Add(1)-1])
+		}))
+		c := newTestCache(t, &Cache{Zone: "peer-retries", TTL: 60, PurgeKey: "secret"})
+		c.Peers = &Peers{Static: []string{srv.URL}, Retries: intPtr(1)}
+		c.Peers.Provision()
+
+		ack := c.forwardPeer(context.Background(), srv.URL, c.PurgePath+"/a/", "example.com", nil)
+		srv.Close()
+		if ack.Attempts != tt.attempts || ack.OK != tt.ok || int(n.Load()) != tt.attempts {
+			t.Errorf("%s: ack %+v after %d requests, want %d attempts and ok %v", tt.name, ack, n.Load(), tt.attempts, tt.ok)
+		}
+		if !tt.ok && ack.Status != tt.statuses[tt.attempts-1] {
+			t.Errorf("%s: ack status %d", tt.name, ack.Status)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// softPurgeStale is the least seconds a soft purged entry is served stale,
+// so one request refreshes it even without stale-while-revalidate
+const softPurgeStale = 30
+
+// PurgeMode selects which entries a path purge removes
+type PurgeMode string
+
+const (
+	// PurgeExact removes the page at the path, in every variant
+	PurgeExact PurgeMode = "exact"
+	// PurgeSubtree removes the page at the path and the pages below it,
+	// "/blog" covers "/blog/post" but not "/blog-archive"
+	PurgeSubtree PurgeMode = "subtree"
+	// PurgePrefix removes every entry whose key starts with the path
+	PurgePrefix PurgeMode = "prefix"
+)
+
+// ParsePurgeMode parses a mode name, empty is PurgeSubtree
+func ParsePurgeMode(name string) (PurgeMode, error) {
+	switch mode := PurgeMode(strings.ToLower(strings.TrimSpace(name))); mode {
+	case "":
+		return PurgeSubtree, nil
+	case PurgeExact, PurgeSubtree, PurgePrefix:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown purge mode '%s'", name)
+}
+
+// matcher returns a match on flattened keys for the request path
+func (mode PurgeMode) matcher(reqPath string) func(key string) bool {
+	flat := strings.ReplaceAll(reqPath, "/", "+")
+	switch mode {
+	case PurgeExact:
+		return func(key string) bool {
+			keyPath, _, _ := strings.Cut(key, "::")
+			return keyPath == flat
+		}
+	case PurgeSubtree:
+		base := strings.TrimSuffix(flat, "+")
+		return func(key string) bool {
+			keyPath, _, _ := strings.Cut(key, "::")
+			return keyPath == base || strings.HasPrefix(keyPath, base+"+")
+		}
+	}
+	return func(key string) bool {
+		return strings.HasPrefix(key, flat)
+	}
+}
+
+// PurgeResult reports what a purge removed, or for soft purges marked expired
+type PurgeResult struct {
+	Mem        int          `json:"mem"`
+	Disk       int          `json:"disk"`
+	Errors     []PurgeError `json:"errors,omitempty"`
+	DurationMs float64      `json:"duration_ms"`
+	// Peers reports the replicas the purge was forwarded to
+	Peers []PeerAck `json:"peers,omitempty"`
+
+	start time.Time
+}
+
+// PurgeError is a file the purge failed on
+type PurgeError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+func newPurgeResult() *PurgeResult {
+	return &PurgeResult{start: time.Now()}
+}
+
+func (res *PurgeResult) fail(fp string, err error) {
+	res.Errors = append(res.Errors, PurgeError{Path: fp, Error: err.Error()})
+}
+
+// count adds what a tier removed, the memory tier counts in mem and every other in disk
+func (res *PurgeResult) count(t tier, n int) {
+	if t.name == "mem" {
+		res.Mem += n
+	} else {
+		res.Disk += n
+	}
+}
+
+// add counts what another pass of the same purge removed
+func (res *PurgeResult) add(other *PurgeResult) {
+	res.Mem += other.Mem
+	res.Disk += other.Disk
+	res.Errors = append(res.Errors, other.Errors...)
+}
+
+func (res *PurgeResult) done() *PurgeResult {
+	res.DurationMs = float64(time.Since(res.start).Microseconds()) / 1000
+	return res
+}
+
+// SoftPurge marks the entries of the request path, selected by mode, as expired but keeps them,
+// so stale serving can still hand them out while a single refresh repopulates each one.
+// With related the pages the purge rules tie to reqPath are expired too.
+func (d *Store) SoftPurge(reqPath string, mode PurgeMode, related bool) *PurgeResult {
+	d.logger.Debug("Soft purging path from cache", zap.String("path", reqPath), zap.String("mode", string(mode)), zap.Bool("related", related))
+	match := mode.matcher(reqPath)
+	prefix := keyPrefix(reqPath, mode)
+	if related && len(d.Related(reqPath)) > 0 {
+		match = d.withRelated([]string{reqPath}, match)
+		prefix = ""
+	}
+	d.recordPurge(matchKeys(match))
+	return d.expireKeys(prefix, match)
+}
+
+// SoftFlush marks every entry as expired
+func (d *Store) SoftFlush() *PurgeResult {
+	d.logger.Debug("Soft flushing cache")
+	d.recordPurge(matchAll)
+	return d.expireKeys("", func(string) bool {
+		return true
+	})
+}
+
+// SoftPurgeTags marks the entries carrying any of the tags as expired,
+// with related the pages the purge rules tie to their paths too
+func (d *Store) SoftPurgeTags(tags []string, related bool) *PurgeResult {
+	d.logger.Debug("Soft purging tags from cache", zap.Strings("tags", tags), zap.Bool("related", related))
+	var paths []string
+	if related {
+		paths = d.taggedPaths(tags)
+	}
+	d.recordPurge(d.withRelatedMeta(paths, matchTags(tags)))
+	keys := d.taggedSet(tags)
+	return d.expireKeys("", d.withRelated(paths, func(k string) bool {
+		return keys[k]
+	}))
+}
+
+// expiredAt reports whether the entry is expired at the unix time now
+func (d *Store) expiredAt(meta *CacheMeta, now int64) bool {
+	expires := d.expiresAt(meta)
+	return expires > 0 && expires <= now
+}
+
+// splitMemKey splits a memory cache key into the flattened key and the content encoding
+func splitMemKey(k string) (string, string) {
+	i := strings.LastIndex(k, "::")
+	if i < 0 {
+		return k, ""
+	}
+	return k[:i], k[i+2:]
+}
+
+// removeKeys deletes the matching entries, by flattened key starting with prefix, from every tier
+func (d *Store) removeKeys(prefix string, match func(key string) bool) *PurgeResult {
+	res := newPurgeResult()
+
+	vary := d.getVary()
+	vary.Range(func(k string, _ []string) bool {
+		if match(k) {
+			vary.Delete(k)
+		}
+		return true
+	})
+
+	d.genMu.Lock()
+	d.untagKeys(match)
+	d.genMu.Unlock()
+
+	for _, t := range d.tiers {
+		n, errs := t.Purge(prefix, match)
+		res.count(t, n)
+		for _, e := range errs {
+			d.logger.Error("Error Removing key from "+t.name+" cache", zap.String("path", e.Path), zap.String("error", e.Error))
+		}
+		res.Errors = append(res.Errors, errs...)
+	}
+	return res.done()
+}
+
+// expireKeys moves the expiry of the matching entries, by flattened key starting with prefix, into the past
+func (d *Store) expireKeys(prefix string, match func(key string) bool) *PurgeResult {
+	now := time.Now().Unix()
+	res := newPurgeResult()
+
+	for _, t := range d.tiers {
+		keys, err := t.List()
+		if err != nil {
+			d.logger.Error("Error expiring keys in "+t.name+" cache", zap.Error(err))
+			res.fail(t.name, err)
+			continue
+		}
+		for key := range keys {
+			if !strings.HasPrefix(key, prefix) || !match(key) {
+				continue
+			}
+			n, err := d.expireKey(t, key, now)
+			if err != nil {
+				d.logger.Error("Error expiring key in "+t.name+" cache", zap.String("key", key), zap.Error(err))
+				res.fail(key, err)
+				continue
+			}
+			res.count(t, n)
+		}
+	}
+	return res.done()
+}
+
+// expireKey moves the expiry of an entry into the past unless it already is,
+// holding off Set so a fresh write is not replaced by an expired copy
+func (d *Store) expireKey(t tier, key string, now int64) (int, error) {
+	d.genMu.Lock()
+	defer d.genMu.Unlock()
+
+	meta, err := t.Meta(key)
+	if err != nil || d.expiredAt(meta, now) {
+		return 0, nil
+	}
+	return t.Expire(key, now-1)
+}
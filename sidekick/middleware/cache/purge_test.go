@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// blogEntries are the entries a purge of /blog is checked against
+var blogEntries = []string{"/blog::", "/blog/::", "/blog/post/::", "/blog-archive/::"}
+
+func setBlogEntries(t *testing.T, d *Store) {
+	t.Helper()
+	for _, key := range blogEntries {
+		if err := d.Set(key, d.Generation(), http.Header{}, testMeta(), []byte(key)); err != nil {
+			t.Fatalf("Set %s: %v", key, err)
+		}
+	}
+}
+
+// assertPurged checks which of blogEntries are gone
+func assertPurged(t *testing.T, d *Store, name string, purged map[string]bool) {
+	t.Helper()
+	for _, key := range blogEntries {
+		_, _, err := d.Get(key, http.Header{}, "none")
+		if gone := errors.Is(err, ErrCacheNotFound); gone != purged[key] {
+			t.Errorf("%s: %s purged %v, want %v", name, key, gone, purged[key])
+		}
+	}
+}
+
+func TestParsePurgeMode(t *testing.T) {
+	tests := map[string]PurgeMode{
+		"":         PurgeSubtree,
+		"exact":    PurgeExact,
+		" Subtree": PurgeSubtree,
+		"PREFIX":   PurgePrefix,
+	}
+	for name, want := range tests {
+		if got, err := ParsePurgeMode(name); err != nil || got != want {
+			t.Errorf("ParsePurgeMode(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParsePurgeMode("tree"); err == nil {
+		t.Error("ParsePurgeMode accepted an unknown mode")
+	}
+}
+
+func TestPurgeModes(t *testing.T) {
+	tests := []struct {
+		mode   PurgeMode
+		purged map[string]bool
+	}{
+		{PurgeExact, map[string]bool{"/blog::": true}},
+		{PurgeSubtree, map[string]bool{"/blog::": true, "/blog/::": true, "/blog/post/::": true}},
+		{PurgePrefix, map[string]bool{"/blog::": true, "/blog/::": true, "/blog/post/::": true, "/blog-archive/::": true}},
+	}
+	for _, tt := range tests {
+		d := newTestStore(t, StoreOptions{})
+		setBlogEntries(t, d)
+		d.Purge("/blog", tt.mode, false)
+		assertPurged(t, d, string(tt.mode), tt.purged)
+
+		d = newTestStore(t, StoreOptions{})
+		setBlogEntries(t, d)
+		if _, err := d.PurgeBatch(&PurgeBatch{Paths: []string{"/blog"}, Mode: string(tt.mode)}, false); err != nil {
+			t.Fatal(err)
+		}
+		assertPurged(t, d, "batch "+string(tt.mode), tt.purged)
+	}
+}
+
+func TestPurgeModeDefault(t *testing.T) {
+	tests := []struct {
+		env    string
+		purged map[string]bool
+	}{
+		{"", map[string]bool{"/blog::": true, "/blog/::": true, "/blog/post/::": true}},
+		{"prefix", map[string]bool{"/blog::": true, "/blog/::": true, "/blog/post/::": true, "/blog-archive/::": true}},
+	}
+	for _, tt := range tests {
+		t.Setenv("PURGE_MODE", tt.env)
+		c := newTestCache(t, &Cache{Zone: "purge-mode-" + tt.env, TTL: 60})
+		setBlogEntries(t, c.Store)
+
+		r := httptest.NewRequest("POST", c.PurgePath+"/blog", nil)
+		purge, err := c.preparePurge(httptest.NewRecorder(), r, "/blog", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		purge()
+		assertPurged(t, c.Store, "PURGE_MODE="+tt.env, tt.purged)
+	}
+}
+
+func TestPurgePlainPermalink(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, PurgeKey: "secret"})
+	for _, key := range []string{"/::", "/blog/::"} {
+		c.Store.Set(key, c.Store.Generation(), http.Header{}, testMeta(), []byte(key))
+	}
+
+	// a "/?p=42" permalink reaches the cache as its path and an exact purge
+	if w := postPurge(c, c.PurgePath+"/?mode=exact&sync=1", ""); w.Code != http.StatusOK {
+		t.Fatalf("purge answered %d: %s", w.Code, w.Body)
+	}
+	if _, _, err := c.Store.Get("/::", http.Header{}, "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("home page kept: %v", err)
+	}
+	if _, _, err := c.Store.Get("/blog/::", http.Header{}, "none"); err != nil {
+		t.Errorf("an exact purge of the home page flushed /blog/: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// PurgeRule purges related pages, like the home page, archives, feeds and
+// sitemaps listing a post, along with every path purge it matches. Every
+// condition given must match, a rule without conditions matches every purge.
+type PurgeRule struct {
+	PathPrefix string
+	PathRegex  string
+	// paths purged along with the match, exactly, or with * matching anything
+	Also []string
+
+	rx   *regexp.Regexp
+	also []func(key string) bool
+}
+
+// UnmarshalCaddyfile parses a purge_rule block:
+//
+//	purge_rule {
+//		path_prefix /blog/
+//		path_regex ^/(category|tag)/
+//		also / /blog/ /feed/ /wp-sitemap*.xml
+//	}
+func (rule *PurgeRule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	err := parseBlock(d, func(key string, args []string) error {
+		switch key {
+		case "path_prefix":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			rule.PathPrefix = args[0]
+
+		case "path_regex":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			if _, err := regexp.Compile(args[0]); err != nil {
+				return d.Errf("invalid path_regex '%s': %v", args[0], err)
+			}
+			rule.PathRegex = args[0]
+
+		case "also":
+			for _, p := range splitList(args) {
+				if !strings.HasPrefix(p, "/") {
+					return d.Errf("invalid also path '%s', paths start with /", p)
+				}
+				rule.Also = append(rule.Also, p)
+			}
+
+		default:
+			return d.Errf("unknown purge_rule option '%s'", key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(rule.Also) == 0 {
+		return d.Err("purge_rule needs also paths")
+	}
+	return nil
+}
+
+// Provision compiles the path regex and the also paths
+func (rule *PurgeRule) Provision() error {
+	if rule.PathRegex != "" {
+		rx, err := regexp.Compile(rule.PathRegex)
+		if err != nil {
+			return err
+		}
+		rule.rx = rx
+	}
+
+	rule.also = make([]func(key string) bool, 0, len(rule.Also))
+	for _, p := range rule.Also {
+		if !strings.Contains(p, "*") {
+			rule.also = append(rule.also, PurgeExact.matcher(p))
+			continue
+		}
+		parts := strings.Split(p, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		rx := regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+		rule.also = append(rule.also, func(key string) bool {
+			keyPath, _, _ := strings.Cut(key, "::")
+			return rx.MatchString(strings.ReplaceAll(keyPath, "+", "/"))
+		})
+	}
+	return nil
+}
+
+// Match reports whether a purge of reqPath matches every condition of the rule
+func (rule *PurgeRule) Match(reqPath string) bool {
+	if rule.PathPrefix != "" && !strings.HasPrefix(reqPath, rule.PathPrefix) {
+		return false
+	}
+	if rule.rx != nil && !rule.rx.MatchString(reqPath) {
+		return false
+	}
+	return true
+}
+
+// Related returns the also paths of the rules matching a purge of any of the paths
+func (d *Store) Related(paths ...string) []string {
+	var also []string
+	for i := range d.purgeRules {
+		if slices.ContainsFunc(paths, d.purgeRules[i].Match) {
+			also = appendNew(also, d.purgeRules[i].Also)
+		}
+	}
+	return also
+}
+
+// relatedMatch matches the pages the purge rules tie to any of the paths, nil when no rule does
+func (d *Store) relatedMatch(paths []string) func(key string) bool {
+	var also []func(key string) bool
+	for i := range d.purgeRules {
+		if slices.ContainsFunc(paths, d.purgeRules[i].Match) {
+			also = append(also, d.purgeRules[i].also...)
+		}
+	}
+	if len(also) == 0 {
+		return nil
+	}
+	return func(key string) bool {
+		return slices.ContainsFunc(also, func(m func(string) bool) bool {
+			return m(key)
+		})
+	}
+}
+
+// withRelated extends match with the pages the purge rules tie to the paths
+func (d *Store) withRelated(paths []string, match func(key string) bool) func(key string) bool {
+	rel := d.relatedMatch(paths)
+	if rel == nil {
+		return match
+	}
+	return func(key string) bool {
+		return match(key) || rel(key)
+	}
+}
+
+// withRelatedMeta is withRelated for a purge log match
+func (d *Store) withRelatedMeta(paths []string, match func(string, *CacheMeta) bool) func(string, *CacheMeta) bool {
+	rel := d.relatedMatch(paths)
+	if rel == nil {
+		return match
+	}
+	return func(key string, meta *CacheMeta) bool {
+		return match(key, meta) || rel(key)
+	}
+}
+
+// keyPaths returns the request paths of flattened keys
+func keyPaths(keys []string) []string {
+	paths := make([]string, 0, len(keys))
+	for _, key := range keys {
+		keyPath, _, _ := keyParts(key)
+		paths = append(paths, strings.ReplaceAll(keyPath, "+", "/"))
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
@@ -0,0 +1,593 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(RedisStorage{})
+}
+
+// RedisStorage keeps entries in Redis or Valkey, shared by every replica.
+// Each entry is a hash under Prefix+"e:"+key holding the meta and a field per
+// content encoding, expiring Grace after the entry does. The vary fields of a
+// key are a string under Prefix+"v:"+key, and the keys carrying a tag a set
+// under Prefix+"t:"+tag, kept as long as its longest lived entry. Purges scan
+// the keyspace by pattern.
+type RedisStorage struct {
+	// Address is host:port of the server, CACHE_REDIS_ADDR or localhost:6379 by default
+	Address  string
+	Username string
+	// Password is CACHE_REDIS_PASSWORD by default
+	Password string
+	DB       int
+	// Prefix namespaces the keys, so several sites can share a server
+	Prefix string
+	// Timeout bounds each round trip
+	Timeout caddy.Duration
+	// Grace is how long Redis keeps an entry past its expiry, for stale serving.
+	// It should cover stale_while_revalidate and stale_if_error.
+	Grace caddy.Duration
+	// PoolSize is how many idle connections are kept
+	PoolSize int
+
+	client *respClient
+}
+
+// CaddyModule returns the Caddy module information.
+func (RedisStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.wp_cache.storage.redis",
+		New: func() caddy.Module {
+			return new(RedisStorage)
+		},
+	}
+}
+
+// UnmarshalCaddyfile parses a redis block:
+//
+//	storage redis {
+//		address localhost:6379
+//		username default
+//		password secret
+//		db 0
+//		prefix wpcache:
+//		timeout 2s
+//		grace 24h
+//		pool_size 16
+//	}
+func (s *RedisStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // backend name
+	return parseBlock(d, func(key string, args []string) error {
+		switch key {
+		case "address", "username", "password", "prefix":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			switch key {
+			case "address":
+				s.Address = args[0]
+			case "username":
+				s.Username = args[0]
+			case "password":
+				s.Password = args[0]
+			case "prefix":
+				s.Prefix = args[0]
+			}
+
+		case "db", "pool_size":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				return d.Errf("invalid %s '%s'", key, args[0])
+			}
+			if key == "db" {
+				s.DB = n
+			} else {
+				s.PoolSize = n
+			}
+
+		case "timeout", "grace":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return d.Errf("invalid %s '%s'", key, args[0])
+			}
+			if key == "timeout" {
+				s.Timeout = caddy.Duration(dur)
+			} else {
+				s.Grace = caddy.Duration(dur)
+			}
+
+		default:
+			return d.Errf("unknown redis storage option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Provision fills defaults, the server is dialed on first use
+func (s *RedisStorage) Provision(ctx caddy.Context) error {
+	if s.Address == "" {
+		s.Address = os.Getenv("CACHE_REDIS_ADDR")
+		if s.Address == "" {
+			s.Address = "localhost:6379"
+		}
+	}
+	if s.Password == "" {
+		s.Password = os.Getenv("CACHE_REDIS_PASSWORD")
+	}
+	if s.Prefix == "" {
+		s.Prefix = "wpcache:"
+	}
+	if s.Timeout == 0 {
+		s.Timeout = caddy.Duration(2 * time.Second)
+	}
+	if s.Grace == 0 {
+		s.Grace = caddy.Duration(24 * time.Hour)
+	}
+	if s.PoolSize == 0 {
+		s.PoolSize = 16
+	}
+	s.client = newRespClient(s.Address, s.Username, s.Password, s.DB, time.Duration(s.Timeout), s.PoolSize)
+	return nil
+}
+
+// Cleanup closes the idle connections
+func (s *RedisStorage) Cleanup() error {
+	s.client.close()
+	return nil
+}
+
+func (s *RedisStorage) entryKey(key string) string {
+	return s.Prefix + "e:" + key
+}
+
+func (s *RedisStorage) varyKey(key string) string {
+	return s.Prefix + "v:" + key
+}
+
+func (s *RedisStorage) tagKey(tag string) string {
+	return s.Prefix + "t:" + tag
+}
+
+// tagScript adds the key ARGV[1] to the tag sets in KEYS and keeps each set at
+// least until ARGV[2], a unix time, or forever when it is 0. ARGV[3] is now.
+// A set without a TTL already holds an entry that never expires.
+const tagScript = `
+local at, now = tonumber(ARGV[2]), tonumber(ARGV[3])
+for _, k in ipairs(KEYS) do
+	local ttl = redis.call('TTL', k)
+	redis.call('SADD', k, ARGV[1])
+	if at == 0 then
+		redis.call('PERSIST', k)
+	elseif ttl == -2 or (ttl >= 0 and now + ttl < at) then
+		redis.call('EXPIREAT', k, at)
+	end
+end
+return 0
+`
+
+// setScript writes the meta ARGV[2] and the body ARGV[4] of encoding ARGV[3] to the
+// hash KEYS[1], unless it holds a later render. ARGV[1] is the render, zero padded
+// so renders compare as strings, Lua numbers can't hold nanoseconds. A later render
+// than the stored one removes the bodies of the encodings in ARGV[6] onwards. ARGV[5]
+// is the unix time to expire the hash at, 0 for never. Returns 0 when the write lost.
+const setScript = `
+local cur = redis.call('HGET', KEYS[1], 'render') or ''
+if cur > ARGV[1] then
+	return 0
+end
+if cur < ARGV[1] and #ARGV > 5 then
+	redis.call('HDEL', KEYS[1], unpack(ARGV, 6))
+end
+redis.call('HSET', KEYS[1], 'render', ARGV[1], 'meta', ARGV[2], ARGV[3], ARGV[4])
+if ARGV[5] == '0' then
+	redis.call('PERSIST', KEYS[1])
+else
+	redis.call('EXPIREAT', KEYS[1], ARGV[5])
+end
+return 1
+`
+
+// setCmd writes the entry by setScript
+func (s *RedisStorage) setCmd(key, ce string, meta *CacheMeta, buf, value []byte) []any {
+	render := meta.Rendered
+	if render == 0 {
+		render = meta.Timestamp * int64(time.Second)
+	}
+	at := int64(0)
+	if meta.Expires > 0 {
+		at = meta.Expires + int64(time.Duration(s.Grace)/time.Second)
+	}
+	cmd := []any{"EVAL", setScript, int64(1), s.entryKey(key), fmt.Sprintf("%020d", render), buf, ce, value, at}
+	for _, other := range CachedContentEncoding {
+		if other != ce {
+			cmd = append(cmd, other)
+		}
+	}
+	return cmd
+}
+
+// tagCmd adds key to the sets of its tags, they expire with the last of their entries
+func (s *RedisStorage) tagCmd(key string, meta *CacheMeta) []any {
+	at := int64(0)
+	if meta.Expires > 0 {
+		at = meta.Expires + int64(time.Duration(s.Grace)/time.Second)
+	}
+	cmd := []any{"EVAL", tagScript, int64(len(meta.Tags))}
+	for _, tag := range meta.Tags {
+		cmd = append(cmd, s.tagKey(tag))
+	}
+	return append(cmd, key, at, time.Now().Unix())
+}
+
+// expireCmd sets the Redis TTL of rkey to Grace past expires, no TTL when expires is 0
+func (s *RedisStorage) expireCmd(rkey string, expires int64) []any {
+	if expires <= 0 {
+		return []any{"PERSIST", rkey}
+	}
+	return []any{"EXPIREAT", rkey, expires + int64(time.Duration(s.Grace)/time.Second)}
+}
+
+// multi runs the commands in a transaction, returning the first error reply
+func (s *RedisStorage) multi(cmds ...[]any) error {
+	_, err := s.multiReplies(cmds...)
+	return err
+}
+
+// multiReplies runs the commands in a transaction and returns their replies,
+// or the first error reply
+func (s *RedisStorage) multiReplies(cmds ...[]any) ([]any, error) {
+	cmds = append([][]any{{"MULTI"}}, append(cmds, []any{"EXEC"})...)
+	replies, err := s.client.pipe(cmds)
+	if err != nil {
+		return nil, err
+	}
+	for _, reply := range replies {
+		if e, ok := reply.(respError); ok {
+			return nil, e
+		}
+	}
+	results, _ := replies[len(replies)-1].([]any)
+	for _, reply := range results {
+		if e, ok := reply.(respError); ok {
+			return nil, e
+		}
+	}
+	return results, nil
+}
+
+func (s *RedisStorage) Get(key, ce string) (*CacheMeta, []byte, error) {
+	reply, err := s.client.do("HMGET", s.entryKey(key), "meta", ce)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields, _ := reply.([]any)
+	if len(fields) != 2 || fields[0] == nil || fields[1] == nil {
+		return nil, nil, ErrCacheNotFound
+	}
+	meta := &CacheMeta{}
+	if err := json.Unmarshal(fields[0].([]byte), meta); err != nil {
+		return nil, nil, err
+	}
+	return meta, fields[1].([]byte), nil
+}
+
+// Set writes the body and meta in one transaction, along with the vary fields
+// of the key, which expire with the entry written last, and its tags.
+// The meta and body are compared and set by setScript, so replicas writing
+// the same key can't leave an earlier render or its encodings behind.
+func (s *RedisStorage) Set(key, ce string, meta *CacheMeta, value []byte) error {
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	fields, _ := json.Marshal(meta.VaryFields())
+	vkey := s.varyKey(baseKey(key))
+	cmds := [][]any{
+		s.setCmd(key, ce, meta, buf, value),
+		{"SET", vkey, fields},
+		s.expireCmd(vkey, meta.Expires),
+	}
+	if len(meta.Tags) > 0 {
+		cmds = append(cmds, s.tagCmd(key, meta))
+	}
+	return s.multi(cmds...)
+}
+
+func (s *RedisStorage) Meta(key string) (*CacheMeta, error) {
+	reply, err := s.client.do("HGET", s.entryKey(key), "meta")
+	if err != nil {
+		return nil, err
+	}
+	buf, ok := reply.([]byte)
+	if !ok {
+		return nil, ErrCacheNotFound
+	}
+	meta := &CacheMeta{}
+	if err := json.Unmarshal(buf, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Expire rewrites the meta and moves the Redis TTL along
+func (s *RedisStorage) Expire(key string, expires int64) (int, error) {
+	meta, err := s.Meta(key)
+	if err != nil {
+		return 0, err
+	}
+	meta.softExpire(expires)
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return 0, err
+	}
+	rkey := s.entryKey(key)
+	if err := s.multi(
+		[]any{"HSET", rkey, "meta", buf},
+		s.expireCmd(rkey, expires),
+	); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// Delete removes the entry, and the vary fields when key is the base key, the
+// other variants are still found through them. It counts one per key.
+func (s *RedisStorage) Delete(key string) (int, error) {
+	cmd := []any{"DEL", s.entryKey(key)}
+	if baseKey(key) == key {
+		cmd = append(cmd, s.varyKey(key))
+	}
+	reply, err := s.client.do(cmd...)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := reply.(int64); n > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// scan returns the flattened keys of kind, "e:" or "v:", starting with prefix
+func (s *RedisStorage) scan(kind, prefix string) ([]string, error) {
+	pattern := s.Prefix + kind + globEscape(prefix) + "*"
+	strip := len(s.Prefix) + len(kind)
+
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := s.client.do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000)
+		if err != nil {
+			return nil, err
+		}
+		page, _ := reply.([]any)
+		if len(page) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply %v", reply)
+		}
+		next, _ := page[0].([]byte)
+		found, _ := page[1].([]any)
+		for _, k := range found {
+			if rkey, ok := k.([]byte); ok && len(rkey) >= strip {
+				keys = append(keys, string(rkey[strip:]))
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// remove deletes the entries and vary fields of keys matching, counting one per key
+func (s *RedisStorage) remove(prefix string, match func(key string) bool) (int, error) {
+	entries, err := s.scan("e:", prefix)
+	if err != nil {
+		return 0, err
+	}
+	varied, err := s.scan("v:", prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	seen := make(map[string]bool)
+	rkeys := make([]string, 0, len(entries)+len(varied))
+	for _, key := range entries {
+		if match(key) {
+			seen[key] = true
+			rkeys = append(rkeys, s.entryKey(key))
+		}
+	}
+	for _, key := range varied {
+		if match(key) {
+			seen[key] = true
+			rkeys = append(rkeys, s.varyKey(key))
+		}
+	}
+	if err := s.del(rkeys); err != nil {
+		return 0, err
+	}
+	return len(seen), nil
+}
+
+// del deletes the Redis keys, in pipelined batches
+func (s *RedisStorage) del(rkeys []string) error {
+	cmds := make([][]any, 0, len(rkeys)/500+1)
+	for len(rkeys) > 0 {
+		batch := rkeys[:min(len(rkeys), 500)]
+		rkeys = rkeys[len(batch):]
+		del := []any{"DEL"}
+		for _, rkey := range batch {
+			del = append(del, rkey)
+		}
+		cmds = append(cmds, del)
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	replies, err := s.client.pipe(cmds)
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if e, ok := reply.(respError); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *RedisStorage) Purge(prefix string, match func(key string) bool) (int, []PurgeError) {
+	n, err := s.remove(prefix, match)
+	if err != nil {
+		return n, []PurgeError{{Path: s.Prefix + prefix, Error: err.Error()}}
+	}
+	return n, nil
+}
+
+// Flush removes every entry, vary field and tag set under Prefix
+func (s *RedisStorage) Flush() (int, error) {
+	n, err := s.remove("", func(string) bool {
+		return true
+	})
+	if err != nil {
+		return n, err
+	}
+	tags, err := s.scan("t:", "")
+	if err != nil {
+		return n, err
+	}
+	for i, tag := range tags {
+		tags[i] = s.tagKey(tag)
+	}
+	return n, s.del(tags)
+}
+
+// Tagged reads the tag sets, and with remove drops them in the same transaction
+// so a key added meanwhile isn't lost. Members may be keys that expired since.
+func (s *RedisStorage) Tagged(tags []string, remove bool) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	cmds := make([][]any, 0, len(tags)+1)
+	del := []any{"DEL"}
+	for _, tag := range tags {
+		cmds = append(cmds, []any{"SMEMBERS", s.tagKey(tag)})
+		del = append(del, s.tagKey(tag))
+	}
+	if remove {
+		cmds = append(cmds, del)
+	}
+	replies, err := s.multiReplies(cmds...)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, 16)
+	for _, reply := range replies[:len(tags)] {
+		members, _ := reply.([]any)
+		for _, member := range members {
+			if key, ok := member.([]byte); ok {
+				keys = append(keys, string(key))
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (s *RedisStorage) List() (map[string][]string, error) {
+	keys, err := s.scan("e:", "")
+	if err != nil {
+		return nil, err
+	}
+
+	list := make(map[string][]string, len(keys))
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), 500)]
+		keys = keys[len(batch):]
+
+		cmds := make([][]any, len(batch))
+		for i, key := range batch {
+			cmds[i] = []any{"HKEYS", s.entryKey(key)}
+		}
+		replies, err := s.client.pipe(cmds)
+		if err != nil {
+			return nil, err
+		}
+		for i, reply := range replies {
+			fields, _ := reply.([]any)
+			for _, field := range fields {
+				if ce, ok := field.([]byte); ok && string(ce) != "meta" && string(ce) != "render" {
+					list[batch[i]] = append(list[batch[i]], string(ce))
+				}
+			}
+		}
+	}
+	return list, nil
+}
+
+func (s *RedisStorage) Vary(key string) ([]string, error) {
+	reply, err := s.client.do("GET", s.varyKey(key))
+	if err != nil {
+		return nil, err
+	}
+	buf, ok := reply.([]byte)
+	if !ok {
+		return nil, ErrCacheNotFound
+	}
+	fields := []string{}
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func (s *RedisStorage) SetVary(key string, fields []string) error {
+	buf, _ := json.Marshal(fields)
+	_, err := s.client.do("SET", s.varyKey(key), buf)
+	return err
+}
+
+// baseKey strips the variant from a flattened key, the extras are escaped
+// so a | past the last :: is the variant separator
+func baseKey(key string) string {
+	if i := strings.LastIndexByte(key, '|'); i > strings.LastIndex(key, "::") {
+		return key[:i]
+	}
+	return key
+}
+
+// globEscape escapes the characters SCAN MATCH patterns treat specially
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Interface guards
+var (
+	_ Storage               = (*RedisStorage)(nil)
+	_ TagIndex              = (*RedisStorage)(nil)
+	_ caddy.Provisioner     = (*RedisStorage)(nil)
+	_ caddy.CleanerUpper    = (*RedisStorage)(nil)
+	_ caddyfile.Unmarshaler = (*RedisStorage)(nil)
+)
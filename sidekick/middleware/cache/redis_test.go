@@ -0,0 +1,332 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/caddyserver/caddy/v2"
+)
+
+func newTestRedis(t *testing.T) (*RedisStorage, *miniredis.Miniredis) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	s := &RedisStorage{Address: m.Addr(), Grace: caddy.Duration(time.Hour)}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Cleanup() })
+	return s, m
+}
+
+func TestRedisGetSet(t *testing.T) {
+	s, m := newTestRedis(t)
+
+	if _, _, err := s.Get("+a::", "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Fatalf("Get of a missing key returned %v", err)
+	}
+
+	meta := testMeta()
+	meta.Expires = time.Now().Unix() + 60
+	if err := s.Set("+a::", "none", meta, []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("+a::", "gzip", meta, []byte("zipped")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, value, err := s.Get("+a::", "gzip")
+	if err != nil || string(value) != "zipped" || got.Expires != meta.Expires {
+		t.Fatalf("Get = %+v, %q, %v", got, value, err)
+	}
+	if _, _, err := s.Get("+a::", "br"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("Get of a missing encoding returned %v", err)
+	}
+
+	// Redis drops the entry Grace after it expires
+	if ttl := m.TTL("wpcache:e:+a::"); ttl < time.Hour || ttl > time.Hour+time.Minute {
+		t.Errorf("entry TTL %v, want an hour past its expiry", ttl)
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(list["+a::"])
+	if !slices.Equal(list["+a::"], []string{"gzip", "none"}) {
+		t.Errorf("List = %v", list)
+	}
+}
+
+func TestRedisSetDropsEncodingsOfEarlierRender(t *testing.T) {
+	s, _ := newTestRedis(t)
+	old := testMeta()
+	old.Timestamp -= 30
+	old.Expires = old.Timestamp + 60
+	if err := s.Set("+a::", "gzip", old, []byte("old zipped")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a refresh renders again before the entry expires
+	fresh := testMeta()
+	fresh.Expires = fresh.Timestamp + 60
+	if err := s.Set("+a::", "none", fresh, []byte("new plain")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Get("+a::", "gzip"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("gzip body of the earlier render still served, err %v", err)
+	}
+	if _, value, err := s.Get("+a::", "none"); err != nil || string(value) != "new plain" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+}
+
+func TestRedisSetKeepsLaterRender(t *testing.T) {
+	s, _ := newTestRedis(t)
+	older, later := testMeta("post-1"), testMeta("post-2")
+	if err := s.Set("+a::", "gzip", later, []byte("new zipped")); err != nil {
+		t.Fatal(err)
+	}
+
+	// another replica's earlier render lands last
+	if err := s.Set("+a::", "none", older, []byte("old plain")); err != nil {
+		t.Fatal(err)
+	}
+	meta, value, err := s.Get("+a::", "gzip")
+	if err != nil || string(value) != "new zipped" || !slices.Equal(meta.Tags, []string{"post-2"}) {
+		t.Errorf("Get = %+v, %q, %v, want the later render", meta, value, err)
+	}
+	if _, _, err := s.Get("+a::", "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("body of the earlier render stored, err %v", err)
+	}
+
+	// the later render filled in for another encoding is kept
+	if err := s.Set("+a::", "br", later, []byte("new brotli")); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := s.List()
+	slices.Sort(list["+a::"])
+	if !slices.Equal(list["+a::"], []string{"br", "gzip"}) {
+		t.Errorf("List = %v", list)
+	}
+}
+
+func TestRedisExpire(t *testing.T) {
+	s, m := newTestRedis(t)
+	if err := s.Set("+a::", "none", testMeta(), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if m.TTL("wpcache:e:+a::") != 0 {
+		t.Errorf("entry without expiry got a TTL")
+	}
+
+	expires := time.Now().Unix() - 10
+	if n, err := s.Expire("+a::", expires); n != 1 || err != nil {
+		t.Fatalf("Expire = %d, %v", n, err)
+	}
+	meta, err := s.Meta("+a::")
+	if err != nil || meta.Expires != expires {
+		t.Fatalf("Meta after Expire = %+v, %v", meta, err)
+	}
+	if _, value, _ := s.Get("+a::", "none"); string(value) != "a" {
+		t.Errorf("Expire dropped the body")
+	}
+	if ttl := m.TTL("wpcache:e:+a::"); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("expired entry TTL %v, want within the grace", ttl)
+	}
+}
+
+func TestRedisVary(t *testing.T) {
+	s, _ := newTestRedis(t)
+
+	if _, err := s.Vary("+a::"); !errors.Is(err, ErrCacheNotFound) {
+		t.Fatalf("Vary of an unknown key returned %v", err)
+	}
+	if err := s.SetVary("+a::", []string{"Cookie", "X-Lang"}); err != nil {
+		t.Fatal(err)
+	}
+	fields, err := s.Vary("+a::")
+	if err != nil || !slices.Equal(fields, []string{"Cookie", "X-Lang"}) {
+		t.Fatalf("Vary = %v, %v", fields, err)
+	}
+}
+
+func TestRedisPurgeFlush(t *testing.T) {
+	s, m := newTestRedis(t)
+	for _, key := range []string{"+blog+::", "+blog+a::", "+blog+b::|0011", "+shop+::", "+a*b::"} {
+		if err := s.Set(key, "none", testMeta(), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SetVary("+blog+b::", []string{"Cookie"})
+
+	n, errs := s.Purge("+blog+", PurgeSubtree.matcher("/blog/"))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if n != 4 {
+		t.Errorf("Purge counted %d, want 3 entries and a vary record", n)
+	}
+	for _, key := range []string{"+blog+::", "+blog+a::", "+blog+b::|0011"} {
+		if _, _, err := s.Get(key, "none"); !errors.Is(err, ErrCacheNotFound) {
+			t.Errorf("%s left after purging /blog/", key)
+		}
+	}
+	if _, err := s.Vary("+blog+b::"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("vary record left after purging /blog/")
+	}
+
+	// glob characters in the prefix are matched literally
+	if n, _ := s.Purge("+a*", PurgePrefix.matcher("/a*")); n != 1 {
+		t.Errorf("Purge of a glob prefix counted %d, want 1", n)
+	}
+	if _, _, err := s.Get("+shop+::", "none"); err != nil {
+		t.Errorf("unrelated entry purged: %v", err)
+	}
+
+	if n, err := s.Flush(); n != 1 || err != nil {
+		t.Errorf("Flush = %d, %v", n, err)
+	}
+	if keys := m.Keys(); len(keys) != 0 {
+		t.Errorf("keys left after Flush: %v", keys)
+	}
+}
+
+func TestRedisPrefixIsolation(t *testing.T) {
+	m := miniredis.RunT(t)
+	site := func(prefix string) *RedisStorage {
+		s := &RedisStorage{Address: m.Addr(), Prefix: prefix}
+		if err := s.Provision(caddy.Context{}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Cleanup() })
+		return s
+	}
+	a, b := site("a:"), site("b:")
+	a.Set("+x::", "none", testMeta(), []byte("a"))
+	b.Set("+x::", "none", testMeta(), []byte("b"))
+
+	if _, err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, value, err := b.Get("+x::", "none"); err != nil || string(value) != "b" {
+		t.Errorf("flushing one prefix touched the other: %q, %v", value, err)
+	}
+}
+
+func TestRedisTags(t *testing.T) {
+	s, m := newTestRedis(t)
+	s.Set("+a::", "none", testMeta("post-1", "home"), []byte("a"))
+	s.Set("+b::", "none", testMeta("post-2"), []byte("b"))
+
+	keys, err := s.Tagged([]string{"post-1", "post-2"}, false)
+	slices.Sort(keys)
+	if err != nil || !slices.Equal(keys, []string{"+a::", "+b::"}) {
+		t.Fatalf("Tagged = %v, %v", keys, err)
+	}
+
+	if keys, _ := s.Tagged([]string{"home"}, true); !slices.Equal(keys, []string{"+a::"}) {
+		t.Errorf("Tagged home = %v", keys)
+	}
+	if m.Exists("wpcache:t:home") {
+		t.Errorf("tag set left after removing it")
+	}
+
+	if _, err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := m.Keys(); len(keys) != 0 {
+		t.Errorf("keys left after Flush: %v", keys)
+	}
+}
+
+func TestRedisPurgeTagsAcrossReplicas(t *testing.T) {
+	shared, _ := newTestRedis(t)
+	replica := func() *Store {
+		return newTestStore(t, StoreOptions{Tiers: []Storage{NewMemoryStorage(0, 0), shared}})
+	}
+	a, b := replica(), replica()
+
+	if err := a.Set("/blog/post::", a.Generation(), http.Header{}, testMeta("post-1"), []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := shared.Get("+blog+post::", "none"); err != nil {
+		t.Fatalf("entry not written to Redis: %v", err)
+	}
+
+	// b never saw the entry, Redis tells it which keys carry the tag
+	b.PurgeTags([]string{"post-1"}, false)
+	if _, _, err := shared.Get("+blog+post::", "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("Redis holds the entry after a tag purge on another replica, err %v", err)
+	}
+}
+
+func TestRedisDeleteVariant(t *testing.T) {
+	s, _ := newTestRedis(t)
+	meta := testMeta()
+	meta.Header = [][]string{{"Vary", "Cookie"}}
+	for _, key := range []string{"+a::|0011", "+a::|0022"} {
+		if err := s.Set(key, "none", meta, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fields, err := s.Vary("+a::"); err != nil || !slices.Equal(fields, []string{"Cookie"}) {
+		t.Fatalf("Set wrote vary fields %v, %v", fields, err)
+	}
+
+	if n, err := s.Delete("+a::|0011"); n != 1 || err != nil {
+		t.Fatalf("Delete = %d, %v", n, err)
+	}
+	// the sibling is still found through the vary fields
+	if fields, err := s.Vary("+a::"); err != nil || !slices.Equal(fields, []string{"Cookie"}) {
+		t.Errorf("vary fields after deleting a variant %v, %v", fields, err)
+	}
+	if _, value, err := s.Get("+a::|0022", "none"); err != nil || string(value) != "+a::|0022" {
+		t.Errorf("sibling variant Get = %q, %v", value, err)
+	}
+
+	if _, err := s.Delete("+a::"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Vary("+a::"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("vary fields left after deleting the base key, err %v", err)
+	}
+}
+
+func TestRedisTagSetsExpire(t *testing.T) {
+	s, m := newTestRedis(t)
+	now := time.Now().Unix()
+	meta := func(expires int64) *CacheMeta {
+		meta := testMeta("post-1")
+		meta.Expires = expires
+		return meta
+	}
+
+	s.Set("+a::", "none", meta(now+2*3600), []byte("a"))
+	// a shorter lived entry doesn't shorten the set
+	s.Set("+b::", "none", meta(now+60), []byte("b"))
+	if ttl := m.TTL("wpcache:t:post-1"); ttl < 3*time.Hour-time.Minute || ttl > 3*time.Hour {
+		t.Fatalf("tag set TTL %v, want the longest entry plus the grace", ttl)
+	}
+
+	m.FastForward(time.Hour + 2*time.Minute)
+	if !m.Exists("wpcache:t:post-1") || m.Exists("wpcache:e:+b::") {
+		t.Fatalf("tag set or expired entry at the wrong time, keys %v", m.Keys())
+	}
+	m.FastForward(2 * time.Hour)
+	if keys := m.Keys(); len(keys) != 0 {
+		t.Errorf("keys left once every entry expired: %v", keys)
+	}
+
+	// an entry that never expires keeps its tag sets
+	s.Set("+c::", "none", meta(now+60), []byte("c"))
+	s.Set("+d::", "none", meta(0), []byte("d"))
+	s.Set("+e::", "none", meta(now+60), []byte("e"))
+	if ttl := m.TTL("wpcache:t:post-1"); ttl != 0 {
+		t.Errorf("tag set of an entry without expiry has TTL %v", ttl)
+	}
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// RefreshAhead re-renders hot entries in the background before they expire,
+// so popular pages never expire in front of a visitor
+type RefreshAhead struct {
+	// Fraction of the entry lifetime after which a hot entry is refreshed
+	Fraction float64
+	// MinHits an entry needs since it was stored to count as hot
+	MinHits int64
+	// Concurrency caps the refreshes running at once
+	Concurrency int
+
+	sem chan struct{}
+}
+
+// UnmarshalCaddyfile parses a refresh_ahead block:
+//
+//	refresh_ahead {
+//		fraction 0.8
+//		min_hits 10
+//		concurrency 4
+//	}
+func (ra *RefreshAhead) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return parseBlock(d, func(key string, args []string) error {
+		if len(args) != 1 {
+			return d.ArgErr()
+		}
+		var err error
+		switch key {
+		case "fraction":
+			ra.Fraction, err = strconv.ParseFloat(args[0], 64)
+			if err == nil && (ra.Fraction <= 0 || ra.Fraction >= 1) {
+				return d.Errf("refresh_ahead fraction must be between 0 and 1, got %s", args[0])
+			}
+
+		case "min_hits":
+			ra.MinHits, err = strconv.ParseInt(args[0], 10, 64)
+
+		case "concurrency":
+			ra.Concurrency, err = strconv.Atoi(args[0])
+
+		default:
+			return d.Errf("unknown refresh_ahead option '%s'", key)
+		}
+		if err != nil {
+			return d.Errf("invalid refresh_ahead %s '%s'", key, args[0])
+		}
+		return nil
+	})
+}
+
+// Provision fills the defaults
+func (ra *RefreshAhead) Provision() {
+	if ra.Fraction <= 0 || ra.Fraction >= 1 {
+		ra.Fraction = 0.8
+	}
+	if ra.MinHits <= 0 {
+		ra.MinHits = 10
+	}
+	if ra.Concurrency <= 0 {
+		ra.Concurrency = 4
+	}
+	ra.sem = make(chan struct{}, ra.Concurrency)
+}
+
+// refreshAhead renders the key again in the background, unless the same key is
+// already being refreshed or the concurrency cap is reached. It is retried on a later hit then.
+func (c *Cache) refreshAhead(cacheKey string, r *http.Request, next caddyhttp.Handler) {
+	ra := c.RefreshAhead
+	select {
+	case ra.sem <- struct{}{}:
+	default:
+		return
+	}
+	if _, running := c.refreshing.LoadOrStore(cacheKey, struct{}{}); running {
+		<-ra.sem
+		return
+	}
+
+	r = r.Clone(context.Background())
+	go func() {
+		defer func() {
+			c.refreshing.Delete(cacheKey)
+			<-ra.sem
+		}()
+		c.doCache(r, next)
+	}()
+}
@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// hitEntry stores an entry of age seconds under key and reads it hits times
+func hitEntry(t *testing.T, d *Store, key string, age, expires, hits int64) *CacheMeta {
+	t.Helper()
+	meta := testMeta()
+	meta.Timestamp -= age
+	if expires > 0 {
+		meta.Expires = meta.Timestamp + expires
+	}
+	if err := d.Set(key, d.Generation(), http.Header{}, meta, []byte(key)); err != nil {
+		t.Fatal(err)
+	}
+	for range hits {
+		if _, _, err := d.Get(key, http.Header{}, "none"); err != nil {
+			t.Fatalf("Get %s: %v", key, err)
+		}
+	}
+	return meta
+}
+
+func TestRefreshDue(t *testing.T) {
+	d := newTestStore(t, StoreOptions{TTL: 100, RefreshAheadFraction: 0.8, RefreshAheadHits: 2})
+	due := func(key string, meta *CacheMeta) bool {
+		return d.RefreshDue(key, http.Header{}, meta)
+	}
+
+	if due("/a/::", hitEntry(t, d, "/a/::", 90, 0, 1)) {
+		t.Error("entry below min hits is due")
+	}
+	if !due("/b/::", hitEntry(t, d, "/b/::", 90, 0, 2)) {
+		t.Error("hot entry past the fraction isn't due")
+	}
+	if due("/c/::", hitEntry(t, d, "/c/::", 50, 0, 5)) {
+		t.Error("hot entry before the fraction is due")
+	}
+
+	// the origin expiry counts over the TTL
+	if !due("/d/::", hitEntry(t, d, "/d/::", 50, 60, 5)) {
+		t.Error("hot entry past the fraction of its origin lifetime isn't due")
+	}
+
+	// a new render starts counting over
+	if due("/b/::", hitEntry(t, d, "/b/::", 89, 0, 1)) {
+		t.Error("hits of the previous render count for a new one")
+	}
+
+	never := newTestStore(t, StoreOptions{RefreshAheadFraction: 0.8})
+	if never.RefreshDue("/a/::", http.Header{}, hitEntry(t, never, "/a/::", 1e6, 0, 100)) {
+		t.Error("entry that never expires is due")
+	}
+	off := newTestStore(t, StoreOptions{TTL: 100})
+	if off.RefreshDue("/a/::", http.Header{}, hitEntry(t, off, "/a/::", 99, 0, 100)) {
+		t.Error("entry is due with refresh-ahead off")
+	}
+}
+
+func TestRefreshDueWithoutMemory(t *testing.T) {
+	// every Get decodes a new meta from disk, the store counts the hits
+	d := newTestStore(t, StoreOptions{
+		TTL:                  100,
+		RefreshAheadFraction: 0.8,
+		RefreshAheadHits:     3,
+		Tiers:                []Storage{NewFileStorage(t.TempDir())},
+	})
+	meta := hitEntry(t, d, "/a/::", 90, 0, 2)
+	if d.RefreshDue("/a/::", http.Header{}, meta) {
+		t.Error("entry below min hits is due")
+	}
+	_, meta, _ = d.Get("/a/::", http.Header{}, "none")
+	if !d.RefreshDue("/a/::", http.Header{}, meta) {
+		t.Error("hot entry read from disk isn't due")
+	}
+}
+
+func TestRefreshHitsConcurrent(t *testing.T) {
+	d := newTestStore(t, StoreOptions{TTL: 100})
+	// the first hits of a render race to start its count
+	for i := range 50 {
+		key := fmt.Sprintf("+%d+::", i)
+		meta := testMeta()
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				d.hit(key, meta)
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if n := d.hitsOf(key, meta); n != 20 {
+			t.Fatalf("counted %d of 20 concurrent hits of %s", n, key)
+		}
+	}
+}
+
+func TestRefreshAheadOnHit(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, RefreshAhead: &RefreshAhead{Fraction: 0.5, MinHits: 1}, CacheResponseCodes: []string{"2"}})
+	meta := testMeta()
+	meta.Timestamp -= 40
+	meta.Expires = meta.Timestamp + 60
+	if err := c.Store.Set("/a/::", c.Store.Generation(), http.Header{}, meta, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Write([]byte("new"))
+		return nil
+	})
+	if w := serveGet(c, next, "/a/"); w.Header().Get(c.CacheHeaderName) != "HIT" || w.Body.String() != "old" {
+		t.Errorf("hot entry answered %s %q, want the cached entry", w.Header().Get(c.CacheHeaderName), w.Body.String())
+	}
+	waitFor(t, "the entry to be refreshed ahead", func() bool {
+		value, _, err := c.Store.Get("/a/::", http.Header{}, "none")
+		return err == nil && string(value) == "new"
+	})
+}
+
+func TestRefreshAheadConcurrency(t *testing.T) {
+	c := newTestCache(t, &Cache{TTL: 60, RefreshAhead: &RefreshAhead{Concurrency: 1}, CacheResponseCodes: []string{"2"}})
+	var renders atomic.Int32
+	release := make(chan struct{})
+	next := slowOrigin(&renders, release)
+
+	c.refreshAhead("/a/::", httptest.NewRequest("GET", "/a/", nil), next)
+	waitFor(t, "the refresh to start", func() bool { return renders.Load() == 1 })
+	// over the cap, and the same key again
+	c.refreshAhead("/b/::", httptest.NewRequest("GET", "/b/", nil), next)
+	c.refreshAhead("/a/::", httptest.NewRequest("GET", "/a/", nil), next)
+	close(release)
+
+	waitFor(t, "the refresh to finish", func() bool { return c.refreshing.Size() == 0 && len(c.RefreshAhead.sem) == 0 })
+	time.Sleep(20 * time.Millisecond)
+	if n := renders.Load(); n != 1 {
+		t.Errorf("%d refreshes ran, want 1 with concurrency 1", n)
+	}
+}
@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// respError is an error reply of the server
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// respClient speaks the Redis protocol (RESP2) to one server, keeping a pool
+// of idle connections. Commands are sent as arrays of bulk strings.
+type respClient struct {
+	addr     string
+	username string
+	password string
+	db       int
+	timeout  time.Duration
+
+	idle chan *respConn
+}
+
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newRespClient(addr, username, password string, db int, timeout time.Duration, poolSize int) *respClient {
+	return &respClient{
+		addr:     addr,
+		username: username,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+		idle:     make(chan *respConn, poolSize),
+	}
+}
+
+// do sends one command and returns its reply
+func (c *respClient) do(args ...any) (any, error) {
+	replies, err := c.pipe([][]any{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(respError); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// pipe sends the commands in one write and reads their replies, error replies
+// are returned in place as respError
+func (c *respClient) pipe(cmds [][]any) ([]any, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	replies, err := conn.pipe(cmds)
+	if err != nil {
+		// the stream may be out of step, don't reuse it
+		conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return replies, nil
+}
+
+func (c *respClient) get() (*respConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &respConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	var hello [][]any
+	if c.password != "" {
+		if c.username != "" {
+			hello = append(hello, []any{"AUTH", c.username, c.password})
+		} else {
+			hello = append(hello, []any{"AUTH", c.password})
+		}
+	}
+	if c.db != 0 {
+		hello = append(hello, []any{"SELECT", c.db})
+	}
+	if len(hello) > 0 {
+		replies, err := conn.pipe(hello)
+		if err == nil {
+			for _, reply := range replies {
+				if e, ok := reply.(respError); ok {
+					err = e
+					break
+				}
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *respClient) put(conn *respConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// close closes the idle connections
+func (c *respClient) close() {
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (conn *respConn) pipe(cmds [][]any) ([]any, error) {
+	for _, args := range cmds {
+		fmt.Fprintf(conn.w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			var buf []byte
+			switch v := arg.(type) {
+			case []byte:
+				buf = v
+			case string:
+				buf = []byte(v)
+			case int:
+				buf = strconv.AppendInt(nil, int64(v), 10)
+			case int64:
+				buf = strconv.AppendInt(nil, v, 10)
+			default:
+				return nil, fmt.Errorf("unsupported argument type %T", arg)
+			}
+			fmt.Fprintf(conn.w, "$%d\r\n", len(buf))
+			conn.w.Write(buf)
+			conn.w.WriteString("\r\n")
+		}
+	}
+	if err := conn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	for i := range cmds {
+		reply, err := conn.read()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// read returns a reply as string, respError, int64, []byte or []any,
+// nil bulk strings and arrays as nil
+func (conn *respConn) read() (any, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return respError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		list := make([]any, n)
+		for i := range list {
+			if list[i], err = conn.read(); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("unknown reply type '%c'", kind)
+}
@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// readReply parses a raw server reply
+func readReply(raw string) (any, error) {
+	conn := &respConn{r: bufio.NewReader(strings.NewReader(raw))}
+	return conn.read()
+}
+
+func TestRespRead(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want any
+	}{
+		{"+OK\r\n", "OK"},
+		{"-ERR wrong type\r\n", respError("ERR wrong type")},
+		{":42\r\n", int64(42)},
+		{":-1\r\n", int64(-1)},
+		{"$5\r\nhello\r\n", []byte("hello")},
+		{"$0\r\n\r\n", []byte{}},
+		{"$7\r\nline\r\nx\r\n", []byte("line\r\nx")},
+		{"$-1\r\n", nil},
+		{"*-1\r\n", nil},
+		{"*0\r\n", []any{}},
+		{"*3\r\n$1\r\na\r\n$-1\r\n:7\r\n", []any{[]byte("a"), nil, int64(7)}},
+		{"*2\r\n$1\r\n0\r\n*2\r\n$1\r\nx\r\n$1\r\ny\r\n", []any{[]byte("0"), []any{[]byte("x"), []byte("y")}}},
+	}
+	for _, tt := range tests {
+		got, err := readReply(tt.raw)
+		if err != nil {
+			t.Errorf("read %q: %v", tt.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("read %q = %#v, want %#v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestRespReadMalformed(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"+OK\n",
+		"?what\r\n",
+		":nan\r\n",
+		"$5\r\nhel",
+		"*2\r\n$1\r\na\r\n",
+	} {
+		if _, err := readReply(raw); err == nil {
+			t.Errorf("read %q succeeded", raw)
+		}
+	}
+}
+
+func newTestRespClient(t *testing.T, m *miniredis.Miniredis, username, password string, db int) *respClient {
+	t.Helper()
+	c := newRespClient(m.Addr(), username, password, db, time.Second, 2)
+	t.Cleanup(c.close)
+	return c
+}
+
+func TestRespPipe(t *testing.T) {
+	m := miniredis.RunT(t)
+	c := newTestRespClient(t, m, "", "", 0)
+
+	replies, err := c.pipe([][]any{
+		{"SET", "a", []byte("1")},
+		{"INCRBY", "a", int64(41)},
+		{"HSET", "h", "f", "v"},
+		{"GET", "a"},
+		{"GET", "missing"},
+		{"LPUSH", "h", "x"},
+		{"HGETALL", "h"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{
+		"OK",
+		int64(42),
+		int64(1),
+		[]byte("42"),
+		nil,
+		respError("WRONGTYPE Operation against a key holding the wrong kind of value"),
+		[]any{[]byte("f"), []byte("v")},
+	}
+	if !reflect.DeepEqual(replies, want) {
+		t.Fatalf("pipe replies %#v, want %#v", replies, want)
+	}
+
+	// do returns error replies as errors
+	if _, err := c.do("LPUSH", "h", "x"); err == nil {
+		t.Errorf("do returned no error for an error reply")
+	}
+	if _, err := c.do("SET", "a", 1.5); err == nil {
+		t.Errorf("do sent an unsupported argument type")
+	}
+}
+
+func TestRespAuthSelect(t *testing.T) {
+	m := miniredis.RunT(t)
+	m.RequireUserAuth("cache", "secret")
+
+	c := newTestRespClient(t, m, "cache", "secret", 3)
+	if _, err := c.do("SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	m.Select(3)
+	if got, _ := m.Get("k"); got != "v" {
+		t.Errorf("key written to db 3 = %q", got)
+	}
+	m.Select(0)
+	if m.Exists("k") {
+		t.Errorf("key written to db 0")
+	}
+
+	wrong := newTestRespClient(t, m, "cache", "wrong", 0)
+	if _, err := wrong.do("PING"); err == nil {
+		t.Errorf("wrong password accepted")
+	}
+
+	m2 := miniredis.RunT(t)
+	m2.RequireAuth("secret")
+	legacy := newTestRespClient(t, m2, "", "secret", 0)
+	if reply, err := legacy.do("PING"); err != nil || reply != "PONG" {
+		t.Errorf("password only auth: %v, %v", reply, err)
+	}
+}
+
+func TestRespPoolReuse(t *testing.T) {
+	m := miniredis.RunT(t)
+	c := newTestRespClient(t, m, "", "", 0)
+
+	for i := 0; i < 5; i++ {
+		if _, err := c.do("PING"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := m.TotalConnectionCount(); n != 1 {
+		t.Errorf("sequential commands opened %d connections, want 1", n)
+	}
+
+	// more connections than the pool keeps, the extra ones are closed when put back
+	conns := make([]*respConn, 4)
+	for i := range conns {
+		conn, err := c.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn
+	}
+	for _, conn := range conns {
+		c.put(conn)
+	}
+	if n := len(c.idle); n != 2 {
+		t.Errorf("pool keeps %d idle connections, want 2", n)
+	}
+
+	c.close()
+	if n := len(c.idle); n != 0 {
+		t.Errorf("close left %d idle connections", n)
+	}
+}
+
+func TestRespBrokenConnNotReused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// a reply cut short
+			conn.Write([]byte("$10\r\nshort"))
+			conn.Close()
+		}
+	}()
+
+	c := newRespClient(ln.Addr().String(), "", "", 0, time.Second, 2)
+	if _, err := c.do("GET", "k"); err == nil {
+		t.Fatal("truncated reply accepted")
+	}
+	if n := len(c.idle); n != 0 {
+		t.Errorf("broken connection put back in the pool")
+	}
+}
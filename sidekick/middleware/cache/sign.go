@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+var (
+	ErrPurgeNoKey        = errors.New("purge is disabled, no purge key is configured")
+	ErrPurgeUnsigned     = errors.New("purge request is not signed")
+	ErrPurgeBadSignature = errors.New("purge signature does not match")
+	ErrPurgeSkew         = errors.New("purge timestamp is outside the allowed clock skew")
+	ErrPurgeReplay       = errors.New("purge signature was already used")
+	ErrPurgeTooLarge     = errors.New("purge body is too large")
+)
+
+// SignPurge returns the signature header value for a purge request, "t=<unix>,n=<nonce>,s=<hex>".
+// It is an HMAC-SHA256 over the timestamp, a random nonce, method, request URI and body,
+// the nonce keeps two identical purges in the same second from looking like a replay.
+func SignPurge(key, method, requestURI string, body []byte, ts time.Time) string {
+	unix := strconv.FormatInt(ts.Unix(), 10)
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	nonce := hex.EncodeToString(buf)
+	sig := purgeMAC([]byte(key), unix, nonce, method, requestURI, body)
+	return "t=" + unix + ",n=" + nonce + ",s=" + hex.EncodeToString(sig)
+}
+
+func purgeMAC(key []byte, unix, nonce, method, requestURI string, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, unix+"\n"+nonce+"\n"+method+"\n"+requestURI+"\n")
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// signature is a parsed purge signature header
+type signature struct {
+	unix  string
+	ts    int64
+	nonce string
+	sig   []byte
+}
+
+// parseSignature splits a "t=<unix>,n=<nonce>,s=<hex>" header value
+func parseSignature(value string) (*signature, error) {
+	s := &signature{}
+	for _, part := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "t":
+			s.unix = arg
+		case "n":
+			s.nonce = arg
+		case "s":
+			s.sig, _ = hex.DecodeString(arg)
+		}
+	}
+	ts, err := strconv.ParseInt(s.unix, 10, 64)
+	if err != nil || len(s.sig) == 0 {
+		return nil, ErrPurgeUnsigned
+	}
+	s.ts = ts
+	return s, nil
+}
+
+// requestURI is the URI the client sent, before any rewrite by earlier handlers
+func requestURI(r *http.Request) string {
+	if orig, ok := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok && orig.RequestURI != "" {
+		return orig.RequestURI
+	}
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+// verifyPurge checks the signature of a purge request against every one of keys,
+// so requests signed with an old key keep working while keys rotate.
+// The body is read and put back for the handler.
+func (c *Cache) verifyPurge(r *http.Request, keys [][]byte) error {
+	if len(keys) == 0 {
+		return ErrPurgeNoKey
+	}
+
+	s, err := parseSignature(r.Header.Get(c.PurgeKeyHeader))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	skew := time.Duration(c.PurgeSkew)
+	if d := now.Sub(time.Unix(s.ts, 0)); d > skew || d < -skew {
+		return ErrPurgeSkew
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, purgeBodyMaxSize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > purgeBodyMaxSize {
+		return ErrPurgeTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	uri := requestURI(r)
+	valid := false
+	for _, key := range keys {
+		// keep comparing after a match so the time doesn't tell which key it was
+		if hmac.Equal(s.sig, purgeMAC(key, s.unix, s.nonce, r.Method, uri, body)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return ErrPurgeBadSignature
+	}
+
+	// a signature is only good once within the skew window
+	seen := string(s.sig)
+	if _, loaded := c.purgeSeen.LoadOrStore(seen, s.ts); loaded {
+		return ErrPurgeReplay
+	}
+	c.purgeSeen.Range(func(k string, t int64) bool {
+		if now.Sub(time.Unix(t, 0)) > skew {
+			c.purgeSeen.Delete(k)
+		}
+		return true
+	})
+	return nil
+}
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/puzpuzpuz/xsync"
+)
+
+const testPurgeHeader = "X-WPSidekick-Purge-Key"
+
+func newSignCache() *Cache {
+	return &Cache{
+		PurgeKeyHeader: testPurgeHeader,
+		PurgeSkew:      caddy.Duration(5 * time.Minute),
+		purgeSeen:      xsync.NewMapOf[int64](),
+	}
+}
+
+// signedRequest returns a request carrying sig, the body defaults to none
+func signedRequest(method, uri, body, sig string) *http.Request {
+	r := httptest.NewRequest(method, uri, strings.NewReader(body))
+	if sig != "" {
+		r.Header.Set(testPurgeHeader, sig)
+	}
+	return r
+}
+
+func TestVerifyPurge(t *testing.T) {
+	const uri = "/__wp_cache/purge/blog/?mode=exact"
+	const body = `{"urls":["/blog/"]}`
+	key := []byte("secret")
+	now := time.Now()
+	sign := func(key, method, uri, body string, ts time.Time) string {
+		return SignPurge(key, method, uri, []byte(body), ts)
+	}
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		keys [][]byte
+		want error
+	}{
+		{"signed", signedRequest("POST", uri, body, sign("secret", "POST", uri, body, now)), [][]byte{key}, nil},
+		{"no key configured", signedRequest("POST", uri, body, sign("secret", "POST", uri, body, now)), nil, ErrPurgeNoKey},
+		{"unsigned", signedRequest("POST", uri, body, ""), [][]byte{key}, ErrPurgeUnsigned},
+		{"garbled", signedRequest("POST", uri, body, "t=now,s=zz"), [][]byte{key}, ErrPurgeUnsigned},
+		{"wrong key", signedRequest("POST", uri, body, sign("other", "POST", uri, body, now)), [][]byte{key}, ErrPurgeBadSignature},
+		{"tampered body", signedRequest("POST", uri, `{"urls":["/"]}`, sign("secret", "POST", uri, body, now)), [][]byte{key}, ErrPurgeBadSignature},
+		{"tampered uri", signedRequest("POST", "/__wp_cache/purge/?mode=prefix", body, sign("secret", "POST", uri, body, now)), [][]byte{key}, ErrPurgeBadSignature},
+		{"tampered method", signedRequest("GET", uri, body, sign("secret", "POST", uri, body, now)), [][]byte{key}, ErrPurgeBadSignature},
+		{"too old", signedRequest("POST", uri, body, sign("secret", "POST", uri, body, now.Add(-6*time.Minute))), [][]byte{key}, ErrPurgeSkew},
+		{"from the future", signedRequest("POST", uri, body, sign("secret", "POST", uri, body, now.Add(6*time.Minute))), [][]byte{key}, ErrPurgeSkew},
+		{"old key while rotating", signedRequest("POST", uri, body, sign("previous", "POST", uri, body, now)), [][]byte{key, []byte("previous")}, nil},
+		{"too large", signedRequest("POST", uri, strings.Repeat("a", purgeBodyMaxSize+1), sign("secret", "POST", uri, "", now)), [][]byte{key}, ErrPurgeTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := newSignCache().verifyPurge(tt.req, tt.keys); !errors.Is(err, tt.want) {
+				t.Fatalf("verifyPurge = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyPurgeKeepsBody(t *testing.T) {
+	const body = `{"tags":["home"]}`
+	r := signedRequest("POST", "/__wp_cache/purge/", body, SignPurge("secret", "POST", "/__wp_cache/purge/", []byte(body), time.Now()))
+	if err := newSignCache().verifyPurge(r, [][]byte{[]byte("secret")}); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := io.ReadAll(r.Body); string(buf) != body {
+		t.Errorf("body after verifying %q", buf)
+	}
+}
+
+func TestVerifyPurgeReplay(t *testing.T) {
+	c := newSignCache()
+	keys := [][]byte{[]byte("secret")}
+	sig := SignPurge("secret", "POST", "/__wp_cache/purge/", nil, time.Now())
+
+	if err := c.verifyPurge(signedRequest("POST", "/__wp_cache/purge/", "", sig), keys); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.verifyPurge(signedRequest("POST", "/__wp_cache/purge/", "", sig), keys); !errors.Is(err, ErrPurgeReplay) {
+		t.Fatalf("replayed signature returned %v", err)
+	}
+
+	// the same purge signed again gets a new nonce
+	again := SignPurge("secret", "POST", "/__wp_cache/purge/", nil, time.Now())
+	if err := c.verifyPurge(signedRequest("POST", "/__wp_cache/purge/", "", again), keys); err != nil {
+		t.Fatalf("identical purge signed again returned %v", err)
+	}
+}
+
+func TestVerifyPurgeForgetsOldSignatures(t *testing.T) {
+	c := newSignCache()
+	old := time.Now().Add(-10 * time.Minute).Unix()
+	for _, sig := range []string{"a", "b", "c"} {
+		c.purgeSeen.Store(sig, old)
+	}
+
+	sig := SignPurge("secret", "POST", "/__wp_cache/purge/", nil, time.Now())
+	if err := c.verifyPurge(signedRequest("POST", "/__wp_cache/purge/", "", sig), [][]byte{[]byte("secret")}); err != nil {
+		t.Fatal(err)
+	}
+	// signatures past the skew are dropped, their timestamp already refuses a replay
+	if n := c.purgeSeen.Size(); n != 1 {
+		t.Errorf("purgeSeen holds %d signatures, want only the new one", n)
+	}
+}
+
+func TestListKeyCantPurge(t *testing.T) {
+	c := newTestCache(t, &Cache{Zone: "sign-list", TTL: 60, PurgeKey: "purge", ListKey: "list"})
+	uri := c.PurgePath + "/"
+
+	serve := func(method, key string) int {
+		r := signedRequest(method, uri, "", SignPurge(key, method, uri, nil, time.Now()))
+		w := httptest.NewRecorder()
+		c.servePurge(w, r)
+		return w.Code
+	}
+	if code := serve("POST", "list"); code != http.StatusForbidden {
+		t.Errorf("purge with the list key answered %d, want 403", code)
+	}
+	if code := serve("GET", "list"); code != http.StatusOK {
+		t.Errorf("list with the list key answered %d, want 200", code)
+	}
+	if code := serve("GET", "purge"); code != http.StatusOK {
+		t.Errorf("list with the purge key answered %d, want 200", code)
+	}
+}
+
+// TestReadmeSignature signs a batch the way the README shows with openssl
+func TestReadmeSignature(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not installed")
+	}
+	const uri = "/__wp_cache/purge/?sync=1"
+	const body = `{"tags":["post-42"]}`
+	cmd := exec.Command("sh", "-c", `t=$(date +%s); n=$(openssl rand -hex 8)
+s=$(printf '%s\n%s\n%s\n%s\n%s' "$t" "$n" POST "$uri" "$body" | openssl dgst -sha256 -hmac "$PURGE_KEY" -hex | cut -d' ' -f2)
+printf 't=%s,n=%s,s=%s' "$t" "$n" "$s"`)
+	cmd.Env = append(cmd.Environ(), "uri="+uri, "body="+body, "PURGE_KEY=secret")
+	sig, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := signedRequest("POST", uri, body, string(bytes.TrimSpace(sig)))
+	if err := newSignCache().verifyPurge(r, [][]byte{[]byte("secret")}); err != nil {
+		t.Fatalf("README signature %s refused: %v", sig, err)
+	}
+}
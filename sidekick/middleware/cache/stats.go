@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"slices"
+	"strings"
+)
+
+// StoreStats is a snapshot of the store size and state
+type StoreStats struct {
+	MemCount    int    `json:"mem_count"`
+	MemSize     int    `json:"mem_size"`
+	MemMaxCount int    `json:"mem_max_count"`
+	MemMaxSize  int    `json:"mem_max_size"`
+	DiskCount   int    `json:"disk_count"`
+	Tags        int    `json:"tags"`
+	Generation  uint64 `json:"generation"`
+}
+
+// Stats returns the sizes of the memory tier and how many keys the tiers behind it hold
+func (d *Store) Stats() StoreStats {
+	stats := StoreStats{
+		Tags:       d.getTags().Size(),
+		Generation: d.Generation(),
+	}
+	for _, t := range d.tiers {
+		if m, ok := t.Storage.(*MemoryStorage); ok {
+			stats.MemCount += m.Size()
+			stats.MemSize += m.Cost()
+			stats.MemMaxCount += m.MaxCount
+			stats.MemMaxSize += m.MaxSize
+			continue
+		}
+		keys, _ := t.List()
+		stats.DiskCount += len(keys)
+	}
+	return stats
+}
+
+// EntryInfo describes a cached entry, one per flattened key and variant
+type EntryInfo struct {
+	Key string `json:"key"`
+	// Encodings are the content encodings stored on disk, Memory those held in memory
+	Encodings []string   `json:"encodings"`
+	Memory    []string   `json:"memory"`
+	Status    int        `json:"status"`
+	Header    [][]string `json:"header"`
+	Created   int64      `json:"created"`
+	Expires   int64      `json:"expires"`
+	Tags      []string   `json:"tags"`
+	Hits      int64      `json:"hits"`
+}
+
+// Entries returns every entry cached for the request path, in every variant
+func (d *Store) Entries(reqPath string) []*EntryInfo {
+	match := PurgeExact.matcher(reqPath)
+	entries := make(map[string]*EntryInfo)
+	entry := func(key string, meta *CacheMeta) *EntryInfo {
+		info, ok := entries[key]
+		if !ok {
+			info = &EntryInfo{
+				Key:       key,
+				Encodings: []string{},
+				Memory:    []string{},
+				Status:    meta.StateCode,
+				Header:    meta.Header,
+				Created:   meta.Timestamp,
+				Expires:   d.expiresAt(meta),
+				Tags:      meta.Tags,
+				Hits:      d.hitsOf(key, meta),
+			}
+			entries[key] = info
+		}
+		return info
+	}
+
+	for _, t := range d.tiers {
+		if m, ok := t.Storage.(*MemoryStorage); ok {
+			m.rangeItems(func(key, ce string, item *MemCacheItem) bool {
+				if match(key) {
+					info := entry(key, item.CacheMeta)
+					info.Memory = append(info.Memory, ce)
+				}
+				return true
+			})
+			continue
+		}
+
+		keys, _ := t.List()
+		for key, encodings := range keys {
+			if !match(key) {
+				continue
+			}
+			meta, err := t.Meta(key)
+			if err != nil {
+				continue
+			}
+			info := entry(key, meta)
+			info.Encodings = appendNew(info.Encodings, encodings)
+		}
+	}
+
+	list := make([]*EntryInfo, 0, len(entries))
+	for _, info := range entries {
+		list = append(list, info)
+	}
+	slices.SortFunc(list, func(a, b *EntryInfo) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return list
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Storage is a tier of the store. Entries are stored by flattened key, the
+// path with / replaced by + and the variant appended, with one body per
+// content encoding. Backends are Caddy modules in the
+// http.handlers.wp_cache.storage namespace, the store tries its tiers in
+// order and fills the faster ones from the slower ones on a hit.
+type Storage interface {
+	// Get returns the meta and body of the entry in content encoding ce,
+	// ErrCacheNotFound if there is none
+	Get(key, ce string) (*CacheMeta, []byte, error)
+	// Set stores the body of the entry in content encoding ce along with its meta
+	Set(key, ce string, meta *CacheMeta, value []byte) error
+	// Meta returns the newest meta of the entry, ErrCacheNotFound if there is none
+	Meta(key string) (*CacheMeta, error)
+	// Expire soft purges the entry in every content encoding, setting its expiry
+	// and keeping the bodies, returning how many it changed in the unit the tier counts in
+	Expire(key string, expires int64) (int, error)
+	// Delete removes the entry in every content encoding, returning how many
+	// it removed in the unit the tier counts in
+	Delete(key string) (int, error)
+	// Purge removes the entries whose key matches. Every matching key
+	// starts with prefix, so backends may scan only that range.
+	Purge(prefix string, match func(key string) bool) (int, []PurgeError)
+	// Flush removes every entry, returning how many it removed
+	Flush() (int, error)
+	// List returns the stored keys with their content encodings
+	List() (map[string][]string, error)
+	// Vary returns the header names the entries of the unvaried key vary on,
+	// ErrCacheNotFound if it doesn't know the key
+	Vary(key string) ([]string, error)
+	// SetVary records the header names the entries of the unvaried key vary on
+	SetVary(key string, fields []string) error
+}
+
+// TagIndex is implemented by backends shared between replicas that index tags
+// themselves, so a tag purge finds the entries other replicas wrote
+type TagIndex interface {
+	// Tagged returns the flattened keys of the entries carrying any of the tags,
+	// with remove the tags are dropped from the index
+	Tagged(tags []string, remove bool) ([]string, error)
+}
+
+// tier is a Storage with the name the store reports it under
+type tier struct {
+	Storage
+	name string
+}
+
+// newTier names the backend after its module, memory is "mem" and file "disk"
+// to keep the names the store always reported
+func newTier(s Storage) tier {
+	name := "storage"
+	if mod, ok := s.(caddy.Module); ok {
+		name = mod.CaddyModule().ID.Name()
+	}
+	switch name {
+	case "memory":
+		name = "mem"
+	case "file":
+		name = "disk"
+	}
+	return tier{Storage: s, name: name}
+}
+
+// keyPrefix returns the longest prefix of flattened keys a path purge can match
+func keyPrefix(reqPath string, mode PurgeMode) string {
+	flat := strings.ReplaceAll(reqPath, "/", "+")
+	if mode == PurgeSubtree {
+		return strings.TrimSuffix(flat, "+")
+	}
+	return flat
+}
+
+// commonPrefix returns the longest prefix shared by a and b
+func commonPrefix(a, b string) string {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return a[:i]
+		}
+	}
+	return a[:n]
+}
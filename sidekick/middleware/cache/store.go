@@ -3,18 +3,25 @@ package cache
 import (
 	"errors"
 	"fmt"
-	"os"
-	"path"
+	"net/http"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/puzpuzpuz/xsync"
 	"go.uber.org/zap"
 )
 
 var (
 	ErrCacheExpired  = errors.New("cache expired")
 	ErrCacheNotFound = errors.New("key not found in cache")
+	// ErrCacheStale is returned along with the value of an expired entry
+	// that is still inside the stale-while-revalidate window
+	ErrCacheStale = errors.New("cache stale")
+	// ErrCachePurged is returned by Set when a purge covering the key ran while the response rendered
+	ErrCachePurged = errors.New("cache purged while rendering")
 
 	CachedContentEncoding = []string{
 		"none",
@@ -24,292 +31,415 @@ var (
 	}
 )
 
+// StoreOptions configures keying, expiry and the storage tiers of a Store
+type StoreOptions struct {
+	TTL int
+	// seconds an expired entry may still be served while it is refreshed
+	StaleWhileRevalidate int
+	// seconds an expired entry is kept to be served when the origin fails
+	StaleIfError int
+	CacheKey     *CacheKey
+	// ordered rules overriding TTL for the entries they match
+	TTLRules []TTLRule
+	// rules adding related pages to path purges
+	PurgeRules []PurgeRule
+	// refresh entries with RefreshAheadHits hits once RefreshAheadFraction
+	// of their lifetime passed, 0 disables
+	RefreshAheadFraction float64
+	RefreshAheadHits     int64
+
+	// Tiers are the storage backends, fastest first. Without any the store
+	// keeps a memory LRU of MemMaxSize and MemMaxCount in front of the disk.
+	Tiers       []Storage
+	MemMaxSize  int
+	MemMaxCount int
+}
+
 type Store struct {
-	loc    string
-	ttl    int
-	logger *zap.Logger
-	// memCach0 atomic.Value // *xsync.MapOf[string, *MemCacheItem]
-
-	memMaxSize  int
-	memMaxCount int
-	memCache    atomic.Value // *LRUCache[string, *MemCacheItem]
+	ttl   int
+	stale int
+	// seconds past expiry an entry is kept for stale-if-error
+	staleIfError int
+	cacheKey     *CacheKey
+	ttlRules     []TTLRule
+	purgeRules   []PurgeRule
+	refreshAt    float64
+	refreshHits  int64
+	logger       *zap.Logger
+
+	// storage backends, fastest first
+	tiers []tier
+
+	// header names the entries of each flattened key vary on
+	vary atomic.Value // *xsync.MapOf[string, []string]
+
+	// purge generations, see gen.go. Set holds the read lock while writing
+	// so purges are ordered against writes.
+	genMu      sync.RWMutex
+	gen        uint64
+	purgeLog   []purgeRecord
+	purgeFloor uint64
+
+	// flattened keys of the entries carrying each tag
+	tags      atomic.Value // *tagIndex
+	tagsReady atomic.Bool
+
+	// hits of the entries by flattened key, whichever tier they are read from.
+	// hitsMu orders the counts started for a new render.
+	hits   *LRUCache[string, *hitCount]
+	hitsMu sync.Mutex
 }
 
-type MemCacheItem struct {
-	*CacheMeta
-	value []byte
+// hitCount counts the hits of one render of an entry
+type hitCount struct {
+	// Timestamp of the render counted
+	render int64
+	n      atomic.Int64
 }
 
-const (
-	CACHE_DIR = "sidekick-cache"
-)
+// hitCountKeys bounds the entries hits are counted for, the oldest counts are dropped
+const hitCountKeys = 64 * 1024
 
-func NewStore(loc string, ttl int, memMaxSize int, memMaxCount int, logger *zap.Logger) *Store {
-	os.MkdirAll(loc+"/"+CACHE_DIR, 0o755)
-	// memCache := xsync.NewMapOf[*MemCacheItem]()
+func NewStore(loc string, opts StoreOptions, logger *zap.Logger) *Store {
+	cacheKey := opts.CacheKey
+	if cacheKey == nil {
+		cacheKey = DefaultCacheKey()
+	}
 	d := &Store{
-		loc:    loc,
-		ttl:    ttl,
-		logger: logger,
-
-		memMaxSize:  memMaxSize,
-		memMaxCount: memMaxCount,
-	}
-	memCache := NewLRUCache[string, *MemCacheItem](memMaxCount, memMaxSize)
-	d.memCache.Store(memCache)
-
-	// Load cache from disk
-	/*files, err := os.ReadDir(loc + "/" + CACHE_DIR)
-	if err == nil {
-		for _, file := range files {
-			if file.IsDir() {
-				filename := file.Name()
-				pageFiles, err := os.ReadDir(loc + "/" + CACHE_DIR + "/" + filename)
-				if err != nil {
-					continue
-				}
-
-				// first time, should not have existing value
-				cacheItem, _ := memCache.LoadOrStore(filename, &MemCacheItem{
-					value:     nil,
-					timestamp: time.Now().Unix(),
-				})
-
-				// TODO: load header, stateCode, timestamp
-				for _, pageFile := range pageFiles {
-					if !pageFile.IsDir() {
-						value, err := os.ReadFile(loc + "/" + CACHE_DIR + "/" + file.Name() + "/" + pageFile.Name())
-
-						if err != nil {
-							continue
-						}
-						cacheItem.value = append(cacheItem.value, value...)
-					}
-				}
-			}
+		ttl:   opts.TTL,
+		stale: opts.StaleWhileRevalidate,
+
+		staleIfError: opts.StaleIfError,
+		cacheKey:     cacheKey,
+		ttlRules:     opts.TTLRules,
+		purgeRules:   opts.PurgeRules,
+		refreshAt:    opts.RefreshAheadFraction,
+		refreshHits:  opts.RefreshAheadHits,
+		logger:       logger,
+		hits:         NewLRUCache[string, *hitCount](hitCountKeys, 0),
+	}
+
+	tiers := opts.Tiers
+	if len(tiers) == 0 {
+		tiers = []Storage{
+			NewMemoryStorage(opts.MemMaxCount, opts.MemMaxSize),
+			NewFileStorage(loc),
 		}
-	}*/
+	}
+	for _, s := range tiers {
+		d.tiers = append(d.tiers, newTier(s))
+		if m, ok := s.(*MemoryStorage); ok {
+			m.OnEvict(d.evicted)
+		}
+	}
+
+	d.vary.Store(xsync.NewMapOf[[]string]())
+	d.tags.Store(xsync.NewMapOf[*xsync.MapOf[string, struct{}]]())
+	go d.loadTagIndex()
 
 	return d
 }
 
-// func (d *Store) getMemCache() *xsync.MapOf[string, *MemCacheItem] {
-// 	memCache, ok := d.memCache.Load().(*xsync.MapOf[string, *MemCacheItem])
-// 	if !ok {
-// 		return nil
-// 	}
-// 	return memCache
-// }
-
-func (d *Store) getMemCache() *LRUCache[string, *MemCacheItem] {
-	memCache, ok := d.memCache.Load().(*LRUCache[string, *MemCacheItem])
-	if !ok {
-		return nil
+// memory returns the memory tier, nil when the store has none
+func (d *Store) memory() *MemoryStorage {
+	for _, t := range d.tiers {
+		if m, ok := t.Storage.(*MemoryStorage); ok {
+			return m
+		}
 	}
-	return memCache
+	return nil
 }
 
-func (d *Store) Get(key string, ce string) ([]byte, *CacheMeta, error) {
-	key = strings.ReplaceAll(key, "/", "+")
-	d.logger.Debug("Getting key from cache", zap.String("key", key), zap.String("ce", ce))
-
-	memCache := d.getMemCache()
-
-	// load from memory or try load from disk
-	var retErr error
-	var cacheItem *MemCacheItem
-	isDisk := false
-	cacheKey := key + "::" + ce
-	for cacheItem == nil && retErr == nil {
-		// not sure why compute function may get called more than once...?
-		cacheItem, _ = memCache.LoadOrCompute(cacheKey, func() (*MemCacheItem, int, bool) {
-			// test for disable load from disk
-			// retErr = ErrCacheNotFound
-			// return nil, 0, false
-
-			cacheMeta := &CacheMeta{}
-			err := cacheMeta.LoadFromFile(path.Join(d.loc, CACHE_DIR, key, ".meta"))
-			if err != nil {
-				retErr = err
-				return nil, 0, false
-			}
-			value, err := os.ReadFile(path.Join(d.loc, CACHE_DIR, key, "."+ce))
-			if err != nil {
-				retErr = err
-				return nil, 0, false
-			}
-
-			isDisk = true
-			return &MemCacheItem{
-				CacheMeta: cacheMeta,
-				value:     value,
-			}, len(value), true // TODO: add header size
-		})
-		if cacheItem == nil {
-			memCache.Delete(cacheKey)
-		}
-	}
-	if retErr != nil {
-		d.logger.Debug("Error pulled key from disk", zap.String("key", key), zap.String("ce", ce), zap.Error(retErr))
-		return nil, nil, ErrCacheNotFound
+// Get looks up the variant of key matching the request header for the content encoding
+func (d *Store) Get(key string, reqHdr http.Header, ce string) ([]byte, *CacheMeta, error) {
+	meta, value, key, err := d.load(key, reqHdr, ce)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if isDisk {
-		d.logger.Debug("Pulled key from disk", zap.String("key", key), zap.String("ce", ce))
-	} else {
-		d.logger.Debug("Pulled key from memory", zap.String("key", key), zap.String("ce", ce))
-	}
+	if expires := d.expiresAt(meta); expires > 0 {
+		now := time.Now().Unix()
+		if now > expires {
+			if now <= expires+int64(d.staleFor(meta)) {
+				d.logger.Debug("Cache stale", zap.String("key", key), zap.String("ce", ce))
+				return value, meta, ErrCacheStale
+			}
 
-	if d.ttl > 0 {
-		if time.Now().Unix() > cacheItem.Timestamp+int64(d.ttl) {
 			d.logger.Debug("Cache expired", zap.String("key", key))
-			// TODO: fix racing when purge running and setting new value with same key
-			go d.Purge(key)
+			// keep the entry around while it may still be served on error
+			if now > expires+int64(d.staleIfError) {
+				go d.removeExpired(key)
+			}
 			return nil, nil, ErrCacheExpired
 		}
 	}
 
+	d.hit(key, meta)
 	d.logger.Debug("Cache hit", zap.String("key", key), zap.String("ce", ce))
-	return cacheItem.value, cacheItem.CacheMeta, nil
+	return value, meta, nil
 }
 
-func (d *Store) Set(reqPath string, cacheKey string, meta *CacheMeta, value []byte) error {
-	key := d.buildCacheKey(reqPath, cacheKey)
-	d.logger.Debug("Cache Key", zap.String("Key", key), zap.String("ce", meta.contentEncoding))
+// hit counts a hit of the render of meta, a new render starts over
+func (d *Store) hit(key string, meta *CacheMeta) {
+	if count, ok := d.hits.Peek(key); ok && (*count).render == meta.Timestamp {
+		(*count).n.Add(1)
+		return
+	}
 
-	key = strings.ReplaceAll(key, "/", "+")
-	ce := meta.contentEncoding
-	memCache := d.getMemCache()
-	// _, existed := memCache.LoadAndStore(key+"::"+ce, &MemCacheItem{
-	// 	CacheMeta: meta,
-	// 	value:     value,
-	// })
-	existed := memCache.Put(key+"::"+ce, &MemCacheItem{
-		CacheMeta: meta,
-		value:     value,
-	}, len(value)) // TODO: add header size
+	d.hitsMu.Lock()
+	count, ok := d.hits.Peek(key)
+	if !ok || (*count).render != meta.Timestamp {
+		fresh := &hitCount{render: meta.Timestamp}
+		d.hits.Put(key, fresh, 0)
+		count = &fresh
+	}
+	d.hitsMu.Unlock()
+	(*count).n.Add(1)
+}
 
-	d.logger.Debug("-----------------------------------")
-	d.logger.Debug("Setting key in cache", zap.String("key", key), zap.String("ce", meta.contentEncoding), zap.Bool("replace", existed))
+// hitsOf returns the hits of the render of meta stored under the flattened key
+func (d *Store) hitsOf(key string, meta *CacheMeta) int64 {
+	if count, ok := d.hits.Peek(key); ok && (*count).render == meta.Timestamp {
+		return (*count).n.Load()
+	}
+	return 0
+}
 
-	// create page directory
-	basePath := path.Join(d.loc, CACHE_DIR, key)
-	os.MkdirAll(basePath, 0o755)
-	err := os.WriteFile(path.Join(basePath, "."+ce), value, 0o644)
-	if err != nil {
-		d.logger.Error("Error writing data to cache", zap.Error(err))
+// RefreshDue reports whether a hot entry has used up enough of its lifetime to be refreshed ahead.
+// key and reqHdr are those meta was looked up with by Get.
+func (d *Store) RefreshDue(key string, reqHdr http.Header, meta *CacheMeta) bool {
+	if d.refreshAt <= 0 || d.hitsOf(d.flatKey(key, reqHdr), meta) < d.refreshHits {
+		return false
+	}
+	expires := d.expiresAt(meta)
+	if expires <= meta.Timestamp {
+		return false
 	}
-	err = meta.WriteToFile(path.Join(basePath, ".meta"))
+	lifetime := float64(expires - meta.Timestamp)
+	return float64(time.Now().Unix()-meta.Timestamp) >= lifetime*d.refreshAt
+}
+
+// GetStale returns the entry even past its TTL, as long as it is inside the
+// stale-if-error window. Used when the origin fails.
+func (d *Store) GetStale(key string, reqHdr http.Header, ce string) ([]byte, *CacheMeta, error) {
+	meta, value, key, err := d.load(key, reqHdr, ce)
 	if err != nil {
-		d.logger.Error("Error writing meta to cache", zap.Error(err))
+		return nil, nil, err
 	}
-	return nil
+
+	if expires := d.expiresAt(meta); expires > 0 {
+		if time.Now().Unix() > expires+int64(d.staleIfError) {
+			return nil, nil, ErrCacheExpired
+		}
+	}
+
+	d.logger.Debug("Cache stale on error", zap.String("key", key), zap.String("ce", ce))
+	return value, meta, nil
 }
 
-func (d *Store) Purge(key string) {
+// flatKey returns the flattened key of the request variant of key
+func (d *Store) flatKey(key string, reqHdr http.Header) string {
 	key = strings.ReplaceAll(key, "/", "+")
-	d.logger.Debug("Removing key from cache", zap.String("key", key))
+	return variantKey(key, d.loadVary(key), reqHdr)
+}
+
+// load returns the entry of the request variant from the first tier holding it,
+// along with its flattened key. The tiers in front of that one are filled with it.
+func (d *Store) load(key string, reqHdr http.Header, ce string) (*CacheMeta, []byte, string, error) {
+	key = d.flatKey(key, reqHdr)
+	d.logger.Debug("Getting key from cache", zap.String("key", key), zap.String("ce", ce))
 
-	memCache := d.getMemCache()
-	rmKeys := make([]string, 0, 4)
-	memCache.Range(func(k string, v *MemCacheItem) bool {
-		if strings.HasPrefix(k, key) {
-			rmKeys = append(rmKeys, k)
+	gen := d.Generation()
+	for i, t := range d.tiers {
+		meta, value, err := t.Get(key, ce)
+		if err != nil {
+			if err != ErrCacheNotFound {
+				d.logger.Debug("Error pulling key from "+t.name, zap.String("key", key), zap.String("ce", ce), zap.Error(err))
+			}
+			continue
 		}
-		return true
-	})
-	for _, k := range rmKeys {
-		d.logger.Debug("Removing key from mem cache", zap.String("key", k))
-		memCache.Delete(k)
+		d.logger.Debug("Pulled key from "+t.name, zap.String("key", key), zap.String("ce", ce))
+		if i > 0 {
+			d.fill(d.tiers[:i], key, ce, gen, meta, value)
+		}
+		return meta, value, key, nil
 	}
 
-	basePath := path.Join(d.loc, CACHE_DIR)
-	files, err := os.ReadDir(basePath)
-	if err != nil {
-		d.logger.Error("Error Removing key from disk cache", zap.Error(err))
+	d.logger.Debug("Key not in cache", zap.String("key", key), zap.String("ce", ce))
+	return nil, nil, key, ErrCacheNotFound
+}
+
+// fill copies an entry into the faster tiers, unless a purge covering it ran since gen
+func (d *Store) fill(tiers []tier, key, ce string, gen uint64, meta *CacheMeta, value []byte) {
+	d.genMu.RLock()
+	defer d.genMu.RUnlock()
+	if d.purgedSince(key, meta, gen) {
 		return
 	}
-	for _, f := range files {
-		name := f.Name()
-		if !strings.HasPrefix(name, key) {
-			continue
+	for _, t := range tiers {
+		if err := t.Set(key, ce, meta, value); err != nil {
+			d.logger.Error("Error filling "+t.name+" cache", zap.String("key", key), zap.Error(err))
 		}
-		fp := path.Join(basePath, name)
-		err := os.RemoveAll(fp)
-		if err != nil {
-			d.logger.Error("Error Removing key from disk cache", zap.String("fp", fp), zap.Error(err))
+	}
+}
+
+// Set stores the value under a key built by buildCacheKey, the same key Get is called with.
+// Responses with a Vary header are stored per variant of the request header.
+// gen is the store Generation when the request started, the write is dropped
+// if a purge covering the key ran since.
+func (d *Store) Set(key string, gen uint64, reqHdr http.Header, meta *CacheMeta, value []byte) error {
+	d.logger.Debug("Cache Key", zap.String("Key", key), zap.String("ce", meta.contentEncoding))
+
+	reqPath, _, _ := strings.Cut(key, "::")
+	key = strings.ReplaceAll(key, "/", "+")
+	fields := meta.VaryFields()
+	if slices.Contains(fields, "*") {
+		return nil
+	}
+	baseKey := key
+	key = variantKey(key, fields, reqHdr)
+
+	d.genMu.RLock()
+	defer d.genMu.RUnlock()
+	if d.purgedSince(key, meta, gen) {
+		d.logger.Debug("Dropping write purged while rendering", zap.String("key", key), zap.Uint64("gen", gen))
+		return ErrCachePurged
+	}
+	d.storeVary(baseKey, fields)
+
+	// origin didn't say how long, use the first matching rule or the store TTL
+	if meta.Expires == 0 {
+		if ttl := d.entryTTL(reqPath, meta); ttl > 0 {
+			meta.Expires = meta.Timestamp + int64(ttl)
 		}
-		// for _, name := range CachedContentEncoding {
-		// 	err := os.Remove(path.Join(fp, "."+name))
-		// 	if err != nil {
-		// 		d.logger.Error("Error Removing key from disk cache", zap.String("fp", fp), zap.Error(err))
-		// 	}
-		// }
 	}
+	ce := meta.contentEncoding
+	d.indexTags(key, meta.Tags)
+
+	d.logger.Debug("-----------------------------------")
+	d.logger.Debug("Setting key in cache", zap.String("key", key), zap.String("ce", meta.contentEncoding))
+
+	for _, t := range d.tiers {
+		if err := t.Set(key, ce, meta, value); err != nil {
+			d.logger.Error("Error writing data to "+t.name+" cache", zap.String("key", key), zap.Error(err))
+		}
+	}
+	return nil
 }
 
-func (d *Store) Flush() error {
-	d.memCache.Store(NewLRUCache[string, *MemCacheItem](d.memMaxCount, d.memMaxSize))
-	// return nil
-	basePath := path.Join(d.loc, CACHE_DIR)
-	files, err := os.ReadDir(basePath)
-	if err != nil {
-		d.logger.Error("Error flushing cache", zap.Error(err))
-		return err
+// Purge removes the entries of reqPath, and with related the pages the purge rules tie to it
+func (d *Store) Purge(reqPath string, mode PurgeMode, related bool) *PurgeResult {
+	d.logger.Debug("Removing path from cache", zap.String("path", reqPath), zap.String("mode", string(mode)), zap.Bool("related", related))
+	match := mode.matcher(reqPath)
+	prefix := keyPrefix(reqPath, mode)
+	if related && len(d.Related(reqPath)) > 0 {
+		match = d.withRelated([]string{reqPath}, match)
+		prefix = ""
 	}
-	for _, f := range files {
-		fp := path.Join(basePath, f.Name())
-		err = os.RemoveAll(fp)
+	d.recordPurge(matchKeys(match))
+	return d.removeKeys(prefix, match)
+}
+
+// Flush removes every entry of every tier
+func (d *Store) Flush() *PurgeResult {
+	d.recordPurge(matchAll)
+	res := newPurgeResult()
+	d.vary.Store(xsync.NewMapOf[[]string]())
+	d.tags.Store(xsync.NewMapOf[*xsync.MapOf[string, struct{}]]())
+	for _, t := range d.tiers {
+		n, err := t.Flush()
+		res.count(t, n)
 		if err != nil {
-			d.logger.Error("Error flushing cache", zap.String("fp", fp), zap.Error(err))
+			d.logger.Error("Error flushing "+t.name+" cache", zap.Error(err))
+			res.fail(t.name, err)
 		}
 	}
-	return err
+	return res.done()
 }
 
+// List returns the keys of every tier, with their content encoding, by tier name
 func (d *Store) List() map[string][]string {
-	memCache := d.getMemCache()
 	list := make(map[string][]string)
-	list["mem"] = make([]string, 0, memCache.Size())
+	for _, t := range d.tiers {
+		keys, err := t.List()
+		if err != nil {
+			d.logger.Error("Error listing "+t.name+" cache", zap.Error(err))
+		}
+		if list[t.name] == nil {
+			list[t.name] = make([]string, 0, len(keys))
+		}
+		for key, encodings := range keys {
+			for _, ce := range encodings {
+				list[t.name] = append(list[t.name], key+"::"+ce)
+			}
+		}
+	}
 
-	memCache.Range(func(key string, value *MemCacheItem) bool {
-		list["mem"] = append(list["mem"], key)
-		return true
-	})
+	if m := d.memory(); m != nil {
+		list["debug"] = []string{
+			fmt.Sprintf("max_size=%v", m.MaxSize),
+			fmt.Sprintf("max_count=%v", m.MaxCount),
+			fmt.Sprintf("size=%v", m.Cost()),
+			fmt.Sprintf("coun=%v", m.Size()),
+		}
+	}
 
-	basePath := path.Join(d.loc, CACHE_DIR)
-	files, err := os.ReadDir(basePath)
-	list["disk"] = make([]string, 0)
+	return list
+}
 
-	if err == nil {
-		for _, file := range files {
-			if !file.IsDir() {
-				continue
-			}
-			dirName := file.Name()
-			fp := path.Join(basePath, dirName)
-			for _, name := range CachedContentEncoding {
-				ckPath := path.Join(fp, "."+name)
-				_, err := os.Stat(ckPath)
-				if errors.Is(err, os.ErrNotExist) {
-					continue
-				}
-				list["disk"] = append(list["disk"], dirName+"::"+name)
-			}
+// removeExpired deletes the entry of a flattened key once it is past every stale window.
+// Unlike Purge it starts no new generation, and it holds off Set so a fresh write is kept.
+func (d *Store) removeExpired(key string) {
+	d.genMu.Lock()
+	defer d.genMu.Unlock()
+
+	now := time.Now().Unix()
+	var tags []string
+	for _, t := range d.tiers {
+		meta, err := t.Meta(key)
+		if err != nil || !d.expiredAt(meta, now-int64(max(d.staleFor(meta), d.staleIfError))) {
+			continue
 		}
+		tags = append(tags, meta.Tags...)
+		if _, err := t.Delete(key); err != nil {
+			d.logger.Error("Error Removing expired key from "+t.name+" cache", zap.String("key", key), zap.Error(err))
+		}
+	}
+	if len(tags) > 0 {
+		d.untagGone(key, tags)
 	}
+}
 
-	list["debug"] = []string{
-		fmt.Sprintf("max_size=%v", d.memMaxSize),
-		fmt.Sprintf("max_count=%v", d.memMaxCount),
-		fmt.Sprintf("size=%v", memCache.Cost()),
-		fmt.Sprintf("coun=%v", memCache.Size()),
+// staleFor returns the seconds past expiry the entry is served while it refreshes
+func (d *Store) staleFor(meta *CacheMeta) int {
+	if meta.SoftPurged {
+		return max(d.stale, softPurgeStale)
 	}
+	return d.stale
+}
 
-	return list
+// expiresAt returns the unix time the entry expires, 0 if it never does
+func (d *Store) expiresAt(meta *CacheMeta) int64 {
+	if meta.Expires > 0 {
+		return meta.Expires
+	}
+	if d.ttl <= 0 {
+		return 0
+	}
+	return meta.Timestamp + int64(d.ttl)
+}
+
+// entryTTL returns the TTL of the first rule matching the entry, or the store TTL
+func (d *Store) entryTTL(reqPath string, meta *CacheMeta) int {
+	for i := range d.ttlRules {
+		if d.ttlRules[i].Match(reqPath, meta) {
+			return d.ttlRules[i].TTL
+		}
+	}
+	return d.ttl
 }
 
-func (d *Store) buildCacheKey(reqPath string, cacheKey string) string {
-	// cacheKey := contentEncoding + "::" + reqPath
-	return fmt.Sprintf("%v::%v", reqPath, cacheKey)
-}
\ No newline at end of file
+// buildCacheKey returns the key of the request for both Get and Set
+func (d *Store) buildCacheKey(r *http.Request) string {
+	return d.cacheKey.Build(r)
+}
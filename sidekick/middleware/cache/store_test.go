@@ -0,0 +1,247 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestStore returns a store with the default memory and file tiers in a temporary directory
+func newTestStore(t *testing.T, opts StoreOptions) *Store {
+	t.Helper()
+	d := NewStore(t.TempDir(), opts, zap.NewNop())
+	for !d.tagsReady.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	return d
+}
+
+func testMeta(tags ...string) *CacheMeta {
+	now := time.Now()
+	return &CacheMeta{
+		StateCode: http.StatusOK,
+		Timestamp: now.Unix(),
+		Rendered:  now.UnixNano(),
+		Tags:      tags,
+
+		contentEncoding: "none",
+	}
+}
+
+// assertNotStored fails if any tier holds the flattened key of key
+func assertNotStored(t *testing.T, d *Store, key string) {
+	t.Helper()
+	flat := strings.ReplaceAll(key, "/", "+")
+	for _, tr := range d.tiers {
+		if _, _, err := tr.Get(flat, "none"); !errors.Is(err, ErrCacheNotFound) {
+			t.Errorf("%s tier holds %s after a purge, err %v", tr.name, key, err)
+		}
+	}
+}
+
+func TestSetAfterPurgeIsDropped(t *testing.T) {
+	const key = "/blog/post::"
+
+	purges := map[string]func(d *Store){
+		"purge": func(d *Store) {
+			d.Purge("/blog/", PurgePrefix, false)
+		},
+		"purge tags": func(d *Store) {
+			d.PurgeTags([]string{"post-1"}, false)
+		},
+		"flush": func(d *Store) {
+			d.Flush()
+		},
+	}
+
+	for name, purge := range purges {
+		t.Run(name, func(t *testing.T) {
+			d := newTestStore(t, StoreOptions{})
+
+			gen := d.Generation()
+			purge(d)
+
+			err := d.Set(key, gen, http.Header{}, testMeta("post-1"), []byte("rendered before the purge"))
+			if !errors.Is(err, ErrCachePurged) {
+				t.Fatalf("Set after %s returned %v, want ErrCachePurged", name, err)
+			}
+			assertNotStored(t, d, key)
+		})
+	}
+}
+
+func TestSetAfterUnrelatedPurgeIsKept(t *testing.T) {
+	const key = "/blog/post::"
+	d := newTestStore(t, StoreOptions{})
+
+	gen := d.Generation()
+	d.Purge("/shop/", PurgePrefix, false)
+	d.PurgeTags([]string{"product-1"}, false)
+
+	if err := d.Set(key, gen, http.Header{}, testMeta("post-1"), []byte("body")); err != nil {
+		t.Fatalf("Set after an unrelated purge returned %v", err)
+	}
+	value, _, err := d.Get(key, http.Header{}, "none")
+	if err != nil || string(value) != "body" {
+		t.Fatalf("Get returned %q, %v", value, err)
+	}
+}
+
+func TestSetOlderThanPurgeLogIsDropped(t *testing.T) {
+	const key = "/blog/post::"
+	d := newTestStore(t, StoreOptions{})
+
+	gen := d.Generation()
+	for i := 0; i <= purgeLogSize; i++ {
+		d.Purge("/shop/", PurgeExact, false)
+	}
+
+	err := d.Set(key, gen, http.Header{}, testMeta(), []byte("body"))
+	if !errors.Is(err, ErrCachePurged) {
+		t.Fatalf("Set older than the purge log returned %v, want ErrCachePurged", err)
+	}
+	assertNotStored(t, d, key)
+}
+
+func TestSoftPurgeServesStale(t *testing.T) {
+	for _, stale := range []int{0, 120} {
+		d := newTestStore(t, StoreOptions{TTL: 60, StaleWhileRevalidate: stale})
+		if err := d.Set("/a/::", d.Generation(), http.Header{}, testMeta(), []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+
+		d.SoftPurge("/a/", PurgeExact, false)
+		value, _, err := d.Get("/a/::", http.Header{}, "none")
+		if !errors.Is(err, ErrCacheStale) || string(value) != "a" {
+			t.Errorf("stale_while_revalidate %d: Get after soft purge returned %q, %v, want the stale entry", stale, value, err)
+		}
+
+		// past the window the entry is expired like any other
+		past := time.Now().Unix() - int64(max(stale, softPurgeStale)) - 2
+		for _, tr := range d.tiers {
+			if _, err := tr.Expire("+a+::", past); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := d.Get("/a/::", http.Header{}, "none"); !errors.Is(err, ErrCacheExpired) {
+			t.Errorf("stale_while_revalidate %d: Get past the window returned %v, want ErrCacheExpired", stale, err)
+		}
+	}
+}
+
+func TestExpiredEntryWithoutStaleWindow(t *testing.T) {
+	d := newTestStore(t, StoreOptions{TTL: 60})
+	meta := testMeta()
+	meta.Expires = meta.Timestamp - 1
+	if err := d.Set("/a/::", d.Generation(), http.Header{}, meta, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.Get("/a/::", http.Header{}, "none"); !errors.Is(err, ErrCacheExpired) {
+		t.Errorf("expired entry without stale_while_revalidate: Get returned %v, want ErrCacheExpired", err)
+	}
+}
+
+// newTieredStore returns a store with a memory tier in front of a file tier
+func newTieredStore(t *testing.T) (*Store, *MemoryStorage, *FileStorage) {
+	t.Helper()
+	mem := NewMemoryStorage(100, 1<<20)
+	disk := NewFileStorage(t.TempDir())
+	return newTestStore(t, StoreOptions{Tiers: []Storage{mem, disk}}), mem, disk
+}
+
+func TestTierHitFillsFront(t *testing.T) {
+	d, mem, disk := newTieredStore(t)
+	if err := disk.Set("+a+::", "none", testMeta(), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _, err := d.Get("/a/::", http.Header{}, "none"); err != nil || string(value) != "a" {
+		t.Fatalf("Get of an entry only on disk returned %q, %v", value, err)
+	}
+	if _, value, err := mem.Get("+a+::", "none"); err != nil || string(value) != "a" {
+		t.Errorf("hit on disk didn't fill memory: %q, %v", value, err)
+	}
+}
+
+func TestTierFillAfterPurgeIsDropped(t *testing.T) {
+	d, mem, disk := newTieredStore(t)
+	meta := testMeta()
+	if err := disk.Set("+a+::", "none", meta, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the fill read disk before the purge and lands after it
+	gen := d.Generation()
+	d.Purge("/a/", PurgeExact, false)
+	d.fill(d.tiers[:1], "+a+::", "none", gen, meta, []byte("a"))
+	if _, _, err := mem.Get("+a+::", "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("fill purged while reading landed in memory: %v", err)
+	}
+}
+
+func TestTierPurgeAndFlush(t *testing.T) {
+	d, mem, disk := newTieredStore(t)
+	for _, key := range []string{"/a/::", "/b/::"} {
+		if err := d.Set(key, d.Generation(), http.Header{}, testMeta(), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res := d.Purge("/a/", PurgeExact, false)
+	if res.Mem != 1 || res.Disk != 1 {
+		t.Errorf("Purge removed mem=%d disk=%d, want 1 and 1", res.Mem, res.Disk)
+	}
+	for _, s := range []Storage{mem, disk} {
+		if _, _, err := s.Get("+a+::", "none"); !errors.Is(err, ErrCacheNotFound) {
+			t.Errorf("purged entry left in %T: %v", s, err)
+		}
+		if _, _, err := s.Get("+b+::", "none"); err != nil {
+			t.Errorf("unpurged entry gone from %T: %v", s, err)
+		}
+	}
+
+	d.Flush()
+	for _, s := range []Storage{mem, disk} {
+		if _, _, err := s.Get("+b+::", "none"); !errors.Is(err, ErrCacheNotFound) {
+			t.Errorf("flushed entry left in %T: %v", s, err)
+		}
+	}
+}
+
+func TestTierSetDropsEncodingsOfEarlierRender(t *testing.T) {
+	_, mem, disk := newTieredStore(t)
+	for _, s := range []Storage{mem, disk} {
+		old := testMeta()
+		old.Timestamp -= 30
+		fill := testMeta()
+		fill.Timestamp, fill.Rendered = old.Timestamp, old.Rendered
+		if err := s.Set("+a+::", "gzip", old, []byte("old zipped")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set("+a+::", "br", fill, []byte("old brotli")); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.Get("+a+::", "gzip"); err != nil {
+			t.Errorf("%T: a fill of the same render dropped gzip: %v", s, err)
+		}
+
+		// a refresh renders again before the entry expires, within the same second
+		fresh := testMeta()
+		fresh.Timestamp = old.Timestamp
+		if err := s.Set("+a+::", "none", fresh, []byte("new plain")); err != nil {
+			t.Fatal(err)
+		}
+		for _, ce := range []string{"gzip", "br"} {
+			if _, _, err := s.Get("+a+::", ce); !errors.Is(err, ErrCacheNotFound) {
+				t.Errorf("%T: %s body of the earlier render still served, err %v", s, ce, err)
+			}
+		}
+		if _, value, err := s.Get("+a+::", "none"); err != nil || string(value) != "new plain" {
+			t.Errorf("%T: Get = %q, %v", s, value, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/puzpuzpuz/xsync"
+	"go.uber.org/zap"
+)
+
+// parseTags splits a tag header value, tags may be separated by commas or spaces
+func parseTags(value string) []string {
+	tags := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	slices.Sort(tags)
+	return slices.Compact(tags)
+}
+
+// tagIndex maps each tag to the flattened keys of the entries carrying it
+type tagIndex = xsync.MapOf[string, *xsync.MapOf[string, struct{}]]
+
+func (d *Store) getTags() *tagIndex {
+	tags, ok := d.tags.Load().(*tagIndex)
+	if !ok {
+		return nil
+	}
+	return tags
+}
+
+// indexTags records key under each of its tags
+func (d *Store) indexTags(key string, tags []string) {
+	index := d.getTags()
+	for _, tag := range tags {
+		// not LoadOrCompute, it hands back a different map than the one it stores
+		keys, ok := index.Load(tag)
+		if !ok {
+			keys, _ = index.LoadOrStore(tag, xsync.NewMapOf[struct{}]())
+		}
+		keys.Store(key, struct{}{})
+	}
+}
+
+// untag drops key from the sets of its tags, and the sets left empty.
+// The caller holds genMu, so no Set adds to a set being dropped.
+func (d *Store) untag(key string, tags []string) {
+	index := d.getTags()
+	for _, tag := range tags {
+		keys, ok := index.Load(tag)
+		if !ok {
+			continue
+		}
+		keys.Delete(key)
+		if keys.Size() == 0 {
+			index.Delete(tag)
+		}
+	}
+}
+
+// untagKeys drops the matching keys from every tag set, the caller holds genMu
+func (d *Store) untagKeys(match func(key string) bool) {
+	index := d.getTags()
+	index.Range(func(tag string, keys *xsync.MapOf[string, struct{}]) bool {
+		keys.Range(func(k string, _ struct{}) bool {
+			if match(k) {
+				keys.Delete(k)
+			}
+			return true
+		})
+		if keys.Size() == 0 {
+			index.Delete(tag)
+		}
+		return true
+	})
+}
+
+// untagGone drops key from the index once no tier holds it, the caller holds genMu
+func (d *Store) untagGone(key string, tags []string) {
+	for _, t := range d.tiers {
+		if _, err := t.Meta(key); err == nil {
+			return
+		}
+	}
+	d.untag(key, tags)
+}
+
+// evicted drops an entry evicted from memory from the index, unless a slower tier keeps it
+func (d *Store) evicted(key string, meta *CacheMeta) {
+	if len(meta.Tags) == 0 {
+		return
+	}
+	d.genMu.Lock()
+	defer d.genMu.Unlock()
+	d.untagGone(key, meta.Tags)
+}
+
+// loadTagIndex fills the index from the entries of the tiers,
+// until it is done PurgeTags reads the metas itself
+func (d *Store) loadTagIndex() {
+	defer d.tagsReady.Store(true)
+
+	d.rangeMetas(func(key string, meta *CacheMeta) {
+		d.genMu.RLock()
+		defer d.genMu.RUnlock()
+		d.indexTags(key, meta.Tags)
+	})
+}
+
+// rangeMetas calls fn with the meta of every key the tiers hold
+func (d *Store) rangeMetas(fn func(key string, meta *CacheMeta)) {
+	seen := make(map[string]bool)
+	for _, t := range d.tiers {
+		keys, err := t.List()
+		if err != nil {
+			continue
+		}
+		for key := range keys {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			meta, err := t.Meta(key)
+			if err != nil {
+				continue
+			}
+			fn(key, meta)
+		}
+	}
+}
+
+// taggedKeys returns the flattened keys carrying any of the tags,
+// with remove the tags are dropped from the index
+func (d *Store) taggedKeys(tags []string, remove bool) []string {
+	keys := make([]string, 0, 16)
+
+	if !d.tagsReady.Load() {
+		// index still loading, look at every entry
+		d.rangeMetas(func(key string, meta *CacheMeta) {
+			for _, tag := range meta.Tags {
+				if slices.Contains(tags, tag) {
+					keys = append(keys, key)
+					break
+				}
+			}
+		})
+	}
+
+	// shared tiers know the entries of every replica
+	for _, t := range d.tiers {
+		ti, ok := t.Storage.(TagIndex)
+		if !ok {
+			continue
+		}
+		tagged, err := ti.Tagged(tags, remove)
+		if err != nil {
+			d.logger.Error("Error reading tags from "+t.name+" cache", zap.Strings("tags", tags), zap.Error(err))
+			continue
+		}
+		keys = append(keys, tagged...)
+	}
+
+	index := d.getTags()
+	for _, tag := range tags {
+		var tagged *xsync.MapOf[string, struct{}]
+		var ok bool
+		if remove {
+			tagged, ok = index.LoadAndDelete(tag)
+		} else {
+			tagged, ok = index.Load(tag)
+		}
+		if !ok {
+			continue
+		}
+		tagged.Range(func(key string, _ struct{}) bool {
+			keys = append(keys, key)
+			return true
+		})
+	}
+
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// PurgeTags removes every entry carrying one or more of the tags from every tier,
+// with related the pages the purge rules tie to their paths too
+func (d *Store) PurgeTags(tags []string, related bool) *PurgeResult {
+	d.logger.Debug("Removing tags from cache", zap.Strings("tags", tags), zap.Bool("related", related))
+	var paths []string
+	if related {
+		paths = d.taggedPaths(tags)
+	}
+	d.recordPurge(d.withRelatedMeta(paths, matchTags(tags)))
+	res := newPurgeResult()
+
+	keys := d.taggedKeys(tags, true)
+	for _, key := range keys {
+		for _, t := range d.tiers {
+			n, err := t.Delete(key)
+			if err != nil {
+				d.logger.Error("Error Removing tagged key from "+t.name+" cache", zap.String("key", key), zap.Error(err))
+				res.fail(key, err)
+				continue
+			}
+			res.count(t, n)
+		}
+	}
+
+	// the keys may carry other tags too
+	if len(keys) > 0 {
+		d.genMu.Lock()
+		d.untagKeys(func(k string) bool {
+			_, found := slices.BinarySearch(keys, k)
+			return found
+		})
+		d.genMu.Unlock()
+	}
+
+	if rel := d.relatedMatch(paths); rel != nil {
+		res.add(d.removeKeys("", rel))
+	}
+	return res.done()
+}
+
+// taggedPaths returns the request paths of the entries carrying any of the tags,
+// for the purge rules to match. Without rules there is nothing to look up.
+func (d *Store) taggedPaths(tags []string) []string {
+	if len(d.purgeRules) == 0 || len(tags) == 0 {
+		return nil
+	}
+	return keyPaths(d.taggedKeys(tags, false))
+}
+
+// taggedSet returns the flattened keys carrying any of the tags
+func (d *Store) taggedSet(tags []string) map[string]bool {
+	set := make(map[string]bool)
+	if len(tags) == 0 {
+		return set
+	}
+	for _, k := range d.taggedKeys(tags, false) {
+		set[k] = true
+	}
+	return set
+}
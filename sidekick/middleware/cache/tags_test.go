@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/puzpuzpuz/xsync"
+)
+
+func TestParseTags(t *testing.T) {
+	got := parseTags("post-1, term-2 post-1,,home")
+	want := []string{"home", "post-1", "term-2"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("parseTags = %v, want %v", got, want)
+	}
+}
+
+func TestIndexTagsKeepsFirstKey(t *testing.T) {
+	d := newTestStore(t, StoreOptions{})
+
+	d.indexTags("+a::", []string{"post-1"})
+	if got := d.taggedKeys([]string{"post-1"}, false); !slices.Equal(got, []string{"+a::"}) {
+		t.Fatalf("first key under a new tag: got %v", got)
+	}
+
+	d.indexTags("+b::", []string{"post-1", "home"})
+	if got := d.taggedKeys([]string{"post-1"}, false); !slices.Equal(got, []string{"+a::", "+b::"}) {
+		t.Fatalf("keys under post-1: got %v", got)
+	}
+	if got := d.taggedKeys([]string{"home", "post-1"}, true); !slices.Equal(got, []string{"+a::", "+b::"}) {
+		t.Fatalf("keys under home or post-1: got %v", got)
+	}
+	if got := d.taggedKeys([]string{"post-1"}, false); len(got) != 0 {
+		t.Fatalf("removed tags still indexed: %v", got)
+	}
+}
+
+func TestPurgeTags(t *testing.T) {
+	d := newTestStore(t, StoreOptions{})
+
+	entries := map[string][]string{
+		"/post-1/::": {"post-1", "home"},
+		"/post-2/::": {"post-2"},
+		"/::":        {"home"},
+		"/about/::":  nil,
+	}
+	for key, tags := range entries {
+		if err := d.Set(key, d.Generation(), http.Header{}, testMeta(tags...), []byte(key)); err != nil {
+			t.Fatalf("Set %s: %v", key, err)
+		}
+	}
+
+	res := d.PurgeTags([]string{"home"}, false)
+	if len(res.Errors) > 0 {
+		t.Fatalf("PurgeTags errors: %v", res.Errors)
+	}
+	if res.Mem != 2 || res.Disk != 2 {
+		t.Errorf("PurgeTags removed mem=%d disk=%d, want 2 and 2", res.Mem, res.Disk)
+	}
+
+	for key, tags := range entries {
+		_, _, err := d.Get(key, http.Header{}, "none")
+		if slices.Contains(tags, "home") {
+			if !errors.Is(err, ErrCacheNotFound) {
+				t.Errorf("%s carries the purged tag, Get returned %v", key, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s doesn't carry the purged tag, Get returned %v", key, err)
+		}
+	}
+}
+
+// indexedTags returns the tags of the index with the keys under each
+func indexedTags(d *Store) map[string][]string {
+	tags := make(map[string][]string)
+	d.getTags().Range(func(tag string, keys *xsync.MapOf[string, struct{}]) bool {
+		keys.Range(func(k string, _ struct{}) bool {
+			tags[tag] = append(tags[tag], k)
+			return true
+		})
+		slices.Sort(tags[tag])
+		return true
+	})
+	return tags
+}
+
+func TestTagIndexDropsRemovedKeys(t *testing.T) {
+	d := newTestStore(t, StoreOptions{})
+	set := func(key string, meta *CacheMeta) {
+		if err := d.Set(key, d.Generation(), http.Header{}, meta, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("/post-1/::", testMeta("post-1", "home"))
+	set("/post-2/::", testMeta("post-2", "home"))
+	set("/post-3/::", testMeta("post-3", "home"))
+
+	// a path purge
+	d.Purge("/post-1/", PurgeExact, false)
+	// a tag purge, the key leaves its other tags too
+	d.PurgeTags([]string{"post-2"}, false)
+	// an expired entry past its stale windows
+	expired := testMeta("post-3", "home")
+	expired.Expires = expired.Timestamp - 10
+	set("/post-3/::", expired)
+	d.removeExpired("+post-3+::")
+
+	if tags := indexedTags(d); len(tags) != 0 {
+		t.Errorf("index holds removed keys: %v", tags)
+	}
+}
+
+func TestTagIndexDropsEvictedKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		tiers func(t *testing.T) []Storage
+		kept  bool
+	}{
+		{"memory only", func(*testing.T) []Storage {
+			return []Storage{NewMemoryStorage(1, 0)}
+		}, false},
+		{"memory and file", func(t *testing.T) []Storage {
+			return []Storage{NewMemoryStorage(1, 0), NewFileStorage(t.TempDir())}
+		}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestStore(t, StoreOptions{Tiers: tc.tiers(t)})
+			d.Set("/a/::", d.Generation(), http.Header{}, testMeta("post-1"), []byte("a"))
+			// the memory tier holds a single entry, b evicts a
+			d.Set("/b/::", d.Generation(), http.Header{}, testMeta(), []byte("b"))
+
+			want := map[string][]string{}
+			if tc.kept {
+				want["post-1"] = []string{"+a+::"}
+			}
+			deadline := time.Now().Add(time.Second)
+			for {
+				tags := indexedTags(d)
+				if reflect.DeepEqual(tags, want) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("index %v, want %v", tags, want)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestPurgeTagsRelated(t *testing.T) {
+	d := newRelatedStore(t)
+	res := d.PurgeTags([]string{"post-1"}, true)
+	if len(res.Errors) > 0 {
+		t.Fatalf("PurgeTags errors: %v", res.Errors)
+	}
+	for _, key := range []string{"/blog/post/::", "/::", "/feed/atom/::"} {
+		assertNotStored(t, d, key)
+	}
+	if _, _, err := d.Get("/about/::", http.Header{}, "none"); err != nil {
+		t.Errorf("tag purge removed an unrelated page: %v", err)
+	}
+
+	d = newRelatedStore(t)
+	d.SoftPurgeTags([]string{"post-1"}, true)
+	if _, _, err := d.Get("/feed/atom/::", http.Header{}, "none"); !errors.Is(err, ErrCacheStale) {
+		t.Errorf("soft tag purge left the feed fresh: Get returned %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// TTLRule sets the lifetime of entries it matches. Every condition given must
+// match, rules are tried in order and the first match wins.
+type TTLRule struct {
+	PathPrefix string
+	PathRegex  string
+	// status codes, "4" for the whole 4XX class
+	Status []string
+	// media type prefix of Content-Type, e.g. "text/html"
+	ContentType string
+	// seconds the entry lives
+	TTL int
+
+	rx *regexp.Regexp
+}
+
+// UnmarshalCaddyfile parses a ttl_rule block:
+//
+//	ttl_rule {
+//		path_prefix /product/
+//		path_regex ^/(category|tag)/
+//		status 404,4XX
+//		content_type text/html
+//		ttl 3600
+//	}
+func (rule *TTLRule) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	err := parseBlock(d, func(key string, args []string) error {
+		switch key {
+		case "path_prefix":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			rule.PathPrefix = args[0]
+
+		case "path_regex":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			if _, err := regexp.Compile(args[0]); err != nil {
+				return d.Errf("invalid path_regex '%s': %v", args[0], err)
+			}
+			rule.PathRegex = args[0]
+
+		case "status":
+			rule.Status = parseStatusCodes(splitList(args))
+
+		case "content_type":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			rule.ContentType = strings.ToLower(args[0])
+
+		case "ttl":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			ttl, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("invalid ttl '%s'", args[0])
+			}
+			rule.TTL = ttl
+
+		default:
+			return d.Errf("unknown ttl_rule option '%s'", key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if rule.TTL <= 0 {
+		return d.Err("ttl_rule needs a ttl greater than 0")
+	}
+	return nil
+}
+
+// Provision compiles the path regex
+func (rule *TTLRule) Provision() error {
+	if rule.PathRegex == "" {
+		return nil
+	}
+	rx, err := regexp.Compile(rule.PathRegex)
+	if err != nil {
+		return err
+	}
+	rule.rx = rx
+	return nil
+}
+
+// Match reports whether the entry for reqPath matches every condition of the rule
+func (rule *TTLRule) Match(reqPath string, meta *CacheMeta) bool {
+	if rule.PathPrefix != "" && !strings.HasPrefix(reqPath, rule.PathPrefix) {
+		return false
+	}
+	if rule.rx != nil && !rule.rx.MatchString(reqPath) {
+		return false
+	}
+	if len(rule.Status) > 0 && !matchStatus(rule.Status, meta.StateCode) {
+		return false
+	}
+	if rule.ContentType != "" {
+		ct := strings.ToLower(meta.GetHeader("Content-Type"))
+		if !strings.HasPrefix(ct, rule.ContentType) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseStatusCodes turns "404" and "4XX" style codes into "404" and "4"
+func parseStatusCodes(codes []string) []string {
+	parsed := make([]string, len(codes))
+	for i, code := range codes {
+		code = strings.TrimSpace(code)
+		if strings.Contains(strings.ToUpper(code), "XX") {
+			code = string(code[0])
+		}
+		parsed[i] = code
+	}
+	return parsed
+}
+
+// matchStatus reports whether status is one of codes, single digit codes match a class
+func matchStatus(codes []string, status int) bool {
+	statusStr := strconv.Itoa(status)
+	for _, code := range codes {
+		if code == statusStr || (len(code) == 1 && code == statusStr[0:1]) {
+			return true
+		}
+	}
+	return false
+}
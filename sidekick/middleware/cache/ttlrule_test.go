@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestTTLRuleFirstMatchWins(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`ttl_rule {
+		status 4XX
+		ttl 30
+	}
+	ttl_rule {
+		path_prefix /product/
+		content_type text/html
+		ttl 3600
+	}
+	ttl_rule {
+		path_regex ^/(product|category)/
+		ttl 600
+	}`)
+	var rules []TTLRule
+	for d.Next() {
+		rule := TTLRule{}
+		if err := rule.UnmarshalCaddyfile(d); err != nil {
+			t.Fatal(err)
+		}
+		if err := rule.Provision(); err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	store := newTestStore(t, StoreOptions{TTL: 60, TTLRules: rules})
+
+	tests := []struct {
+		path   string
+		status int
+		ct     string
+		want   int
+	}{
+		{"/product/shoe/", http.StatusNotFound, "text/html", 30},
+		{"/product/shoe/", http.StatusOK, "text/html; charset=UTF-8", 3600},
+		{"/product/shoe/", http.StatusOK, "application/json", 600},
+		{"/category/shoes/", http.StatusOK, "text/html", 600},
+		{"/about/", http.StatusOK, "text/html", 60},
+	}
+	for _, tt := range tests {
+		meta := testMeta()
+		meta.StateCode = tt.status
+		meta.Header = [][]string{{"Content-Type", tt.ct}}
+		if got := store.entryTTL(tt.path, meta); got != tt.want {
+			t.Errorf("%s %d %s: ttl %d, want %d", tt.path, tt.status, tt.ct, got, tt.want)
+		}
+	}
+}
+
+func TestTTLRuleSetsExpiry(t *testing.T) {
+	rule := TTLRule{PathPrefix: "/feed/", TTL: 300}
+	d := newTestStore(t, StoreOptions{TTL: 60, TTLRules: []TTLRule{rule}})
+
+	meta := testMeta()
+	if err := d.Set("/feed/::", d.Generation(), http.Header{}, meta, []byte("feed")); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Expires != meta.Timestamp+300 {
+		t.Errorf("entry expires %ds after it was stored, want 300", meta.Expires-meta.Timestamp)
+	}
+
+	// an expiry from the origin is kept
+	meta = testMeta()
+	meta.Expires = meta.Timestamp + 10
+	if err := d.Set("/feed/::", d.Generation(), http.Header{}, meta, []byte("feed")); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Expires != meta.Timestamp+10 {
+		t.Errorf("origin expiry replaced, entry expires %ds after it was stored", meta.Expires-meta.Timestamp)
+	}
+}
+
+func TestTTLRuleNeedsTTL(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`ttl_rule {
+		path_prefix /product/
+	}`)
+	d.Next()
+	if err := (&TTLRule{}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("ttl_rule without a ttl parsed")
+	}
+}
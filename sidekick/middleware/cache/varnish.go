@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(Varnish{})
+}
+
+// Varnish sends BAN requests to a Varnish server. The VCL bans on
+// X-Ban-Host and X-Ban-Url, and on X-Ban-Tags against the TagHeader the
+// cache adds to responses, which it drops before the client:
+//
+//	if (req.method == "BAN") {
+//		if (req.http.X-Ban-Tags) {
+//			ban("obj.http.X-Cache-Tags ~ " + req.http.X-Ban-Tags);
+//		} else {
+//			ban("obj.http.X-Host ~ " + req.http.X-Ban-Host + " && obj.http.X-Url ~ " + req.http.X-Ban-Url);
+//		}
+//		return (synth(200, "Banned"));
+//	}
+//
+//	sub vcl_deliver {
+//		unset resp.http.X-Cache-Tags;
+//	}
+type Varnish struct {
+	CDNBase
+	// Method of the ban requests
+	Method string
+	// TagHeader carries the tags of a page to Varnish, comma separated
+	TagHeader string
+}
+
+// CaddyModule returns the Caddy module information.
+func (Varnish) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.wp_cache.cdn.varnish",
+		New: func() caddy.Module {
+			return new(Varnish)
+		},
+	}
+}
+
+// UnmarshalCaddyfile parses a varnish block:
+//
+//	cdn varnish {
+//		base_url http://varnish:6081
+//		method BAN
+//		tag_header X-Cache-Tags
+//	}
+func (v *Varnish) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // driver name
+	return parseBlock(d, func(key string, args []string) error {
+		if ok, err := v.parseOption(d, key, args); ok {
+			return err
+		}
+		switch key {
+		case "method":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			v.Method = strings.ToUpper(args[0])
+
+		case "tag_header":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			v.TagHeader = args[0]
+
+		default:
+			return d.Errf("unknown varnish option '%s'", key)
+		}
+		return nil
+	})
+}
+
+// Provision checks the Varnish address
+func (v *Varnish) Provision(ctx caddy.Context) error {
+	if v.BaseURL == "" {
+		return errors.New("varnish needs a base_url")
+	}
+	if v.Method == "" {
+		v.Method = "BAN"
+	}
+	if v.TagHeader == "" {
+		v.TagHeader = "X-Cache-Tags"
+	}
+	v.provision("varnish", 50, "")
+	v.tags = cdnTagHeader{name: http.CanonicalHeaderKey(v.TagHeader), sep: ","}
+	return nil
+}
+
+// Purge bans the batch with one request per host, the paths joined into one regex
+func (v *Varnish) Purge(ctx context.Context, p *CDNPurge) error {
+	if p.All {
+		return v.ban(ctx, http.Header{"X-Ban-Host": {"."}, "X-Ban-Url": {"."}})
+	}
+	if len(p.Tags) > 0 {
+		quoted := make([]string, len(p.Tags))
+		for i, tag := range p.Tags {
+			quoted[i] = regexp.QuoteMeta(tag)
+		}
+		return v.ban(ctx, http.Header{"X-Ban-Tags": {`(^|,)\s*(` + strings.Join(quoted, "|") + `)\s*(,|$)`}})
+	}
+
+	paths := make(map[string][]string)
+	hosts := make([]string, 0, 1)
+	add := func(raw, suffix string) {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return
+		}
+		if _, ok := paths[u.Host]; !ok {
+			hosts = append(hosts, u.Host)
+		}
+		paths[u.Host] = append(paths[u.Host], regexp.QuoteMeta(u.Path)+suffix)
+	}
+	for _, u := range p.URLs {
+		// any query string of the page too
+		add(u, `(\?.*)?$`)
+	}
+	for _, prefix := range p.Prefixes {
+		add(prefix, "")
+	}
+	for _, host := range hosts {
+		err := v.ban(ctx, http.Header{
+			"X-Ban-Host": {"^" + regexp.QuoteMeta(host) + "$"},
+			"X-Ban-Url":  {"^(" + strings.Join(paths[host], "|") + ")"},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *Varnish) ban(ctx context.Context, hdr http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, v.Method, v.BaseURL+"/", nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range hdr {
+		req.Header[name] = values
+	}
+	_, err = v.do(req)
+	return err
+}
+
+// Interface guards
+var (
+	_ CDNDriver             = (*Varnish)(nil)
+	_ caddy.Provisioner     = (*Varnish)(nil)
+	_ caddyfile.Unmarshaler = (*Varnish)(nil)
+)
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/puzpuzpuz/xsync"
+	"go.uber.org/zap"
+)
+
+// parseVary returns the request header names listed in a Vary header value.
+// Accept-Encoding is left out as every entry is already stored per encoding.
+func parseVary(value string) []string {
+	fields := make([]string, 0, 2)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "*" {
+			return []string{"*"}
+		}
+		name = http.CanonicalHeaderKey(name)
+		if name == "Accept-Encoding" || slices.Contains(fields, name) {
+			continue
+		}
+		fields = append(fields, name)
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// mergeVary sets Vary on the response to Accept-Encoding plus the fields the origin varied on
+func mergeVary(hdr http.Header, origin string) {
+	fields := append([]string{"Accept-Encoding"}, parseVary(origin)...)
+	hdr.Set("Vary", strings.Join(fields, ", "))
+}
+
+// variantKey appends a digest of the varied request headers to a flattened key
+func variantKey(key string, fields []string, reqHdr http.Header) string {
+	if len(fields) == 0 {
+		return key
+	}
+	h := sha256.New()
+	for _, name := range fields {
+		fmt.Fprintf(h, "%s:%s\n", name, strings.Join(reqHdr.Values(name), ","))
+	}
+	return fmt.Sprintf("%s|%x", key, h.Sum(nil)[:8])
+}
+
+func (d *Store) getVary() *xsync.MapOf[string, []string] {
+	vary, ok := d.vary.Load().(*xsync.MapOf[string, []string])
+	if !ok {
+		return nil
+	}
+	return vary
+}
+
+// loadVary returns the header names the entries under key vary on,
+// asking the tiers on first use
+func (d *Store) loadVary(key string) []string {
+	vary := d.getVary()
+	if fields, ok := vary.Load(key); ok {
+		return fields
+	}
+
+	for _, t := range d.tiers {
+		fields, err := t.Vary(key)
+		if err != nil {
+			continue
+		}
+		vary.Store(key, fields)
+		return fields
+	}
+	// nothing cached for the key, don't remember it
+	return nil
+}
+
+// storeVary records the header names the entries under key vary on
+func (d *Store) storeVary(key string, fields []string) {
+	vary := d.getVary()
+	if prev, ok := vary.Load(key); ok && slices.Equal(prev, fields) {
+		return
+	}
+	vary.Store(key, fields)
+
+	for _, t := range d.tiers {
+		if err := t.SetVary(key, fields); err != nil {
+			d.logger.Error("Error writing vary to "+t.name+" cache", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestParseVary(t *testing.T) {
+	tests := map[string][]string{
+		"":                                 {},
+		"Accept-Encoding":                  {},
+		"accept-language, Cookie":          {"Accept-Language", "Cookie"},
+		"Cookie, accept-encoding,, cookie": {"Cookie"},
+		"Accept-Language, *":               {"*"},
+		" X-Device , Accept-Language ":     {"Accept-Language", "X-Device"},
+	}
+	for value, want := range tests {
+		if got := parseVary(value); !slices.Equal(got, want) {
+			t.Errorf("parseVary(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+func TestVariantKey(t *testing.T) {
+	de := http.Header{"Accept-Language": {"de"}}
+	en := http.Header{"Accept-Language": {"en"}}
+	fields := []string{"Accept-Language"}
+
+	if got := variantKey("+a+::", nil, de); got != "+a+::" {
+		t.Errorf("key without vary fields = %q", got)
+	}
+	if variantKey("+a+::", fields, de) != variantKey("+a+::", fields, de.Clone()) {
+		t.Error("the same header gave different variants")
+	}
+	if variantKey("+a+::", fields, de) == variantKey("+a+::", fields, en) {
+		t.Error("different headers gave one variant")
+	}
+	if got := variantKey("+a+::", fields, http.Header{"Cookie": {"x"}}); got != variantKey("+a+::", fields, http.Header{}) {
+		t.Errorf("a header outside the fields changed the variant: %q", got)
+	}
+}
+
+func TestStoreVariants(t *testing.T) {
+	d := newTestStore(t, StoreOptions{})
+	for _, lang := range []string{"de", "en"} {
+		meta := testMeta()
+		meta.Header = [][]string{{"Vary", "Accept-Language"}}
+		if err := d.Set("/a/::", d.Generation(), http.Header{"Accept-Language": {lang}}, meta, []byte(lang)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, lang := range []string{"de", "en"} {
+		value, _, err := d.Get("/a/::", http.Header{"Accept-Language": {lang}}, "none")
+		if err != nil || string(value) != lang {
+			t.Errorf("Get of the %s variant = %q, %v", lang, value, err)
+		}
+	}
+	if _, _, err := d.Get("/a/::", http.Header{"Accept-Language": {"fr"}}, "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("Get of a variant never stored returned %v", err)
+	}
+}
+
+func TestStoreVaryStarBypasses(t *testing.T) {
+	d := newTestStore(t, StoreOptions{})
+	meta := testMeta()
+	meta.Header = [][]string{{"Vary", "Cookie, *"}}
+	if err := d.Set("/a/::", d.Generation(), http.Header{}, meta, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.Get("/a/::", http.Header{}, "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("response with Vary: * was stored, Get returned %v", err)
+	}
+}
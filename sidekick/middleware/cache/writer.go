@@ -5,7 +5,9 @@ import (
 	"net/url"
 	"slices"
 	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -19,11 +21,16 @@ func NewCustomWriter(rw http.ResponseWriter, r *http.Request, db *Store, logger
 
 		// keep original request info
 		// origHeader: r.Header.Clone(),
-		origUrl: *r.URL,
+		origUrl:  *r.URL,
+		cacheKey: db.buildCacheKey(r),
+		gen:      db.Generation(),
 
 		cacheMaxSize:       c.MemoryItemMaxSize,
 		cacheResponseCodes: c.CacheResponseCodes,
 		cacheHeaderName:    c.CacheHeaderName,
+		trustOrigin:        c.TrustOrigin,
+		tagsHeader:         c.TagsHeader,
+		edgeTags:           c.edgeTags,
 		status:             -1,
 	}
 	return &nw
@@ -40,9 +47,15 @@ type CustomWriter struct {
 	cacheResponseCodes []string
 	cacheHeaderName    string
 	cacheMaxSize       int
+	trustOrigin        bool
+	tagsHeader         string
+	edgeTags           []cdnTagHeader
 
 	// origHeader http.Header
-	origUrl url.URL
+	origUrl  url.URL
+	cacheKey string
+	// store generation at request start, a purge after it drops the write
+	gen uint64
 
 	// -1 means header not send yet
 	status int32
@@ -50,6 +63,15 @@ type CustomWriter struct {
 	// flag response data need to be cached
 	needCache int32
 
+	// expiry given by the origin headers, 0 when it gave none
+	expires int64
+	// purge tags sent by the origin
+	tags []string
+
+	// when set, 5xx responses are held back so a stale entry can be served instead
+	holdErrors bool
+	held       int32
+
 	// currently cache in memory
 	// assume response data not too large
 	// TODO: buffer pool
@@ -68,11 +90,23 @@ func (r *CustomWriter) Close() error {
 		if meta == nil {
 			return nil
 		}
-		r.Store.Set(r.origUrl.Path, "", meta, r.buf)
+		meta.Expires = r.expires
+		meta.Tags = r.tags
+		r.Store.Set(r.cacheKey, r.gen, r.Request.Header, meta, r.buf)
 	}
 	return nil
 }
 
+// Held reports whether a 5xx response was held back from the client
+func (r *CustomWriter) Held() bool {
+	return atomic.LoadInt32(&r.held) == 1
+}
+
+// Started reports whether the response header has been written
+func (r *CustomWriter) Started() bool {
+	return atomic.LoadInt32(&r.status) != -1
+}
+
 func (r *CustomWriter) Header() http.Header {
 	return r.ResponseWriter.Header()
 }
@@ -81,6 +115,20 @@ func (r *CustomWriter) WriteHeader(status int) {
 	r.Logger.Debug("==========-SetHeader-==========")
 	atomic.StoreInt32(&r.status, int32(status))
 
+	// tags are for purging here and on the CDNs, not for the client
+	if r.tagsHeader != "" {
+		hdr := r.Header()
+		r.tags = parseTags(strings.Join(hdr.Values(r.tagsHeader), ","))
+		hdr.Del(r.tagsHeader)
+		setEdgeTags(hdr, r.edgeTags, r.tags)
+	}
+
+	if r.holdErrors && status >= 500 {
+		r.Logger.Debug("Holding error response", zap.String("path", r.origUrl.Path), zap.Int("status", status))
+		atomic.StoreInt32(&r.held, 1)
+		return
+	}
+
 	r.Logger.Debug("Writing customwriter response", zap.String("path", r.origUrl.Path))
 	bypass := true
 
@@ -120,6 +168,27 @@ func (r *CustomWriter) WriteHeader(status int) {
 		}
 	}
 
+	// the response differs for every request
+	if slices.Contains(parseVary(hdr.Get("Vary")), "*") {
+		bypass = true
+	}
+
+	// let Cache-Control, Expires and Surrogate-Control decide
+	if r.trustOrigin {
+		now := time.Now()
+		f := OriginFreshness(hdr, now)
+		if !f.Cacheable || (f.Explicit && f.TTL == 0) {
+			if !bypass {
+				r.Logger.Debug("Bypass caching because of origin headers", zap.String("path", r.origUrl.Path))
+			}
+			bypass = true
+		} else if f.Explicit {
+			r.expires = now.Unix() + f.TTL
+		}
+		// Surrogate-Control is meant for this cache only
+		hdr.Del("Surrogate-Control")
+	}
+
 	cacheState := "BYPASS"
 	if bypass {
 		hdr.Set(r.cacheHeaderName, cacheState)
@@ -130,8 +199,6 @@ func (r *CustomWriter) WriteHeader(status int) {
 	atomic.StoreInt32(&r.needCache, 1)
 	cacheState = "MISS"
 
-	// TODO: prevent multiple CustomWriter cache when concurrent request same page (same cacheKey)
-
 	hdr.Set(r.cacheHeaderName, cacheState)
 	r.ResponseWriter.WriteHeader(status)
 }
@@ -143,6 +210,11 @@ func (r *CustomWriter) Write(b []byte) (int, error) {
 		r.WriteHeader(200)
 	}
 
+	// error response is replaced by a stale entry
+	if atomic.LoadInt32(&r.held) == 1 {
+		return len(b), nil
+	}
+
 	// save response data
 	if atomic.LoadInt32(&r.needCache) == 1 {
 		sz := len(r.buf) + len(b)
@@ -160,4 +232,4 @@ func (r *CustomWriter) Write(b []byte) (int, error) {
 	}
 
 	return r.ResponseWriter.Write(b)
-}
\ No newline at end of file
+}
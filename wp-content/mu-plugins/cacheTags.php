@@ -0,0 +1,50 @@
+<?php
+/**
+ * Plugin Name:     Cache Tags
+ * Author:          Stephen Miracle
+ * Description:     Tags cached pages with the posts, terms and authors they show, so a post update can purge them all.
+ * Version:         0.1.0
+ *
+ */
+
+
+add_action('template_redirect', function () {
+    global $wp_query;
+
+    $tags = [];
+    if (is_singular()) {
+        $post = get_queried_object();
+        $tags[] = 'post-' . $post->ID;
+        $tags[] = 'author-' . $post->post_author;
+        foreach (get_object_taxonomies($post->post_type) as $taxonomy) {
+            foreach (wp_get_post_terms($post->ID, $taxonomy, ['fields' => 'ids']) as $term_id) {
+                $tags[] = 'term-' . $term_id;
+            }
+        }
+    } elseif (is_category() || is_tag() || is_tax()) {
+        $tags[] = 'term-' . get_queried_object_id();
+    } elseif (is_author()) {
+        $tags[] = 'author-' . get_queried_object_id();
+    }
+
+    if (is_home() || is_front_page()) {
+        $tags[] = 'home';
+    }
+    if (is_feed()) {
+        $tags[] = 'feed';
+    }
+
+    // every post listed on an archive, home page or feed
+    if (!is_singular() && !empty($wp_query->posts)) {
+        foreach ($wp_query->posts as $listed) {
+            $tags[] = 'post-' . $listed->ID;
+        }
+    }
+
+    // wp_cache strips the header and passes the tags on to the configured CDNs,
+    // as Cache-Tag, Surrogate-Key or CDN-Tag
+    if (!empty($tags)) {
+        $header = $_SERVER['CACHE_TAGS_HEADER'] ?? 'X-Cache-Tags';
+        header($header . ': ' . implode(',', array_unique($tags)));
+    }
+});
@@ -3,78 +3,63 @@
  * Plugin Name:     Content Cache Purge
  * Author:          Stephen Miracle
  * Description:     Purge the content on publish.
- * Version:         0.2.0
+ * Version:         0.4.1
  *
  */
 
 
 add_action("save_post", function ($id) {
+    // Drafts, autosaves and revisions aren't cached, and their "/?p=42" permalinks
+    // would purge the home page
+    if (wp_is_post_revision($id) || wp_is_post_autosave($id) || get_post_status($id) !== "publish") {
+        return;
+    }
     $link = get_permalink($id);
 
-    // Purge local FrankenWP cache
-    $url = get_site_url() . $_SERVER["PURGE_PATH"] . wp_make_link_relative($link) . "/";
-    wp_remote_post($url, [
-        "headers" => [
-            "X-WPSidekick-Purge-Key" => $_SERVER["PURGE_KEY"],
-        ],
-        "sslverify" => false,
-    ]);
+    // Purge local FrankenWP cache, only the post itself and not the pages below it.
+    // The cache purges by path, the query of a plain permalink would clash with the mode.
+    $path = wp_parse_url($link, PHP_URL_PATH) ?: "/";
+    frankenwp_purge(add_query_arg("mode", "exact", $path));
 
-    // Purge Cloudflare cache if configured
-    purge_cloudflare_cache($link);
+    // Purge the archives, feeds and home page listing the post,
+    // the cache passes both purges on to the configured CDNs
+    frankenwp_purge("?tags=" . rawurlencode("post-" . $id));
 });
 
 /**
- * Purge Cloudflare cache for a specific URL
+ * Send a signed purge request to the FrankenWP cache
  *
- * @param string $url The URL to purge from Cloudflare cache
- * @return bool|WP_Error True on success, WP_Error on failure
+ * The signature is an HMAC-SHA256 with the first PURGE_KEY over the timestamp,
+ * a random nonce, method, request URI and body, sent as "t=<unix>,n=<nonce>,s=<hex>".
+ *
+ * @param string $path Path and query after PURGE_PATH
+ * @param string $body Request body, JSON for batch purges
+ * @return array|WP_Error The response
  */
-function purge_cloudflare_cache($url) {
-    // Check if Cloudflare integration is enabled
-    $cf_zone_id = getenv('CLOUDFLARE_ZONE_ID');
-    $cf_api_token = getenv('CLOUDFLARE_API_TOKEN');
-
-    if (empty($cf_zone_id) || empty($cf_api_token)) {
-        // Cloudflare not configured, skip silently
-        return true;
-    }
-
-    // Cloudflare API endpoint
-    $api_endpoint = sprintf(
-        'https://api.cloudflare.com/client/v4/zones/%s/purge_cache',
-        $cf_zone_id
-    );
-
-    // Prepare the request
-    $response = wp_remote_post($api_endpoint, [
-        'headers' => [
-            'Authorization' => 'Bearer ' . $cf_api_token,
-            'Content-Type' => 'application/json',
-        ],
-        'body' => json_encode([
-            'files' => [$url]
-        ]),
-        'timeout' => 15,
-    ]);
-
-    // Check for errors
-    if (is_wp_error($response)) {
-        error_log('Cloudflare cache purge failed: ' . $response->get_error_message());
-        return $response;
+function frankenwp_purge($path, $body = "") {
+    $keys = explode(",", $_SERVER["PURGE_KEY"] ?? "");
+    $key = trim($keys[0]);
+    if ($key === "") {
+        return new WP_Error('frankenwp_purge_no_key', 'PURGE_KEY is not set');
     }
 
-    $response_code = wp_remote_retrieve_response_code($response);
-    $response_body = json_decode(wp_remote_retrieve_body($response), true);
+    $url = get_site_url() . $_SERVER["PURGE_PATH"] . $path;
+    $parts = wp_parse_url($url);
+    $uri = $parts["path"] . (isset($parts["query"]) ? "?" . $parts["query"] : "");
+    $ts = time();
+    $nonce = bin2hex(random_bytes(8));
+    $signature = hash_hmac("sha256", $ts . "\n" . $nonce . "\n" . "POST" . "\n" . $uri . "\n" . $body, $key);
 
-    if ($response_code !== 200 || !$response_body['success']) {
-        $error_msg = isset($response_body['errors'])
-            ? json_encode($response_body['errors'])
-            : 'Unknown error';
-        error_log("Cloudflare cache purge failed for {$url}: {$error_msg}");
-        return new WP_Error('cloudflare_purge_failed', $error_msg);
+    $headers = [
+        "X-WPSidekick-Purge-Key" => "t=" . $ts . ",n=" . $nonce . ",s=" . $signature,
+    ];
+    if ($body !== "") {
+        $headers["Content-Type"] = "application/json";
     }
 
-    error_log("Successfully purged Cloudflare cache for: {$url}");
-    return true;
-}
\ No newline at end of file
+    return wp_remote_post($url, [
+        "headers" => $headers,
+        "body" => $body,
+        "sslverify" => false,
+    ]);
+}
@@ -0,0 +1,19 @@
+<?php
+/**
+ * Plugin Name:     Device Class
+ * Author:          Stephen Miracle
+ * Description:     Makes wp_is_mobile() agree with the device class the cache keys on.
+ * Version:         0.3.0
+ *
+ */
+
+
+add_filter('wp_is_mobile', function ($is_mobile) {
+    // set by wp_cache when device_detect is enabled, "1" for any class but the
+    // configured default, and stripped from client requests otherwise
+    $mobile = $_SERVER['HTTP_X_WPSIDEKICK_DEVICE_MOBILE'] ?? '';
+    if ($mobile === '') {
+        return $is_mobile;
+    }
+    return $mobile === '1';
+});